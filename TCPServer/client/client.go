@@ -0,0 +1,627 @@
+// Package client talks to a DataServer over its TCP protocol so callers don't
+// have to frame commands by hand.
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPoolSize    = 4
+	defaultDialTimeout = 5 * time.Second
+
+	// Protocol version asked for on every connection, the one with coded errors
+	protocolVersion = "2"
+)
+
+// TTL of a key that never expires
+const NoExpiry = time.Duration(-1)
+
+// Commands that come out the same if the server gets them twice, so they can
+// be sent again when a pooled connection fails. The rest could be applied
+// twice or answer differently the second time, a del would find the key gone.
+var idempotentCommands = map[string]bool{
+	"get": true,
+	"put": true,
+	"per": true,
+	"ttl": true,
+	"mgt": true,
+	"mpt": true,
+	"scn": true,
+	"cnt": true,
+	"rng": true,
+	"rrg": true,
+	"sts": true,
+	"mem": true,
+}
+
+type Options struct {
+	PoolSize    int           // idle connections kept open, 4 if not set
+	DialTimeout time.Duration // 5s if not set
+	Consistency string        // for writes, the server's default if not set
+}
+
+// How many cluster members have to have a write before the server answers.
+// One answers straight away, quorum waits for a majority and all for every
+// member that is up.
+const (
+	ConsistencyOne    = "one"
+	ConsistencyQuorum = "quorum"
+	ConsistencyAll    = "all"
+)
+
+type consistencyKey struct{}
+
+// Context for calls whose writes need a different consistency to the one in
+// Options. A write that doesn't reach enough replicas in time fails with
+// ErrReplicationTimeout, though the server it was sent to has still applied
+// it.
+func WithConsistency(ctx context.Context, level string) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, level)
+}
+
+func validConsistency(level string) bool {
+	return level == "" || level == ConsistencyOne || level == ConsistencyQuorum || level == ConsistencyAll
+}
+
+// Safe for concurrent use. Each call borrows a connection from the pool, or
+// opens one if they are all busy, and hands it back when done.
+type Client struct {
+	address string
+	options Options
+	idle    chan *conn
+	mutex   sync.Mutex
+	closed  bool
+}
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+}
+
+// Connect to the server at address, failing straight away if it can't be
+// reached
+func Dial(ctx context.Context, address string, options Options) (*Client, error) {
+	if !validConsistency(options.Consistency) {
+		return nil, fmt.Errorf("Unknown consistency %q", options.Consistency)
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = defaultPoolSize
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = defaultDialTimeout
+	}
+
+	c := &Client{
+		address: address,
+		options: options,
+		idle:    make(chan *conn, options.PoolSize),
+	}
+
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.release(cn)
+
+	return c, nil
+}
+
+// Close the idle connections, calls still running close theirs when done
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.netConn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	result, err := c.send(ctx, "get", key)
+	return result.Value, err
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	_, err := c.send(ctx, "put", key, value)
+	return err
+}
+
+// Put a key the server drops once ttl has passed, ttl is sent in milliseconds
+func (c *Client) PutWithTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := c.send(ctx, "pex", key, value, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Deleting a missing key gives ErrNotFound
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.send(ctx, "del", key)
+	return err
+}
+
+// Add delta to the integer at key, a missing key counts as 0. Gives
+// ErrNotInteger if the value isn't one and ErrOverflow if the result wouldn't
+// fit in an int64.
+func (c *Client) Increment(ctx context.Context, key string, delta int64) (int64, error) {
+	return counter(c.send(ctx, "inc", key, strconv.FormatInt(delta, 10)))
+}
+
+// Subtract delta from the integer at key, as Increment
+func (c *Client) Decrement(ctx context.Context, key string, delta int64) (int64, error) {
+	return counter(c.send(ctx, "dec", key, strconv.FormatInt(delta, 10)))
+}
+
+func counter(result Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := strconv.ParseInt(result.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad counter %q", ErrProtocol, result.Value)
+	}
+	return value, nil
+}
+
+// Set key to value if it currently holds expected. False if it didn't and
+// nothing was written.
+func (c *Client) CompareAndSwap(ctx context.Context, key, expected, value string) (bool, error) {
+	return conditional(c.send(ctx, "cas", key, expected, value))
+}
+
+// Put key if it doesn't exist, false if it already did
+func (c *Client) PutIfAbsent(ctx context.Context, key, value string) (bool, error) {
+	return conditional(c.send(ctx, "pnx", key, value))
+}
+
+// Put key if it already exists, false if it didn't
+func (c *Client) PutIfExists(ctx context.Context, key, value string) (bool, error) {
+	return conditional(c.send(ctx, "pxx", key, value))
+}
+
+func conditional(_ Result, err error) (bool, error) {
+	if err == ErrConditionFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Values of the keys that exist, fetched in one round trip. Missing keys are
+// left out of the map. The server takes up to 1024 keys in one batch.
+func (c *Client) GetMany(ctx context.Context, keys ...string) (map[string]string, error) {
+	if len(keys) == 0 {
+		return map[string]string{}, nil
+	}
+
+	result, err := c.send(ctx, "mgt", batchArgs(len(keys), keys)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Values) != len(keys) {
+		return nil, fmt.Errorf("%w: %d values for %d keys", ErrProtocol, len(result.Values), len(keys))
+	}
+
+	values := make(map[string]string, len(keys))
+	for i, value := range result.Values {
+		if value.Err == nil {
+			values[keys[i]] = value.Value
+		} else if value.Err != ErrNotFound {
+			return nil, value.Err
+		}
+	}
+
+	return values, nil
+}
+
+// Store every entry or none of them
+func (c *Client) PutMany(ctx context.Context, entries map[string]string) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	args := make([]string, 0, 2*len(entries))
+	for key, value := range entries {
+		args = append(args, key, value)
+	}
+
+	_, err := c.send(ctx, "mpt", batchArgs(len(entries), args)...)
+	return err
+}
+
+// Delete the keys, returning how many of them existed
+func (c *Client) DeleteMany(ctx context.Context, keys ...string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	result, err := c.send(ctx, "mdl", batchArgs(len(keys), keys)...)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := strconv.Atoi(result.Value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad count %q", ErrProtocol, result.Value)
+	}
+	return deleted, nil
+}
+
+// Batch commands lead with the number of entries
+func batchArgs(count int, args []string) []string {
+	return append([]string{strconv.Itoa(count)}, args...)
+}
+
+// Time left before key expires, NoExpiry if it never does
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	result, err := c.send(ctx, "ttl", key)
+	if err != nil {
+		return 0, err
+	}
+
+	ms, err := strconv.ParseInt(result.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad ttl %q", ErrProtocol, result.Value)
+	}
+	if ms < 0 {
+		return NoExpiry, nil
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Remove the expiry from a key
+func (c *Client) Persist(ctx context.Context, key string) error {
+	_, err := c.send(ctx, "per", key)
+	return err
+}
+
+// Server counters by name, such as keys and evictions
+func (c *Client) Stats(ctx context.Context) (map[string]int64, error) {
+	result, err := c.send(ctx, "sts")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]int64)
+	for _, field := range strings.Fields(result.Value) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: bad stat %q", ErrProtocol, field)
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad stat %q", ErrProtocol, field)
+		}
+		stats[name] = n
+	}
+
+	return stats, nil
+}
+
+// One page of the keys matching pattern, see the scn command. Start with an
+// empty cursor and pass back the one returned until it comes back empty.
+// count is at most 1000.
+func (c *Client) Scan(ctx context.Context, cursor, pattern string, count int) ([]string, string, error) {
+	result, err := c.send(ctx, "scn", cursor, pattern, strconv.Itoa(count))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(result.Values) == 0 {
+		return nil, "", fmt.Errorf("%w: scan without a cursor", ErrProtocol)
+	}
+
+	keys := make([]string, 0, len(result.Values)-1)
+	for _, value := range result.Values[1:] {
+		keys = append(keys, value.Value)
+	}
+
+	return keys, result.Values[0].Value, nil
+}
+
+// A key and its value from a range read
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Entries with keys from start to end, both included, in key order. An empty
+// start or end leaves that side open. limit is at most 1000.
+func (c *Client) Range(ctx context.Context, start, end string, limit int) ([]Entry, error) {
+	return entries(c.send(ctx, "rng", start, end, strconv.Itoa(limit)))
+}
+
+// Like Range, from end back towards start
+func (c *Client) ReverseRange(ctx context.Context, start, end string, limit int) ([]Entry, error) {
+	return entries(c.send(ctx, "rrg", start, end, strconv.Itoa(limit)))
+}
+
+// Pair up an arr of keys and values
+func entries(result Result, err error) ([]Entry, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Values)%2 != 0 {
+		return nil, fmt.Errorf("%w: key without a value", ErrProtocol)
+	}
+
+	entries := make([]Entry, 0, len(result.Values)/2)
+	for i := 0; i < len(result.Values); i += 2 {
+		entries = append(entries, Entry{Key: result.Values[i].Value, Value: result.Values[i+1].Value})
+	}
+	return entries, nil
+}
+
+// Number of keys on the server
+func (c *Client) Count(ctx context.Context) (int64, error) {
+	return counter(c.send(ctx, "cnt"))
+}
+
+// A cluster node as the server sees it. State is alive, suspect or dead.
+type Member struct {
+	Address     string
+	State       string
+	Incarnation uint64
+}
+
+// The server's view of its cluster, itself included. A standalone server
+// has no members.
+func (c *Client) Members(ctx context.Context) ([]Member, error) {
+	result, err := c.send(ctx, "mem")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Values)%3 != 0 {
+		return nil, fmt.Errorf("%w: member without a state", ErrProtocol)
+	}
+
+	members := make([]Member, 0, len(result.Values)/3)
+	for i := 0; i < len(result.Values); i += 3 {
+		incarnation, err := strconv.ParseUint(result.Values[i+2].Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad incarnation %q", ErrProtocol, result.Values[i+2].Value)
+		}
+		members = append(members, Member{Address: result.Values[i].Value, State: result.Values[i+1].Value, Incarnation: incarnation})
+	}
+	return members, nil
+}
+
+// Add a node to a raft cluster by the address of its cluster listener, token
+// is the admin token. Only one member can be added or removed at a time.
+func (c *Client) AddMember(ctx context.Context, token, address string) error {
+	_, err := c.send(ctx, "mad", token, address)
+	return err
+}
+
+// Take a node out of a raft cluster, like AddMember
+func (c *Client) RemoveMember(ctx context.Context, token, address string) error {
+	_, err := c.send(ctx, "mrm", token, address)
+	return err
+}
+
+// Ask the server to shut down, token is its admin token
+func (c *Client) Shutdown(ctx context.Context, token string) error {
+	_, err := c.send(ctx, "sdn", token)
+	return err
+}
+
+// Run a single command. The error is either what the server answered with
+// or why we couldn't get an answer.
+func (c *Client) send(ctx context.Context, name string, args ...string) (Result, error) {
+	results, err := c.do(ctx, []string{encodeCommand(name, args...)}, idempotentCommands[name])
+	if err != nil {
+		return Result{}, err
+	}
+	return results[0], results[0].Err
+}
+
+// Send requests on one connection and read a response to each, at the
+// consistency ctx asks for if it does. retry says whether they are all safe
+// to send twice.
+func (c *Client) do(ctx context.Context, requests []string, retry bool) ([]Result, error) {
+	level, override := ctx.Value(consistencyKey{}).(string)
+	if override {
+		if !validConsistency(level) {
+			return nil, fmt.Errorf("Unknown consistency %q", level)
+		}
+
+		// Just for these requests, the connection goes back to the pool as
+		// it was
+		requests = append(append([]string{encodeCommand("cns", level)}, requests...), encodeCommand("cns", c.options.Consistency))
+	}
+
+	results, err := c.roundTrip(ctx, requests, retry)
+	if err != nil || !override {
+		return results, err
+	}
+
+	for _, result := range []Result{results[0], results[len(results)-1]} {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+	}
+	return results[1 : len(results)-1], nil
+}
+
+// The server may have dropped a pooled connection while it sat idle, so a
+// failure on one of those is tried once more on a new connection if retry is
+// set. There's no telling whether the server got the requests before the
+// connection failed, so only idempotent ones can go again.
+func (c *Client) roundTrip(ctx context.Context, requests []string, retry bool) ([]Result, error) {
+	cn, reused, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := cn.exchange(ctx, requests)
+	if err != nil && reused && retry && ctx.Err() == nil {
+		cn.netConn.Close()
+
+		cn, err = c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		results, err = cn.exchange(ctx, requests)
+	}
+
+	if err != nil {
+		// No telling where the stream is up to, don't reuse it
+		cn.netConn.Close()
+		return nil, err
+	}
+
+	c.release(cn)
+	return results, nil
+}
+
+// An idle connection if there is one, otherwise a new one
+func (c *Client) acquire(ctx context.Context) (*conn, bool, error) {
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+
+	if closed {
+		return nil, false, ErrClosed
+	}
+
+	select {
+	case cn := <-c.idle:
+		return cn, true, nil
+	default:
+	}
+
+	cn, err := c.dial(ctx)
+	return cn, false, err
+}
+
+// Back to the pool, or closed if the pool is full
+func (c *Client) release(cn *conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		cn.netConn.Close()
+		return
+	}
+
+	select {
+	case c.idle <- cn:
+	default:
+		cn.netConn.Close()
+	}
+}
+
+// Open a connection and switch it to the protocol version we speak
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := net.Dialer{Timeout: c.options.DialTimeout}
+
+	netConn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{netConn: netConn, reader: bufio.NewReader(netConn)}
+
+	// A server too old to know ver answers with a bare err and we would wait
+	// forever for the code after it, so the handshake gets the dial timeout too
+	handshakeCtx, cancel := context.WithTimeout(ctx, c.options.DialTimeout)
+	defer cancel()
+
+	handshake := []string{encodeCommand("ver", protocolVersion)}
+	if c.options.Consistency != "" {
+		handshake = append(handshake, encodeCommand("cns", c.options.Consistency))
+	}
+
+	results, err := cn.exchange(handshakeCtx, handshake)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	if results[0].Value != protocolVersion {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: server doesn't speak protocol v%s", ErrProtocol, protocolVersion)
+	}
+
+	if len(results) > 1 && results[1].Err != nil {
+		netConn.Close()
+		return nil, results[1].Err
+	}
+
+	return cn, nil
+}
+
+// Write every request in one go and read the responses in order. Writing runs
+// alongside the reads so a long pipeline can't fill both sides' buffers and
+// stall.
+func (cn *conn) exchange(ctx context.Context, requests []string) ([]Result, error) {
+	// Only ctx cuts the exchange short, a socket deadline of its own could
+	// fire before ctx reports why
+	cn.netConn.SetDeadline(time.Time{})
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			cn.netConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(cn.netConn, strings.Join(requests, ""))
+		written <- err
+	}()
+
+	results := make([]Result, len(requests))
+	for i := range requests {
+		result, err := readResponse(cn.reader)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		results[i] = result
+	}
+
+	if err := <-written; err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return results, nil
+}
+
+// Report the context's error rather than the i/o timeout it caused
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
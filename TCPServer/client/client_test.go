@@ -0,0 +1,510 @@
+package client_test
+
+import (
+	"bytes"
+	"client"
+	"context"
+	"dataServer"
+	"errors"
+	"fmt"
+	"net"
+	"store"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const address = "localhost:1334"
+
+func TestClient(t *testing.T) {
+
+	t.Run("PutGetDelete", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		if err := c.Put(context.Background(), "k", "v"); err != nil {
+			t.Fatal("Put failed: ", err)
+		}
+
+		value, err := c.Get(context.Background(), "k")
+		if value != "v" || err != nil {
+			t.Error("Expected value: ", "v", " Actual value: ", value, err)
+		}
+
+		if err := c.Delete(context.Background(), "k"); err != nil {
+			t.Error("Delete failed: ", err)
+		}
+
+		if _, err := c.Get(context.Background(), "k"); !errors.Is(err, client.ErrNotFound) {
+			t.Error("Expected error: ", client.ErrNotFound, " Actual error: ", err)
+		}
+
+		if err := c.Delete(context.Background(), "k"); !errors.Is(err, client.ErrNotFound) {
+			t.Error("Expected error: ", client.ErrNotFound, " Actual error: ", err)
+		}
+	})
+
+	t.Run("EmptyAndLargeValues", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		large := strings.Repeat("v", 100000)
+		for _, expected := range []string{"", large} {
+			if err := c.Put(context.Background(), "k", expected); err != nil {
+				t.Fatal("Put failed: ", err)
+			}
+
+			value, err := c.Get(context.Background(), "k")
+			if value != expected || err != nil {
+				t.Error("Expected length: ", len(expected), " Actual length: ", len(value), err)
+			}
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		if err := c.PutWithTTL(context.Background(), "k", "v", time.Hour); err != nil {
+			t.Fatal("Put failed: ", err)
+		}
+
+		ttl, err := c.TTL(context.Background(), "k")
+		if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Error("Expected ttl just under: ", time.Hour, " Actual ttl: ", ttl, err)
+		}
+
+		if err := c.Persist(context.Background(), "k"); err != nil {
+			t.Error("Persist failed: ", err)
+		}
+
+		if ttl, err := c.TTL(context.Background(), "k"); ttl != client.NoExpiry || err != nil {
+			t.Error("Expected ttl: ", client.NoExpiry, " Actual ttl: ", ttl, err)
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		c.Put(context.Background(), "1", "Apple")
+		c.Put(context.Background(), "2", "Banana")
+
+		stats, err := c.Stats(context.Background())
+		if err != nil || stats["keys"] != 2 {
+			t.Error("Expected keys: ", 2, " Actual stats: ", stats, err)
+		}
+	})
+
+	t.Run("ServerError", func(t *testing.T) {
+		startServer(t, true)
+		c := dial(t)
+
+		err := c.Put(context.Background(), "k", "v")
+		if !errors.Is(err, client.ErrReadOnly) {
+			t.Error("Expected error: ", client.ErrReadOnly, " Actual error: ", err)
+		}
+
+		var serverErr *client.ServerError
+		if !errors.As(err, &serverErr) || serverErr.Message == "" {
+			t.Error("Expected a ServerError with a message, Actual error: ", err)
+		}
+	})
+
+	t.Run("OutOfMemory", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 10, Policy: store.EvictReject})
+		startServerWith(t, dataStore, false)
+		c := dial(t)
+
+		err := c.Put(context.Background(), "k", strings.Repeat("v", 100))
+		if !errors.Is(err, client.ErrOutOfMemory) {
+			t.Error("Expected error: ", client.ErrOutOfMemory, " Actual error: ", err)
+		}
+	})
+
+	t.Run("Pipeline", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		results, err := c.Pipeline().Put("a", "1").Put("b", "2").Get("a").Get("c").Delete("c").Exec(context.Background())
+		if err != nil {
+			t.Fatal("Exec failed: ", err)
+		}
+
+		expected := []client.Result{{}, {}, {Value: "1"}, {Err: client.ErrNotFound}, {Err: client.ErrNotFound}}
+		if len(results) != len(expected) {
+			t.Fatal("Expected results: ", len(expected), " Actual results: ", len(results))
+		}
+
+		for i := range expected {
+			if results[i].Value != expected[i].Value || !errors.Is(results[i].Err, expected[i].Err) {
+				t.Error("Expected result: ", expected[i], " Actual result: ", results[i])
+			}
+		}
+	})
+
+	t.Run("ConditionalPuts", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+		ctx := context.Background()
+
+		steps := []struct {
+			name     string
+			call     func() (bool, error)
+			expected bool
+		}{
+			{"PutIfExistsMissing", func() (bool, error) { return c.PutIfExists(ctx, "k", "v") }, false},
+			{"PutIfAbsent", func() (bool, error) { return c.PutIfAbsent(ctx, "k", "v") }, true},
+			{"PutIfAbsentPresent", func() (bool, error) { return c.PutIfAbsent(ctx, "k", "w") }, false},
+			{"CompareAndSwapWrongValue", func() (bool, error) { return c.CompareAndSwap(ctx, "k", "w", "x") }, false},
+			{"CompareAndSwap", func() (bool, error) { return c.CompareAndSwap(ctx, "k", "v", "x") }, true},
+			{"PutIfExists", func() (bool, error) { return c.PutIfExists(ctx, "k", "y") }, true},
+		}
+
+		for _, step := range steps {
+			if written, err := step.call(); written != step.expected || err != nil {
+				t.Error(step.name, " Expected written: ", step.expected, " Actual written: ", written, err)
+			}
+		}
+
+		if value, err := c.Get(ctx, "k"); value != "y" || err != nil {
+			t.Error("Expected value: ", "y", " Actual value: ", value, err)
+		}
+	})
+
+	t.Run("Counters", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+		ctx := context.Background()
+
+		if value, err := c.Increment(ctx, "n", 5); value != 5 || err != nil {
+			t.Error("Expected value: ", 5, " Actual value: ", value, err)
+		}
+		if value, err := c.Decrement(ctx, "n", 7); value != -2 || err != nil {
+			t.Error("Expected value: ", -2, " Actual value: ", value, err)
+		}
+
+		c.Put(ctx, "s", "Apple")
+		if _, err := c.Increment(ctx, "s", 1); !errors.Is(err, client.ErrNotInteger) {
+			t.Error("Expected error: ", client.ErrNotInteger, " Actual error: ", err)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		if err := c.PutMany(context.Background(), map[string]string{"a": "1", "b": ""}); err != nil {
+			t.Fatal("PutMany failed: ", err)
+		}
+
+		values, err := c.GetMany(context.Background(), "a", "b", "c")
+		if err != nil || len(values) != 2 || values["a"] != "1" || values["b"] != "" {
+			t.Error("Expected values: ", "map[a:1 b:]", " Actual values: ", values, err)
+		}
+
+		deleted, err := c.DeleteMany(context.Background(), "a", "c")
+		if deleted != 1 || err != nil {
+			t.Error("Expected deleted: ", 1, " Actual deleted: ", deleted, err)
+		}
+	})
+
+	t.Run("ScanAndCount", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+		ctx := context.Background()
+
+		c.PutMany(ctx, map[string]string{"u:1": "", "u:2": "", "u:3": "", "x": ""})
+
+		if n, err := c.Count(ctx); n != 4 || err != nil {
+			t.Error("Expected count: ", 4, " Actual count: ", n, err)
+		}
+
+		var keys []string
+		cursor := ""
+		for {
+			page, next, err := c.Scan(ctx, cursor, "u:*", 2)
+			if err != nil {
+				t.Fatal("Scan failed: ", err)
+			}
+			keys = append(keys, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		if fmt.Sprint(keys) != "[u:1 u:2 u:3]" {
+			t.Error("Expected keys: ", "[u:1 u:2 u:3]", " Actual keys: ", keys)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+		ctx := context.Background()
+
+		c.PutMany(ctx, map[string]string{"a": "1", "b": "2", "c": "3"})
+
+		entries, err := c.Range(ctx, "b", "", 10)
+		if err != nil || fmt.Sprint(entries) != "[{b 2} {c 3}]" {
+			t.Error("Expected entries: ", "[{b 2} {c 3}]", " Actual entries: ", entries, err)
+		}
+
+		entries, err = c.ReverseRange(ctx, "", "", 2)
+		if err != nil || fmt.Sprint(entries) != "[{c 3} {b 2}]" {
+			t.Error("Expected entries: ", "[{c 3} {b 2}]", " Actual entries: ", entries, err)
+		}
+	})
+
+	t.Run("Members", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		members, err := c.Members(context.Background())
+		if err != nil || len(members) != 0 {
+			t.Error("Expected members: ", 0, " Actual members: ", members, err)
+		}
+	})
+
+	t.Run("ChangeMembers", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		// No admin token set on the server
+		if err := c.AddMember(context.Background(), "token", "127.0.0.1:8004"); !errors.Is(err, client.ErrUnauthorized) {
+			t.Error("Expected error: ", client.ErrUnauthorized, " Actual error: ", err)
+		}
+
+		if err := c.RemoveMember(context.Background(), "token", "not an address"); !errors.Is(err, client.ErrMalformed) {
+			t.Error("Expected error: ", client.ErrMalformed, " Actual error: ", err)
+		}
+	})
+
+	t.Run("Consistency", func(t *testing.T) {
+		startServer(t, false)
+
+		// A standalone server has nobody to wait for so every level acks
+		c, err := client.Dial(context.Background(), address, client.Options{Consistency: client.ConsistencyAll})
+		if err != nil {
+			t.Fatal("Failed to connect: ", err)
+		}
+		defer c.Close()
+
+		ctx := client.WithConsistency(context.Background(), client.ConsistencyQuorum)
+		if err := c.Put(ctx, "a", "1"); err != nil {
+			t.Error("Expected error: ", nil, " Actual error: ", err)
+		}
+
+		results, err := c.Pipeline().Put("b", "2").Get("a").Exec(ctx)
+		if err != nil || len(results) != 2 || results[0].Err != nil || results[1].Value != "1" {
+			t.Error("Expected results: ", "[{} {1}]", " Actual results: ", results, err)
+		}
+
+		if err := c.Put(client.WithConsistency(context.Background(), "most"), "a", "1"); err == nil {
+			t.Error("Expected an error for an unknown consistency")
+		}
+
+		if _, err := client.Dial(context.Background(), address, client.Options{Consistency: "most"}); err == nil {
+			t.Error("Expected Dial to reject an unknown consistency")
+		}
+	})
+
+	t.Run("ConcurrentCalls", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+
+		var wait sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wait.Add(1)
+			go func(i int) {
+				defer wait.Done()
+
+				key := strconv.Itoa(i)
+				for j := 0; j < 20; j++ {
+					if err := c.Put(context.Background(), key, key); err != nil {
+						t.Error("Put failed: ", err)
+						return
+					}
+					if value, err := c.Get(context.Background(), key); value != key || err != nil {
+						t.Error("Expected value: ", key, " Actual value: ", value, err)
+						return
+					}
+				}
+			}(i)
+		}
+		wait.Wait()
+	})
+
+	t.Run("ReconnectAfterRestart", func(t *testing.T) {
+		server := startServer(t, false)
+		c := dial(t)
+
+		c.Put(context.Background(), "k", "v")
+		server.Shutdown(context.Background())
+
+		// The pooled connection is dead, the call goes through on a new one
+		startServer(t, false)
+		if _, err := c.Get(context.Background(), "k"); !errors.Is(err, client.ErrNotFound) {
+			t.Error("Expected error: ", client.ErrNotFound, " Actual error: ", err)
+		}
+	})
+
+	t.Run("NoRetryOnceSent", func(t *testing.T) {
+		startServer(t, false)
+
+		c, err := client.Dial(context.Background(), dropAfterIncrement(t), client.Options{})
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Failed to connect: %v", err))
+		}
+		defer c.Close()
+
+		// The server applies it but the answer never arrives, sending it
+		// again would count it twice
+		if _, err := c.Increment(context.Background(), "counter", 1); err == nil {
+			t.Error("Expected the lost answer to be an error")
+		}
+
+		if value, err := dial(t).Get(context.Background(), "counter"); value != "1" {
+			t.Error("Expected value: 1 Actual value: ", value, err)
+		}
+	})
+
+	t.Run("ContextTimeout", func(t *testing.T) {
+		// Accepts connections and never answers
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if _, err := client.Dial(ctx, listener.Addr().String(), client.Options{}); err != context.DeadlineExceeded {
+			t.Error("Expected error: ", context.DeadlineExceeded, " Actual error: ", err)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		startServer(t, false)
+		c := dial(t)
+		c.Close()
+
+		if err := c.Put(context.Background(), "k", "v"); err != client.ErrClosed {
+			t.Error("Expected error: ", client.ErrClosed, " Actual error: ", err)
+		}
+	})
+}
+
+// Helper functions
+
+// Standalone server on address, shut down when the test ends
+func startServer(t *testing.T, readOnly bool) *dataServer.DataServer {
+	return startServerWith(t, store.NewDataStore(), readOnly)
+}
+
+func startServerWith(t *testing.T, dataStore *store.DataStore, readOnly bool) *dataServer.DataServer {
+	server := dataServer.NewDataServer(dataStore, true, "server.log", "")
+	server.SetReadOnly(readOnly)
+	go server.InitClientListener(address)
+
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+
+	// The listener comes up in the background
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return server
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Server didn't start")
+	return nil
+}
+
+// A proxy to the server on address that closes the client's side of a
+// connection instead of passing on the answer to an inc
+func dropAfterIncrement(t *testing.T) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			clientConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serverConn, err := net.Dial("tcp", address)
+			if err != nil {
+				clientConn.Close()
+				return
+			}
+
+			var sentIncrement int32
+			go func() {
+				defer serverConn.Close()
+				buffer := make([]byte, 4096)
+				for {
+					n, err := clientConn.Read(buffer)
+					if bytes.Contains(buffer[:n], []byte("inc")) {
+						atomic.StoreInt32(&sentIncrement, 1)
+					}
+					serverConn.Write(buffer[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer clientConn.Close()
+				buffer := make([]byte, 4096)
+				for {
+					n, err := serverConn.Read(buffer)
+					if n > 0 && atomic.LoadInt32(&sentIncrement) == 1 {
+						return
+					}
+					clientConn.Write(buffer[:n])
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T) *client.Client {
+	c, err := client.Dial(context.Background(), address, client.Options{})
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Failed to connect: %v", err))
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codes the server sends with an err response
+const (
+	CodeMissingKey   = "missing_key"
+	CodeMalformed    = "malformed"
+	CodeTooLarge     = "too_large"
+	CodeReadOnly     = "read_only"
+	CodeUnauthorized = "unauthorized"
+	CodeInternal     = "internal"
+	CodeNotInteger   = "not_integer"
+	CodeOverflow     = "overflow"
+
+	// The server is at its memory limit and rejects writes rather than
+	// evicting keys
+	CodeOutOfMemory = "out_of_memory"
+
+	// The write was applied on the server but not enough replicas confirmed
+	// it in time
+	CodeReplicationTimeout = "replication_timeout"
+
+	// Raft mode, there was no leader to take the write, or the one that took
+	// it lost it. Either way it wasn't applied.
+	CodeNoLeader = "no_leader"
+
+	// Raft mode, the members couldn't be changed as asked
+	CodeMembership = "membership"
+)
+
+// An err response from the server
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Any two errors with the same code match, so errors.Is(err, ErrReadOnly)
+// works whatever message came with it
+func (e *ServerError) Is(target error) bool {
+	t, ok := target.(*ServerError)
+	return ok && t.Code == e.Code
+}
+
+var (
+	// One per server error code. Get answers ErrNotFound for a missing key
+	// just like Delete does.
+	ErrNotFound     = &ServerError{Code: CodeMissingKey}
+	ErrMalformed    = &ServerError{Code: CodeMalformed}
+	ErrTooLarge     = &ServerError{Code: CodeTooLarge}
+	ErrReadOnly     = &ServerError{Code: CodeReadOnly}
+	ErrUnauthorized = &ServerError{Code: CodeUnauthorized}
+	ErrInternal     = &ServerError{Code: CodeInternal}
+	ErrNotInteger   = &ServerError{Code: CodeNotInteger}
+	ErrOverflow     = &ServerError{Code: CodeOverflow}
+	ErrOutOfMemory  = &ServerError{Code: CodeOutOfMemory}
+
+	ErrReplicationTimeout = &ServerError{Code: CodeReplicationTimeout}
+	ErrNoLeader           = &ServerError{Code: CodeNoLeader}
+	ErrMembership         = &ServerError{Code: CodeMembership}
+
+	// A conditional put that found the key in the wrong state, the server
+	// answers these with nak
+	ErrConditionFailed = errors.New("Condition not met")
+
+	// Client side failures
+	ErrClosed   = errors.New("Client closed")
+	ErrProtocol = errors.New("Bad response from server")
+)
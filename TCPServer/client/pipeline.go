@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Commands queued up to go to the server in a single write, saving a round
+// trip each. Not safe for concurrent use.
+type Pipeline struct {
+	client   *Client
+	requests []string
+	once     bool // holds a command that can't be sent twice
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+func (p *Pipeline) Get(key string) *Pipeline {
+	return p.add("get", key)
+}
+
+func (p *Pipeline) Put(key, value string) *Pipeline {
+	return p.add("put", key, value)
+}
+
+func (p *Pipeline) PutWithTTL(key, value string, ttl time.Duration) *Pipeline {
+	return p.add("pex", key, value, strconv.FormatInt(ttl.Milliseconds(), 10))
+}
+
+func (p *Pipeline) Delete(key string) *Pipeline {
+	return p.add("del", key)
+}
+
+func (p *Pipeline) Persist(key string) *Pipeline {
+	return p.add("per", key)
+}
+
+// Number of commands queued
+func (p *Pipeline) Len() int {
+	return len(p.requests)
+}
+
+// Send everything queued and wait for the responses, which line up with the
+// order the commands were added in. The error is only set if the exchange
+// itself failed, check each Result for what the server made of its command.
+// The pipeline is empty again afterwards.
+func (p *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+	requests, once := p.requests, p.once
+	p.requests, p.once = nil, false
+
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	return p.client.do(ctx, requests, !once)
+}
+
+func (p *Pipeline) add(name string, args ...string) *Pipeline {
+	p.requests = append(p.requests, encodeCommand(name, args...))
+	p.once = p.once || !idempotentCommands[name]
+	return p
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Args are a digit giving the size of the length field, the length and then
+// the bytes, so "k" goes out as 11k and an empty string as 10
+func encodeArg(arg string) string {
+	length := strconv.Itoa(len(arg))
+	return fmt.Sprintf("%d%s%s", len(length), length, arg)
+}
+
+func encodeCommand(name string, args ...string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, arg := range args {
+		sb.WriteString(encodeArg(arg))
+	}
+	return sb.String()
+}
+
+// Outcome of one command. Value is only set for commands answered with val
+// and Values for those answered with arr, Err holds what the server said went
+// wrong.
+type Result struct {
+	Value  string
+	Values []Result
+	Err    error
+}
+
+// Read the response to one command. The error is only for a broken stream,
+// failures the server reported end up in Result.Err.
+func readResponse(r *bufio.Reader) (Result, error) {
+	kind := make([]byte, 3)
+	if _, err := io.ReadFull(r, kind); err != nil {
+		return Result{}, err
+	}
+
+	switch string(kind) {
+	case "ack":
+		return Result{}, nil
+	case "nil":
+		return Result{Err: ErrNotFound}, nil
+	case "nak":
+		return Result{Err: ErrConditionFailed}, nil
+	case "val":
+		value, err := readArg(r)
+		if err != nil {
+			return Result{}, err
+		}
+		return Result{Value: value}, nil
+	case "arr":
+		// A count and then a response for each entry
+		countArg, err := readArg(r)
+		if err != nil {
+			return Result{}, err
+		}
+		count, err := strconv.Atoi(countArg)
+		if err != nil || count < 0 {
+			return Result{}, fmt.Errorf("%w: bad count %q", ErrProtocol, countArg)
+		}
+
+		values := make([]Result, 0, count)
+		for i := 0; i < count; i++ {
+			value, err := readResponse(r)
+			if err != nil {
+				return Result{}, err
+			}
+			values = append(values, value)
+		}
+		return Result{Values: values}, nil
+	case "err":
+		code, err := readArg(r)
+		if err != nil {
+			return Result{}, err
+		}
+		message, err := readArg(r)
+		if err != nil {
+			return Result{}, err
+		}
+		return Result{Err: &ServerError{Code: code, Message: message}}, nil
+	}
+
+	return Result{}, fmt.Errorf("%w: unexpected %q", ErrProtocol, kind)
+}
+
+func readArg(r *bufio.Reader) (string, error) {
+	lengthByte, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	lengthBytes := int(lengthByte - '0')
+	if lengthBytes < 1 || lengthBytes > 9 {
+		return "", ErrProtocol
+	}
+
+	lengthField := make([]byte, lengthBytes)
+	if _, err := io.ReadFull(r, lengthField); err != nil {
+		return "", err
+	}
+
+	length, err := strconv.Atoi(string(lengthField))
+	if err != nil || length < 0 || len(strconv.Itoa(length)) != lengthBytes {
+		return "", ErrProtocol
+	}
+
+	arg := make([]byte, length)
+	if _, err := io.ReadFull(r, arg); err != nil {
+		return "", err
+	}
+
+	return string(arg), nil
+}
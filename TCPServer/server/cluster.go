@@ -0,0 +1,230 @@
+package dataServer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Carries cluster messages between nodes. All the server needs is to send a
+// datagram to an address and read the next one to arrive, so tests can run a
+// cluster without a network.
+type Transport interface {
+	// Send msg to addr as a single datagram
+	Send(addr string, msg []byte) error
+
+	// Block until a datagram arrives, returning its size and the sender's
+	// address, which is the address it can be answered on
+	Receive(buffer []byte) (int, string, error)
+
+	LocalAddr() string
+	Close() error
+}
+
+// Transport over a single UDP socket used to both send and receive, so the
+// address peers see us sending from is the one we listen on
+type udpTransport struct {
+	conn      *net.UDPConn
+	addrs     map[string]*net.UDPAddr // resolved peer addresses
+	addrMutex sync.Mutex
+}
+
+// Transport listening on the given ip:port
+func ListenUDP(address string) (Transport, error) {
+	la, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", la)
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpTransport{conn: conn, addrs: make(map[string]*net.UDPAddr)}, nil
+}
+
+func (t *udpTransport) Send(addr string, msg []byte) error {
+	ra, err := t.resolve(addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.conn.WriteToUDP(msg, ra)
+	return err
+}
+
+func (t *udpTransport) Receive(buffer []byte) (int, string, error) {
+	n, remote, err := t.conn.ReadFromUDP(buffer)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, remote.String(), nil
+}
+
+func (t *udpTransport) LocalAddr() string {
+	return t.conn.LocalAddr().String()
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Peers are written to on every replicated write, only look them up once
+func (t *udpTransport) resolve(addr string) (*net.UDPAddr, error) {
+	t.addrMutex.Lock()
+	defer t.addrMutex.Unlock()
+
+	if ra, ok := t.addrs[addr]; ok {
+		return ra, nil
+	}
+
+	ra, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.addrs[addr] = ra
+	return ra, nil
+}
+
+// Open the cluster socket on the udp address given to NewDataServer, call
+// before InitClusterListener. Peers answer the address we advertise, so a
+// wildcard one like 0.0.0.0 needs SetAdvertiseAddr.
+func (ds *DataServer) SetupClusterConn() error {
+	if err := checkAdvertiseAddr(ds.self); err != nil {
+		return err
+	}
+
+	transport, err := ListenUDP(ds.udpIP)
+	if err != nil {
+		return err
+	}
+
+	ds.transport = transport
+	return nil
+}
+
+// Talk to the cluster over transport rather than a UDP socket, in place of
+// SetupClusterConn
+func (ds *DataServer) SetTransport(transport Transport) {
+	ds.transport = transport
+}
+
+// Tell the cluster to reach us on addr rather than the udp address we listen
+// on, for when that is 0.0.0.0 or behind NAT. Call before SetPeers and
+// EnableRaft.
+func (ds *DataServer) SetAdvertiseAddr(addr string) error {
+	if err := checkAdvertiseAddr(addr); err != nil {
+		return err
+	}
+
+	options := ds.members.options
+	ds.self = addr
+	ds.members = newMembership(addr, ds.sendTo)
+	ds.members.options = options
+	ds.replicator = newReplicator(addr, ds.sendTo, ds.applyReplicatedMessage)
+	ds.replicator.resync = ds.resyncReplica
+	return nil
+}
+
+// Addresses of other nodes' cluster listeners. They are taken to be members
+// until probing finds otherwise and are asked for the rest of the cluster
+// when the listener starts, so one seed is enough. Our own address is left
+// out so every node can be given the same list.
+func (ds *DataServer) SetPeers(peers []string) {
+	ds.peers = nil
+	for _, peer := range peers {
+		if peer != ds.self {
+			ds.peers = append(ds.peers, peer)
+			ds.members.add(peer)
+		}
+	}
+}
+
+// Timings for failure detection, call before InitClusterListener
+func (ds *DataServer) SetGossipOptions(options GossipOptions) {
+	ds.members.options = options
+}
+
+// Peer addresses from a comma separated list of ip:port
+func ParsePeers(list string) ([]string, error) {
+	var peers []string
+
+	for _, peer := range strings.Split(list, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+
+		if err := checkPeer(peer); err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// Peer addresses from a file with one ip:port per line. Blank lines and lines
+// starting with # are skipped.
+func LoadPeersFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var peers []string
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		peer := strings.TrimSpace(scanner.Text())
+		if peer == "" || strings.HasPrefix(peer, "#") {
+			continue
+		}
+
+		if err := checkPeer(peer); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		peers = append(peers, peer)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// Our address as given to peers, which they send to, so it can't be a
+// wildcard
+func checkAdvertiseAddr(addr string) error {
+	if err := checkPeer(addr); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return fmt.Errorf("can't advertise %q to peers, give the address they can reach us on", addr)
+	}
+
+	return nil
+}
+
+func checkPeer(peer string) error {
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return fmt.Errorf("invalid peer %q: %w", peer, err)
+	}
+
+	if n, err := strconv.Atoi(port); host == "" || err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid peer %q", peer)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package dataServer
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// How many cluster members have to have a write before the client hears it
+// went through
+type Consistency string
+
+const (
+	// Answer once the write is applied here, replication carries on behind
+	ConsistencyOne Consistency = "one"
+
+	// Wait for a majority of every member we know of, dead ones included, to
+	// have the write. This node counts as one of them.
+	ConsistencyQuorum Consistency = "quorum"
+
+	// Wait for every member that isn't dead to have the write
+	ConsistencyAll Consistency = "all"
+)
+
+// How long a write waits on its replicas by default
+const DefaultConsistencyTimeout = 2 * time.Second
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch level := Consistency(s); level {
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return level, nil
+	}
+	return ConsistencyOne, fmt.Errorf("invalid consistency %q", s)
+}
+
+// Consistency for writes from connections that don't ask for one with cns,
+// and how long to wait for replicas before answering with a
+// replication_timeout err. The write has still been applied here when that
+// happens, and the replicas that missed it keep being sent it.
+func (ds *DataServer) SetConsistency(level Consistency, timeout time.Duration) {
+	ds.consistency = level
+	ds.consistencyTimeout = timeout
+}
+
+// Wait for as many members to apply a broadcast write as level asks for.
+// response is what the client gets if enough of them do.
+func (ds *DataServer) awaitReplicas(version int, level Consistency, acks *replicaAcks, response string) string {
+	needed := 0
+	switch level {
+	case ConsistencyQuorum:
+		needed = ds.members.size() / 2
+	case ConsistencyAll:
+		needed = acks.peers
+	}
+
+	if needed == 0 {
+		return response
+	}
+
+	ctx, cancel := context.WithTimeout(ds.ctx, ds.consistencyTimeout)
+	defer cancel()
+
+	if !acks.wait(ctx, needed) {
+		return errorResponse(version, errReplicationTimeout)
+	}
+	return response
+}
@@ -1,361 +1,1009 @@
-package dataServer
-
-import (
-	"fmt"
-	"log"
-	"net"
-	"os"
-	"strconv"
-	"strings"
-
-	"github.com/Emanuel-Nunes/Go-TCPServer/store"
-)
-
-type DataServer struct {
-	udpListenerConn *net.UDPConn
-	tcpListener     net.Listener
-	store           *store.DataStore
-	udpOn           bool
-	tcpOn           bool
-	standAlone      bool
-	log             *log.Logger
-	udpIP           string
-	udpConn         *net.UDPConn
-}
-
-func NewDataServer(store *store.DataStore, standAlone bool, logFile string, udpIP string) *DataServer {
-
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	dataServer := DataServer{
-		store:      store,
-		udpOn:      false,
-		tcpOn:      false,
-		standAlone: standAlone,
-		log:        log.New(file, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile),
-		udpIP:      udpIP,
-	}
-
-	return &dataServer
-}
-
-// TCP listener for client requests
-func (ds *DataServer) InitClientListener(address string) {
-	log.Println("Starting Server")
-
-	var err error
-	ds.tcpListener, err = net.Listen("tcp4", address)
-	if err != nil {
-		log.Println("TCP Listener failed.")
-		return
-	}
-
-	ds.tcpOn = true
-
-	for {
-		log.Println("Waiting for client connection")
-		connection, err := ds.tcpListener.Accept()
-		if err != nil {
-			break
-		}
-		log.Println("Connection accepted")
-		log.Println("Handling client request")
-		go ds.handleTCP(connection)
-	}
-}
-
-func (ds *DataServer) handleTCP(c net.Conn) {
-
-	for {
-		buffer := make([]byte, 2048)
-		_, err := c.Read(buffer)
-
-		if err != nil {
-			fmt.Fprintf(c, "err")
-			return
-		}
-
-		index := 0
-		upperBound := 3
-		commandString := string(buffer[index:upperBound])
-
-		switch commandString {
-		case "get":
-			// get key
-			key, _ := ds.parseArg(buffer[upperBound:])
-
-			if key == "" {
-				// Failure to retrieve arg
-				fmt.Fprintf(c, "err")
-				continue
-			}
-
-			fmt.Fprintf(c, ds.get(key))
-		case "del":
-			// get key
-			key, _ := ds.parseArg(buffer[upperBound:])
-
-			if key == "" {
-				// Failure to retrieve arg
-				fmt.Fprintf(c, "err")
-				continue
-			}
-
-			fmt.Fprintf(c, ds.delete(key))
-
-			if !ds.standAlone {
-				// Notify cluster leader
-				ds.broadcast(strings.TrimSpace(string(buffer)))
-			}
-
-		case "put":
-			// get key
-			key, pos := ds.parseArg(buffer[upperBound:])
-
-			if key == "" || pos == -1 {
-				// Failure to retrieve arg
-				fmt.Fprintf(c, "err")
-			}
-
-			// get value
-			value, _ := ds.parseArg(buffer[pos+3:])
-
-			if value == "" {
-				// We expect a value with a put request...
-				fmt.Fprintf(c, "err")
-			}
-
-			fmt.Fprintf(c, ds.put(key, value))
-
-			if !ds.standAlone {
-				// Notify cluster leader
-				log.Println("Notifying Cluster")
-				ds.broadcast(strings.Trim(string(buffer), "\x00"))
-			}
-		case "bye":
-			// Shutdown
-			if ds.udpOn {
-				ds.udpListenerConn.Close()
-				ds.udpConn.Close()
-			}
-			if ds.tcpOn {
-				ds.tcpListener.Close()
-			}
-		}
-	}
-}
-
-// UDP listener for distributed store cluster communication
-func (ds *DataServer) InitClusterListener() {
-
-	//local address
-	la, err := net.ResolveUDPAddr("udp4", ds.udpIP)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	ds.udpListenerConn, err = net.ListenUDP("udp4", la)
-	if err != nil {
-		log.Println("UDP Listener failed.", ds.udpIP)
-		log.Println(err)
-		return
-	}
-
-	log.Printf("Server listening %s\n", ds.udpListenerConn.LocalAddr().String())
-	ds.udpOn = true
-
-	for {
-		ds.handleUDP(ds.udpListenerConn)
-	}
-}
-
-func (ds *DataServer) handleUDP(conn *net.UDPConn) {
-
-	buffer := make([]byte, 2048)
-	length, remote, err := conn.ReadFromUDP(buffer[:])
-
-	if strings.Split(remote.String(), ":")[0] == strings.Split(conn.LocalAddr().String(), ":")[0] {
-		log.Println("Local addr: ", conn.LocalAddr().String(), ", Remote addr: ", remote.String(), "ignoring data")
-		return
-	}
-
-	if err != nil {
-		log.Println("Failed to read:", err)
-		return
-	}
-
-	data := strings.Trim(string(buffer[:length]), "\x00")
-	log.Printf("received: %s from %s\n", data, remote)
-
-	commandString := string(buffer[:3])
-
-	switch commandString {
-	case "del":
-		key, _ := ds.parseArg(buffer[3:])
-
-		if key == "" {
-			// Failure to retrieve arg
-			log.Println("Get failed key")
-			return
-		}
-
-		ds.delete(key)
-	case "put":
-		key, pos := ds.parseArg(buffer[3:])
-
-		if key == "" {
-			log.Println("Put failed key")
-			return
-		}
-
-		value, pos1 := ds.parseArg(buffer[pos+3:])
-
-		if value == "" || pos1 == -1 {
-			log.Println("Put failed value")
-
-		}
-
-		ds.put(key, value)
-	default:
-		log.Println("Default case")
-	}
-}
-
-func (ds *DataServer) broadcast(msg string) {
-	log.Println("In broadcast")
-	n, err := ds.udpConn.Write([]byte(msg))
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	log.Printf("%d bytes written\n", n)
-}
-
-// rename later
-func (ds *DataServer) SetupUDPConn() {
-
-	//local address
-	t := strings.Split(ds.udpIP, ":")[0] + ":8001"
-
-	la, err := net.ResolveUDPAddr("udp4", t)
-	if err != nil {
-		log.Println(err)
-		log.Println(ds.udpIP)
-		return
-	}
-
-	ra, err := net.ResolveUDPAddr("udp4", "255.255.255.255:8000")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	//dial
-	ds.udpConn, err = net.DialUDP("udp4", la, ra)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-}
-
-// Helpers
-
-// return key and position in buffer so we can retrieve next args value easier
-func (ds *DataServer) parseArg(buffer []byte) (string, int) {
-
-	if len(buffer) <= 0 {
-		// Invalid buffer
-		log.Println("Invalid buffer")
-		return "", -1
-	}
-
-	index := 0
-	upperBound := 0
-
-	lengthBytes, _ := strconv.Atoi(string(buffer[index]))
-
-	if lengthBytes < 1 || lengthBytes > 9 {
-		// error with length
-		log.Println("Invalid first part of arg")
-		return "", -1
-	}
-
-	index++
-	upperBound = (index + lengthBytes)
-
-	argLength, _ := strconv.Atoi(string(buffer[index:upperBound]))
-
-	// need to check digits are correct
-	if lengthBytes != getDigits(argLength) {
-		// arg length is 0, fail!
-		log.Println("Arg length is invalid")
-		return "", -1
-	}
-
-	index += lengthBytes
-	upperBound += argLength
-
-	argValue := string(buffer[index:upperBound])
-
-	if len(argValue) != argLength {
-		// string isn't the length we expected...
-		log.Println("Arg length is not what we expected")
-		return "", -1
-	}
-
-	index += upperBound - index
-
-	return argValue, index
-}
-
-func getDigits(n int) int {
-
-	if n < 0 {
-		return -1337
-	}
-
-	digits := 0
-	for n != 0 {
-		n /= 10
-		digits += 1
-	}
-
-	return digits
-}
-
-// Data store functions
-func (ds *DataServer) put(key, value string) string {
-	responseChannel := make(chan interface{})
-	msg := store.NewStoreMessage(responseChannel, []string{key, value})
-	ds.store.Put(msg)
-	<-responseChannel
-	return "ack"
-}
-
-func (ds *DataServer) get(key string) string {
-	responseChannel := make(chan interface{})
-	msg := store.NewStoreMessage(responseChannel, key)
-	ds.store.Get(msg)
-	result := <-responseChannel
-
-	convertedResults, ok := result.(store.GetContents)
-	if !ok || convertedResults.Err != nil || convertedResults.Value == "" {
-		return "nil"
-	}
-
-	digits := getDigits(len(convertedResults.Value))
-
-	return fmt.Sprintf("val%d%d%s", digits, len(convertedResults.Value), convertedResults.Value)
-}
-
-func (ds *DataServer) delete(key string) string {
-	responseChannel := make(chan interface{})
-	msg := store.NewStoreMessage(responseChannel, key)
-	ds.store.Delete(msg)
-	<-responseChannel
-	return "ack"
-}
+package dataServer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Emanuel-Nunes/Go-TCPServer/store"
+)
+
+// Default cap on the size of a single key or value sent by a client
+const DefaultMaxArgSize = 64 * 1024 * 1024
+
+// Client commands refused while the server is read only
+var writeCommands = map[string]bool{
+	"put": true,
+	"del": true,
+	"pex": true,
+	"per": true,
+	"mpt": true,
+	"mdl": true,
+	"cas": true,
+	"pnx": true,
+	"pxx": true,
+	"inc": true,
+	"dec": true,
+}
+
+// Longest TTL in milliseconds, 100 years. The store logs expiry times as
+// UnixNano which runs out in 2262, so now plus this has to stay short of it.
+const maxTTL = 100 * 365 * 24 * int64(time.Hour/time.Millisecond)
+
+type DataServer struct {
+	fragmentID         uint64 // accessed atomically, keep first for alignment
+	tcpListener        net.Listener
+	store              store.Store
+	tcpOn              bool
+	standAlone         bool
+	log                *log.Logger
+	udpIP              string
+	self               string // how the cluster knows us, udpIP unless SetAdvertiseAddr was called
+	transport          Transport
+	peers              []string // seeds to join through
+	members            *membership
+	replicator         *replicator
+	writeLocks         []sync.Mutex // one for each store shard, see lockKeys
+	raft               *raft        // nil unless EnableRaft was called
+	consistency        Consistency
+	consistencyTimeout time.Duration
+	maxArgSize         int
+	requestTimeout     time.Duration
+	readOnly           bool
+	fragments          *reassembler
+	adminToken         string
+	conns              map[net.Conn]struct{}
+	connsMutex         sync.Mutex
+	connsWait          sync.WaitGroup
+	quit               chan struct{} // closed when shutdown starts
+	done               chan struct{} // closed when shutdown has finished
+	ctx                context.Context
+	cancel             context.CancelFunc // cuts off store calls once the shutdown deadline passes
+}
+
+func NewDataServer(store store.Store, standAlone bool, logFile string, udpIP string) *DataServer {
+
+	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dataServer := DataServer{
+		store:              store,
+		tcpOn:              false,
+		standAlone:         standAlone,
+		log:                log.New(file, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile),
+		udpIP:              udpIP,
+		self:               udpIP,
+		maxArgSize:         DefaultMaxArgSize,
+		consistency:        ConsistencyOne,
+		consistencyTimeout: DefaultConsistencyTimeout,
+		conns:              make(map[net.Conn]struct{}),
+		quit:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	dataServer.writeLocks = make([]sync.Mutex, 1)
+	if sharded, ok := store.(shardedStore); ok {
+		dataServer.writeLocks = make([]sync.Mutex, sharded.Shards())
+	}
+	dataServer.ctx, dataServer.cancel = context.WithCancel(context.Background())
+	dataServer.members = newMembership(udpIP, dataServer.sendTo)
+	dataServer.replicator = newReplicator(udpIP, dataServer.sendTo, dataServer.applyReplicatedMessage)
+	dataServer.replicator.resync = dataServer.resyncReplica
+
+	return &dataServer
+}
+
+// Largest key or value accepted from a client, anything bigger gets an err
+func (ds *DataServer) SetMaxArgSize(maxArgSize int) {
+	ds.maxArgSize = maxArgSize
+}
+
+// How long a request may wait on the store before the client gets an err, 0
+// waits for as long as it takes
+func (ds *DataServer) SetRequestTimeout(timeout time.Duration) {
+	ds.requestTimeout = timeout
+}
+
+// Context for a single store call
+func (ds *DataServer) storeContext() (context.Context, context.CancelFunc) {
+	if ds.requestTimeout <= 0 {
+		return context.WithCancel(ds.ctx)
+	}
+	return context.WithTimeout(ds.ctx, ds.requestTimeout)
+}
+
+// Refuse writes from clients with a read_only error, replication from the
+// cluster still applies
+func (ds *DataServer) SetReadOnly(readOnly bool) {
+	ds.readOnly = readOnly
+}
+
+// TCP listener for client requests
+func (ds *DataServer) InitClientListener(address string) {
+	log.Println("Starting Server")
+
+	listener, err := net.Listen("tcp4", address)
+	if err != nil {
+		log.Println("TCP Listener failed.")
+		return
+	}
+
+	// Shutdown reads these from another goroutine, and may already have run
+	ds.connsMutex.Lock()
+	if ds.closing() {
+		ds.connsMutex.Unlock()
+		listener.Close()
+		<-ds.done
+		return
+	}
+	ds.tcpListener = listener
+	ds.tcpOn = true
+	ds.connsMutex.Unlock()
+
+	for {
+		log.Println("Waiting for client connection")
+		connection, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		if ds.closing() {
+			connection.Close()
+			break
+		}
+		log.Println("Connection accepted")
+		log.Println("Handling client request")
+		go ds.handleTCP(connection)
+	}
+
+	if ds.closing() {
+		// Don't return until in flight requests are done
+		<-ds.done
+	}
+}
+
+func (ds *DataServer) handleTCP(c net.Conn) {
+	if !ds.trackConn(c) {
+		// Shutting down
+		c.Close()
+		return
+	}
+	defer ds.untrackConn(c)
+	defer c.Close()
+
+	decoder := newDecoder(c, commandArgs, ds.maxArgSize)
+
+	// A batch is replicated as one message, so it has to fit in one
+	decoder.maxBatchBytes = ds.maxClusterMessage()
+
+	// Until the client asks for something newer with ver
+	version := protocolV1
+
+	// Until the client asks for another with cns
+	consistency := ds.consistency
+
+	for {
+		cmd, err := decoder.next()
+
+		if isProtocolError(err) {
+			// Malformed request, skip past what we have and wait for the next one
+			io.WriteString(c, errorResponse(version, err))
+			decoder.reset()
+			continue
+		}
+
+		if errors.Is(err, errArgTooLarge) || errors.Is(err, errBatchTooLarge) {
+			// Decoder has already skipped the rest of the request
+			io.WriteString(c, errorResponse(version, err))
+			continue
+		}
+
+		if err != nil {
+			// Client went away
+			return
+		}
+
+		// Every request gets exactly one response, a request that fails here
+		// never reaches the store or the cluster
+		if err := cmd.validate(); err != nil {
+			io.WriteString(c, errorResponse(version, err))
+			continue
+		}
+
+		if ds.readOnly && writeCommands[cmd.name] {
+			io.WriteString(c, errorResponse(version, errReadOnly))
+			continue
+		}
+
+		if ds.raft != nil && writeCommands[cmd.name] {
+			// Every write goes through the raft log so all nodes apply them
+			// in the same order, the client hears back once it's applied
+			io.WriteString(c, ds.propose(version, cmd))
+			continue
+		}
+
+		if writeCommands[cmd.name] {
+			io.WriteString(c, ds.write(version, consistency, cmd))
+			continue
+		}
+
+		switch cmd.name {
+		case "get":
+			io.WriteString(c, ds.get(version, cmd.args[0]))
+		case "ttl":
+			io.WriteString(c, ds.ttl(version, cmd.args[0]))
+		case "mgt":
+			io.WriteString(c, ds.getMany(version, cmd.args[1:]))
+		case "scn":
+			// Count already checked by validate
+			count, _ := strconv.Atoi(cmd.args[2])
+			io.WriteString(c, ds.scan(version, cmd.args[0], cmd.args[1], count))
+		case "cnt":
+			io.WriteString(c, ds.count(version))
+		case "rng", "rrg":
+			// Limit already checked by validate
+			limit, _ := strconv.Atoi(cmd.args[2])
+			io.WriteString(c, ds.readRange(version, cmd.args[0], cmd.args[1], limit, cmd.name == "rrg"))
+		case "sts":
+			io.WriteString(c, ds.stats(version))
+		case "mem":
+			io.WriteString(c, ds.memberList())
+		case "ver":
+			requested, err := strconv.Atoi(cmd.args[0])
+			if err != nil || requested < protocolV1 {
+				io.WriteString(c, errorResponse(version, errBadVersion))
+				continue
+			}
+
+			// Settle on the newest version we both speak and tell the client which
+			version = requested
+			if version > maxProtocolVersion {
+				version = maxProtocolVersion
+			}
+
+			io.WriteString(c, "val"+encodeArg(strconv.Itoa(version)))
+		case "cns":
+			// Consistency for the rest of this connection's writes, "" for
+			// the server's. Already checked by validate.
+			consistency = ds.consistency
+			if cmd.args[0] != "" {
+				consistency = Consistency(cmd.args[0])
+			}
+			io.WriteString(c, "ack")
+		case "mad", "mrm":
+			// Add or remove a raft member
+			if !ds.validAdminToken(cmd.args[0]) {
+				io.WriteString(c, errorResponse(version, errBadToken))
+				continue
+			}
+
+			io.WriteString(c, ds.changeMembers(version, cmd.name == "mad", cmd.args[1]))
+		case "bye":
+			// Client is done with this connection
+			return
+		case "sdn":
+			// Admin shutdown of the whole node
+			if !ds.validAdminToken(cmd.args[0]) {
+				io.WriteString(c, errorResponse(version, errBadToken))
+				continue
+			}
+
+			io.WriteString(c, "ack")
+
+			// Shutdown waits for this handler so it can't run on this goroutine
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+				defer cancel()
+				if err := ds.Shutdown(ctx); err != nil {
+					log.Println(err)
+				}
+			}()
+			return
+		}
+	}
+}
+
+// UDP listener for distributed store cluster communication, reads from the
+// connection opened by SetupClusterConn or SetTransport until shutdown
+func (ds *DataServer) InitClusterListener() {
+
+	if ds.transport == nil {
+		log.Println("No cluster connection to listen on")
+		return
+	}
+
+	log.Printf("Server listening %s\n", ds.transport.LocalAddr())
+
+	if ds.raft != nil {
+		// Raft has its own heartbeats and does its own replication
+		ds.raft.start(ds.quit)
+	} else {
+		go ds.members.run(ds.peers, ds.quit)
+		go ds.replicator.run(ds.members.live, ds.quit)
+	}
+
+	ds.fragments = newReassembler(ds.maxClusterMessage())
+
+	for !ds.closing() {
+		ds.handleUDP()
+	}
+}
+
+func (ds *DataServer) handleUDP() {
+
+	buffer := make([]byte, maxDatagramSize)
+	length, remote, err := ds.transport.Receive(buffer)
+
+	if err != nil {
+		if !ds.closing() {
+			log.Println("Failed to read:", err)
+		}
+		return
+	}
+
+	// Our own writes come back if a peer address is a broadcast address
+	if remote == ds.transport.LocalAddr() {
+		log.Println("Local addr: ", ds.transport.LocalAddr(), ", Remote addr: ", remote, "ignoring data")
+		return
+	}
+
+	log.Printf("received: %d bytes from %s\n", length, remote)
+
+	cmd, err := newDecoder(bytes.NewReader(buffer[:length]), clusterCommandArgs, maxDatagramSize).next()
+	if err != nil {
+		log.Println("Bad cluster message:", err)
+		return
+	}
+
+	if cmd.name == "frg" {
+		// Part of a message too big for one datagram
+		msg, complete := ds.fragments.add(remote, cmd)
+		if !complete {
+			return
+		}
+
+		cmd, err = newDecoder(strings.NewReader(msg), clusterCommandArgs, ds.maxClusterMessage()).next()
+		if err != nil || cmd.name == "frg" {
+			log.Println("Bad cluster message:", err)
+			return
+		}
+	}
+
+	switch cmd.name {
+	case "rep":
+		ds.replicator.receive(cmd)
+	case "rak":
+		ds.replicator.acked(cmd)
+	case "png", "prq", "pak", "jon", "syn":
+		ds.members.handle(cmd)
+	case "rvt", "rvr", "aen", "aer", "isn", "isr", "fwr":
+		if ds.raft != nil {
+			ds.raft.handle(cmd)
+		}
+	case "fwd":
+		if ds.raft != nil {
+			go ds.handleForward(cmd)
+		}
+	default:
+		if err := ds.applyReplicated(cmd); err != nil {
+			log.Println("Failed to apply write:", err)
+		}
+	}
+}
+
+// Room for a put with a key and value of the maximum size, or a full raft
+// append, plus framing
+func (ds *DataServer) maxClusterMessage() int {
+	size := 2 * ds.maxArgSize
+	if size < maxAppendBytes {
+		size = maxAppendBytes
+	}
+	return size + 1024
+}
+
+// A client write. It's applied here and handed to the replicator holding
+// the locks for its keys, so peers get writes to a key in the order we
+// applied them, then we wait for as many replicas as level asks for.
+func (ds *DataServer) write(version int, level Consistency, cmd command) string {
+	if ds.standAlone {
+		response, _ := ds.applyWrite(version, cmd)
+		return response
+	}
+
+	keys := writeKeys(cmd)
+	unlock := ds.lockKeys(keys)
+	response, replicated := ds.applyWrite(version, cmd)
+	var acks *replicaAcks
+	if replicated != "" {
+		acks = ds.broadcast(replicated, keys)
+	}
+	unlock()
+
+	if acks == nil {
+		// Failed, nothing for the cluster
+		return response
+	}
+	return ds.awaitReplicas(version, level, acks, response)
+}
+
+// Stores split by key, writes to different shards don't need to wait on
+// each other
+type shardedStore interface {
+	Shards() int
+	ShardIndex(key string) int
+}
+
+// Lock the write locks for keys, one for each shard they fall in. Batches
+// take theirs in index order so two can't each hold one the other wants.
+func (ds *DataServer) lockKeys(keys []string) func() {
+	var locks []int
+	if sharded, ok := ds.store.(shardedStore); ok && len(ds.writeLocks) > 1 {
+		used := make([]bool, len(ds.writeLocks))
+		for _, key := range keys {
+			used[sharded.ShardIndex(key)] = true
+		}
+		for i := range used {
+			if used[i] {
+				locks = append(locks, i)
+			}
+		}
+	} else {
+		locks = []int{0}
+	}
+
+	for _, i := range locks {
+		ds.writeLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range locks {
+			ds.writeLocks[i].Unlock()
+		}
+	}
+}
+
+// Keys a client write changes
+func writeKeys(cmd command) []string {
+	switch cmd.name {
+	case "mpt":
+		// Count then key value pairs
+		var keys []string
+		for i := 1; i < len(cmd.args); i += 2 {
+			keys = append(keys, cmd.args[i])
+		}
+		return keys
+	case "mdl":
+		return cmd.args[1:]
+	}
+	return cmd.args[:1]
+}
+
+// Apply a client write to the store. Returns the client's response and the
+// write peers get, "" if it didn't go through.
+func (ds *DataServer) applyWrite(version int, cmd command) (string, string) {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	switch cmd.name {
+	case "del":
+		response, _ := ds.delete(ctx, version, cmd.args[0])
+		if response != "ack" {
+			return response, ""
+		}
+		return response, cmd.encode()
+	case "put":
+		response, _ := ds.put(ctx, version, cmd.args[0], cmd.args[1])
+		if response != "ack" {
+			return response, ""
+		}
+		return response, cmd.encode()
+	case "pex":
+		// put with a TTL in milliseconds, already checked by validate
+		key, value := cmd.args[0], cmd.args[1]
+		ttl, _ := strconv.ParseInt(cmd.args[2], 10, 64)
+
+		expiry := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+
+		response, _ := ds.putWithExpiry(ctx, version, key, value, expiry)
+		if response != "ack" {
+			return response, ""
+		}
+
+		// Peers get the absolute expiry so they all drop the key at the same time
+		expiryArg := strconv.FormatInt(expiry.UnixMilli(), 10)
+		return response, command{name: "pxa", args: []string{key, value, expiryArg}}.encode()
+	case "per":
+		response, _ := ds.persist(ctx, version, cmd.args[0])
+		if response != "ack" {
+			return response, ""
+		}
+		return response, cmd.encode()
+	case "cas", "pnx", "pxx":
+		response, _ := ds.conditionalPut(ctx, version, cmd)
+		if response != "ack" {
+			return response, ""
+		}
+
+		// Peers get the outcome as a plain put, checking the condition
+		// against their own copy could go the other way
+		key, value := cmd.args[0], cmd.args[len(cmd.args)-1]
+		return response, command{name: "put", args: []string{key, value}}.encode()
+	case "inc", "dec":
+		// Delta already checked by validate
+		delta, _ := strconv.ParseInt(cmd.args[1], 10, 64)
+		if cmd.name == "dec" {
+			delta = -delta
+		}
+
+		response, value, expiry, _ := ds.increment(ctx, version, cmd.args[0], delta)
+		if value == "" {
+			return response, ""
+		}
+
+		// Peers are sent the result, adding the delta to their own copy
+		// could come out different
+		replicated := command{name: "put", args: []string{cmd.args[0], value}}
+		if !expiry.IsZero() {
+			replicated = command{name: "pxa", args: []string{cmd.args[0], value, strconv.FormatInt(expiry.UnixMilli(), 10)}}
+		}
+		return response, replicated.encode()
+	case "mpt":
+		// The whole batch goes out as one message so peers apply it in one go too
+		response, _ := ds.putMany(ctx, version, cmd.args[1:])
+		if response != "ack" {
+			return response, ""
+		}
+		return response, cmd.encode()
+	case "mdl":
+		response, _ := ds.deleteMany(ctx, version, cmd.args[1:])
+		if !strings.HasPrefix(response, "val") {
+			return response, ""
+		}
+		return response, cmd.encode()
+	}
+
+	return errorResponse(version, errUnknownCommand), ""
+}
+
+// Like applyReplicated for a write still in wire format
+func (ds *DataServer) applyReplicatedMessage(msg string) error {
+	cmd, err := newDecoder(strings.NewReader(msg), clusterCommandArgs, ds.maxClusterMessage()).next()
+	if err != nil {
+		// Never going to get any better
+		log.Println("Bad replicated write:", err)
+		return nil
+	}
+	return ds.applyReplicated(cmd)
+}
+
+// Apply a write another node replicated to us, an error if the store failed
+// so it's kept to try again rather than acked
+func (ds *DataServer) applyReplicated(cmd command) error {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	var err error
+	switch cmd.name {
+	case "del":
+		_, err = ds.delete(ctx, protocolV1, cmd.args[0])
+	case "put":
+		_, err = ds.put(ctx, protocolV1, cmd.args[0], cmd.args[1])
+	case "pxa":
+		expiry, parseErr := strconv.ParseInt(cmd.args[2], 10, 64)
+		if parseErr != nil {
+			log.Println("Put failed expiry")
+			return nil
+		}
+
+		_, err = ds.putWithExpiry(ctx, protocolV1, cmd.args[0], cmd.args[1], time.UnixMilli(expiry))
+	case "per":
+		_, err = ds.persist(ctx, protocolV1, cmd.args[0])
+	case "mpt":
+		_, err = ds.putMany(ctx, protocolV1, cmd.args[1:])
+	case "mdl":
+		_, err = ds.deleteMany(ctx, protocolV1, cmd.args[1:])
+	default:
+		log.Println("Default case")
+	}
+	return err
+}
+
+// Send a replicated write to every member that isn't dead. It is resent
+// until each of them acks it, see replicator.
+func (ds *DataServer) broadcast(msg string, keys []string) *replicaAcks {
+	log.Println("In broadcast")
+
+	members := ds.members.live()
+	acks := ds.replicator.replicate(members, msg, keys)
+	log.Printf("%d bytes written to %d members\n", len(msg), len(members))
+	return acks
+}
+
+// Send peer the current value of keys it missed writes to. The key locks
+// keep client writes to them out until it's queued, so it lands in order.
+func (ds *DataServer) resyncReplica(peer string, keys []string) error {
+	unlock := ds.lockKeys(keys)
+	defer unlock()
+
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	for _, key := range keys {
+		msg, err := ds.currentWrite(ctx, key)
+		if err != nil {
+			return err
+		}
+		ds.replicator.repair(peer, msg, []string{key})
+	}
+	return nil
+}
+
+// A write that leaves a replica's key the way ours is now
+func (ds *DataServer) currentWrite(ctx context.Context, key string) (string, error) {
+	value, err := ds.store.Get(ctx, key)
+	if err == store.ErrKeyNotFound {
+		return command{name: "del", args: []string{key}}.encode(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	expiry, err := ds.store.TTL(ctx, key)
+	if err == store.ErrKeyNotFound {
+		// Expired since the get
+		return command{name: "del", args: []string{key}}.encode(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if expiry.IsZero() {
+		return command{name: "put", args: []string{key, value}}.encode(), nil
+	}
+	return command{name: "pxa", args: []string{key, value, strconv.FormatInt(expiry.UnixMilli(), 10)}}.encode(), nil
+}
+
+// Send a cluster message to one node, split into fragments if it's too big
+// for a datagram
+func (ds *DataServer) sendTo(addr, msg string) {
+	if ds.transport == nil {
+		return
+	}
+
+	id := atomic.AddUint64(&ds.fragmentID, 1)
+
+	for _, datagram := range fragment(id, msg) {
+		if err := ds.transport.Send(addr, []byte(datagram)); err != nil {
+			log.Println("Failed to send to", addr, err)
+			return
+		}
+	}
+}
+
+// Helpers
+
+func getDigits(n int) int {
+
+	if n < 0 {
+		return -1337
+	}
+
+	digits := 0
+	for n != 0 {
+		n /= 10
+		digits += 1
+	}
+
+	return digits
+}
+
+// Data store functions
+// Responses are written for the client's protocol version, replication
+// passes protocolV1 and only looks for an ack. Writes take the caller's ctx
+// and also hand back the error when the store failed, as opposed to
+// answering with a missing key, nak and the like.
+func (ds *DataServer) put(ctx context.Context, version int, key, value string) (string, error) {
+	if err := ds.store.Put(ctx, key, value); err != nil {
+		// Not stored, either rejected for memory or the write ahead log couldn't be written
+		log.Println("Put failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "ack", nil
+}
+
+func (ds *DataServer) get(version int, key string) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	value, err := ds.store.Get(ctx, key)
+	if err == store.ErrKeyNotFound {
+		return "nil"
+	}
+	if err != nil {
+		log.Println("Get failed:", err)
+		return errorResponse(version, err)
+	}
+
+	// An empty value comes back as val10 so it can't be mistaken for a missing key
+	return "val" + encodeArg(value)
+}
+
+func (ds *DataServer) delete(ctx context.Context, version int, key string) (string, error) {
+	err := ds.store.Delete(ctx, key)
+	if err == store.ErrKeyNotFound {
+		if version < protocolV2 {
+			// v1 clients have always had an ack for a missing key
+			return "ack", nil
+		}
+		return errorResponse(version, err), nil
+	}
+	if err != nil {
+		log.Println("Delete failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "ack", nil
+}
+
+func (ds *DataServer) putWithExpiry(ctx context.Context, version int, key, value string, expiry time.Time) (string, error) {
+	if err := ds.store.PutWithExpiry(ctx, key, value, expiry); err != nil {
+		log.Println("Put failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "ack", nil
+}
+
+// Remaining time to live in milliseconds, -1 if the key doesn't expire
+func (ds *DataServer) ttl(version int, key string) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	expiry, err := ds.store.TTL(ctx, key)
+	if err == store.ErrKeyNotFound {
+		return "nil"
+	}
+	if err != nil {
+		log.Println("TTL failed:", err)
+		return errorResponse(version, err)
+	}
+
+	if expiry.IsZero() {
+		return "val" + encodeArg("-1")
+	}
+
+	// Round up so a key with any time left never reports 0
+	remaining := (time.Until(expiry) + time.Millisecond - 1) / time.Millisecond
+
+	return "val" + encodeArg(strconv.FormatInt(int64(remaining), 10))
+}
+
+func (ds *DataServer) persist(ctx context.Context, version int, key string) (string, error) {
+	err := ds.store.Persist(ctx, key)
+	if err == store.ErrKeyNotFound {
+		return "nil", nil
+	}
+	if err != nil {
+		log.Println("Persist failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "ack", nil
+}
+
+// ack if the put went ahead, nak if the key wasn't in the state the command
+// asked for
+func (ds *DataServer) conditionalPut(ctx context.Context, version int, cmd command) (string, error) {
+	var err error
+	switch cmd.name {
+	case "cas":
+		err = ds.store.CompareAndSwap(ctx, cmd.args[0], cmd.args[1], cmd.args[2])
+	case "pnx":
+		err = ds.store.PutIfAbsent(ctx, cmd.args[0], cmd.args[1])
+	case "pxx":
+		err = ds.store.PutIfExists(ctx, cmd.args[0], cmd.args[1])
+	}
+
+	if err == store.ErrConditionFailed {
+		return "nak", nil
+	}
+	if err != nil {
+		log.Println("Put failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "ack", nil
+}
+
+// The new value as a val, also handed back on its own along with the key's
+// expiry for replication. The value is empty if nothing changed.
+func (ds *DataServer) increment(ctx context.Context, version int, key string, delta int64) (string, string, time.Time, error) {
+	result, expiry, err := ds.store.Increment(ctx, key, delta)
+	if err == store.ErrNotInteger || err == store.ErrOverflow {
+		return errorResponse(version, err), "", time.Time{}, nil
+	}
+	if err != nil {
+		log.Println("Increment failed:", err)
+		return errorResponse(version, err), "", time.Time{}, err
+	}
+
+	value := strconv.FormatInt(result, 10)
+	return "val" + encodeArg(value), value, expiry, nil
+}
+
+// The count and then a val or a nil for each key, in the order asked for
+func (ds *DataServer) getMany(version int, keys []string) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	values, err := ds.store.GetMany(ctx, keys)
+	if err != nil {
+		log.Println("Get failed:", err)
+		return errorResponse(version, err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("arr")
+	sb.WriteString(encodeArg(strconv.Itoa(len(keys))))
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			sb.WriteString("nil")
+			continue
+		}
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(value))
+	}
+
+	return sb.String()
+}
+
+// args are key value pairs, nothing is stored unless all of them are
+func (ds *DataServer) putMany(ctx context.Context, version int, args []string) (string, error) {
+	entries := make([]store.KeyValue, 0, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		entries = append(entries, store.KeyValue{Key: args[i], Value: args[i+1]})
+	}
+
+	if err := ds.store.PutMany(ctx, entries); err != nil {
+		log.Println("Put failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "ack", nil
+}
+
+// Missing keys aren't an error, the client gets the number actually deleted
+func (ds *DataServer) deleteMany(ctx context.Context, version int, keys []string) (string, error) {
+	deleted, err := ds.store.DeleteMany(ctx, keys)
+	if err != nil {
+		log.Println("Delete failed:", err)
+		return errorResponse(version, err), err
+	}
+
+	return "val" + encodeArg(strconv.Itoa(deleted)), nil
+}
+
+// An arr of the next cursor, empty once the scan is done, followed by the keys
+func (ds *DataServer) scan(version int, cursor, pattern string, count int) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	keys, next, err := ds.store.Scan(ctx, cursor, pattern, count)
+	if err != nil {
+		log.Println("Scan failed:", err)
+		return errorResponse(version, err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("arr")
+	sb.WriteString(encodeArg(strconv.Itoa(len(keys) + 1)))
+	sb.WriteString("val")
+	sb.WriteString(encodeArg(next))
+	for _, key := range keys {
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(key))
+	}
+
+	return sb.String()
+}
+
+// An arr of each key followed by its value, in order or in reverse order
+func (ds *DataServer) readRange(version int, start, end string, limit int, reverse bool) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	read := ds.store.Range
+	if reverse {
+		read = ds.store.ReverseRange
+	}
+
+	entries, err := read(ctx, start, end, limit)
+	if err != nil {
+		log.Println("Range failed:", err)
+		return errorResponse(version, err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("arr")
+	sb.WriteString(encodeArg(strconv.Itoa(2 * len(entries))))
+	for _, entry := range entries {
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(entry.Key))
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(entry.Value))
+	}
+
+	return sb.String()
+}
+
+// Number of keys stored, not counting any that have expired
+func (ds *DataServer) count(version int) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	stats, err := ds.store.Stats(ctx)
+	if err != nil {
+		log.Println("Count failed:", err)
+		return errorResponse(version, err)
+	}
+
+	return "val" + encodeArg(strconv.Itoa(stats.Keys))
+}
+
+// An arr of the address, state and incarnation of each cluster member, this
+// node included. Empty when standalone. In raft mode the state is leader or
+// follower and the incarnation is the current term.
+func (ds *DataServer) memberList() string {
+	if ds.standAlone {
+		return "arr" + encodeArg("0")
+	}
+
+	var members []member
+	if ds.raft != nil {
+		members = ds.raft.members()
+	} else {
+		members = ds.members.list()
+	}
+
+	var sb strings.Builder
+	sb.WriteString("arr")
+	sb.WriteString(encodeArg(strconv.Itoa(3 * len(members))))
+	for _, member := range members {
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(member.addr))
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(member.state))
+		sb.WriteString("val")
+		sb.WriteString(encodeArg(strconv.FormatUint(member.incarnation, 10)))
+	}
+
+	return sb.String()
+}
+
+// Store counters for monitoring, as space separated name=value pairs
+func (ds *DataServer) stats(version int) string {
+	ctx, cancel := ds.storeContext()
+	defer cancel()
+
+	stats, err := ds.store.Stats(ctx)
+	if err != nil {
+		log.Println("Stats failed:", err)
+		return errorResponse(version, err)
+	}
+
+	summary := fmt.Sprintf("keys=%d memory=%d maxMemory=%d evictions=%d rejections=%d",
+		stats.Keys, stats.UsedMemory, stats.MaxMemory, stats.Evictions, stats.Rejections)
+
+	return "val" + encodeArg(summary)
+}
@@ -1,333 +1,2973 @@
-package dataServer
-
-import (
-	"fmt"
-	"net"
-	"store"
-	"testing"
-)
-
-func TestGetDigits(t *testing.T) {
-
-	t.Run("getDigitsSuccessful", func(t *testing.T) {
-		expected := 5
-
-		actual := getDigits(50000)
-
-		if expected != actual {
-			t.Error(fmt.Sprintf("Expected: %d, Actual: %d", expected, actual))
-		}
-	})
-
-	t.Run("getDigitsZeroPassedIn", func(t *testing.T) {
-		expected := 0
-
-		actual := getDigits(0)
-
-		if expected != actual {
-			t.Error(fmt.Sprintf("Expected: %d, Actual: %d", expected, actual))
-		}
-	})
-
-	t.Run("getDigitsNegativePassedIn", func(t *testing.T) {
-		expected := -1337
-
-		actual := getDigits(-1)
-
-		if expected != actual {
-			t.Error(fmt.Sprintf("Expected: %d, Actual: %d", expected, actual))
-		}
-	})
-}
-
-func TestInitClientListener(t *testing.T) {
-
-	t.Run("InitClientListenerSuccessful", func(t *testing.T) {
-
-		expectedResponse := "ack"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-		go tcpServer.InitClientListener("localhost:1234")
-
-		conn, err := net.Dial("tcp", "localhost:1234")
-		if err != nil {
-			t.Error("Failed to connect to server")
-		}
-
-		_, _ = conn.Write([]byte("del11k"))
-		buffer := make([]byte, 3)
-		_, _ = conn.Read(buffer)
-
-		actualResponse := string(buffer)
-
-		if actualResponse != expectedResponse {
-			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
-		}
-
-		_, _ = conn.Write([]byte("bye"))
-	})
-
-	t.Run("InitClientListenerInvalidAddress", func(t *testing.T) {
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-		go tcpServer.InitClientListener("localhost:")
-
-		_, err := net.Dial("tcp", "localhost:1234")
-		if err == nil {
-			t.Error("Expected the connection to fail")
-		}
-	})
-
-	t.Run("InitClientListenerConnectAfterListenerClosed", func(t *testing.T) {
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-		go tcpServer.InitClientListener("localhost:1234")
-
-		conn, err := net.Dial("tcp", "localhost:1234")
-		if err != nil {
-			t.Error("Failed to connect to server")
-		}
-
-		_, _ = conn.Write([]byte("bye"))
-
-		_, err = net.Dial("tcp", "localhost:1234")
-		if err == nil {
-			t.Error("Expected the connection to fail")
-		}
-	})
-}
-
-func TestParseArg(t *testing.T) {
-
-	const commandOffset = 3
-
-	t.Run("parseArgKVSuccessful", func(t *testing.T) {
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		expectedKey := "k"
-		expectedValue := "v"
-		buffer := []byte("put11k11v")
-
-		actualKey, pos := tcpServer.parseArg(buffer[commandOffset:])
-
-		if actualKey == "" || pos == -1 {
-			t.Error("Failed to retrieve the key!")
-		}
-
-		actualValue, _ := tcpServer.parseArg(buffer[pos+commandOffset:])
-
-		if actualValue == "" {
-			t.Error("Failed to retrieve the value!")
-		}
-
-		if expectedKey != actualKey {
-			t.Error(fmt.Sprintf("Expected key: %s, Actual key: %s", expectedKey, actualKey))
-		}
-
-		if expectedValue != actualValue {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedValue, actualValue))
-		}
-	})
-
-	t.Run("parseArgKVInvalidBuffer", func(t *testing.T) {
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-		arg, pos := tcpServer.parseArg([]byte{})
-		if arg != "" || pos != -1 {
-			t.Error("Expected this to fail as invalid buffer was passed in")
-		}
-	})
-
-	t.Run("parseArgKVValueMissing", func(t *testing.T) {
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		expectedKey := "k"
-		expectedValue := ""
-		buffer := []byte("put11k")
-
-		// get key
-		actualKey, pos := tcpServer.parseArg(buffer[commandOffset:])
-
-		if actualKey == "" || pos == -1 {
-			t.Error("Failed to retrieve the key!")
-		}
-
-		// get value
-		actualValue, pos1 := tcpServer.parseArg(buffer[pos+commandOffset:])
-
-		if actualValue != "" || pos1 != -1 {
-			t.Error("Expected retrieving the value to fail")
-		}
-
-		if expectedKey != actualKey {
-			t.Error(fmt.Sprintf("Expected key: %s, Actual key: %s", expectedKey, actualKey))
-		}
-
-		if expectedValue != actualValue {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedValue, actualValue))
-		}
-	})
-
-	t.Run("parseArgKUnexpectedValue", func(t *testing.T) {
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		expectedKey := "k"
-		buffer := []byte("del11k")
-
-		actualKey, pos := tcpServer.parseArg(buffer[commandOffset:])
-
-		if actualKey == "" || pos == -1 {
-			t.Error("Failed to retrieve the key!")
-		}
-
-		secondArg, pos1 := tcpServer.parseArg(buffer[pos+commandOffset:])
-
-		if secondArg != "" || pos1 != -1 {
-			t.Error("Expected to fail retrieving a second arg")
-		}
-
-		if expectedKey != actualKey {
-			t.Error(fmt.Sprintf("Expected key: %s, Actual key: %s", expectedKey, actualKey))
-		}
-	})
-
-	t.Run("parseArgMultipleArgsStress", func(t *testing.T) {
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		buffer := []byte("put11k11v14test15value15lorem15ipsum13del16value114nine13ten17destiny14halo15seven15eight15maria212dominicxasgd15Apple15jesus183m4aNu3L16GoLang")
-
-		expectedResults := [20]string{
-			"k", "v", "test", "value", "lorem", "ipsum", "del", "value1", "nine", "ten",
-			"destiny", "halo", "seven", "eight", "maria", "dominicxasgd", "Apple", "jesus", "3m4aNu3L", "GoLang",
-		}
-
-		actualResults := [20]string{}
-		pos := 0
-		for i := 0; i < 20; i++ {
-			temp := 0
-			actualResults[i], temp = tcpServer.parseArg(buffer[pos+commandOffset:])
-			pos += temp
-
-			if pos == -1 || actualResults[i] == "" {
-				t.Error(fmt.Sprintf("Failed to parse arg. Expected: %s, Actual: %s", expectedResults[i], actualResults[i]))
-			}
-		}
-
-		if len(actualResults) == 0 {
-			t.Error("Results are empty, failed to parse any args")
-		}
-
-		if expectedResults != actualResults {
-			t.Error(fmt.Sprintf("Expected results: %v, Actual results: %v", expectedResults, actualResults))
-		}
-	})
-}
-
-func TestPut(t *testing.T) {
-
-	t.Run("putCreate", func(t *testing.T) {
-		expected := "ack"
-		expectedVal := "val11v"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		actual1 := tcpServer.put("k", "v")
-
-		if actual1 != expected {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual1))
-		}
-
-		actualVal := tcpServer.get("k")
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-
-	})
-
-	t.Run("putUpdate", func(t *testing.T) {
-		expected := "ack"
-		expectedVal := "val11v"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		actual1 := tcpServer.put("k", "v")
-
-		if actual1 != expected {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual1))
-		}
-
-		actualVal := tcpServer.get("k")
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-
-		actual2 := tcpServer.put("k", "v")
-
-		if actual2 != expected {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual2))
-		}
-
-		actualVal = tcpServer.get("k")
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-	})
-}
-
-func TestGet(t *testing.T) {
-
-	t.Run("getSuccessfull", func(t *testing.T) {
-		expected := "ack"
-		expectedVal := "val11v"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		actual1 := tcpServer.put("k", "v")
-
-		if actual1 != expected {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual1))
-		}
-
-		actualVal := tcpServer.get("k")
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-	})
-
-	t.Run("getKeyNotFound", func(t *testing.T) {
-		expectedVal := "nil"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		actualVal := tcpServer.get("k")
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-	})
-}
-
-func TestDelete(t *testing.T) {
-
-	t.Run("deleteSuccessful", func(t *testing.T) {
-		expectedVal := "ack"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		tcpServer.put("k", "v")
-		actualVal := tcpServer.delete("k")
-
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-	})
-
-	t.Run("deleteKeyNotFound", func(t *testing.T) {
-		expectedVal := "ack"
-
-		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
-
-		actualVal := tcpServer.delete("k")
-		if actualVal != expectedVal {
-			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
-		}
-	})
-}
+package dataServer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"store"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestGetDigits(t *testing.T) {
+
+	t.Run("getDigitsSuccessful", func(t *testing.T) {
+		expected := 5
+
+		actual := getDigits(50000)
+
+		if expected != actual {
+			t.Error(fmt.Sprintf("Expected: %d, Actual: %d", expected, actual))
+		}
+	})
+
+	t.Run("getDigitsZeroPassedIn", func(t *testing.T) {
+		expected := 0
+
+		actual := getDigits(0)
+
+		if expected != actual {
+			t.Error(fmt.Sprintf("Expected: %d, Actual: %d", expected, actual))
+		}
+	})
+
+	t.Run("getDigitsNegativePassedIn", func(t *testing.T) {
+		expected := -1337
+
+		actual := getDigits(-1)
+
+		if expected != actual {
+			t.Error(fmt.Sprintf("Expected: %d, Actual: %d", expected, actual))
+		}
+	})
+}
+
+func TestInitClientListener(t *testing.T) {
+
+	t.Run("InitClientListenerSuccessful", func(t *testing.T) {
+
+		expectedResponse := "ack"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		go tcpServer.InitClientListener("localhost:1234")
+
+		conn := dialServer(t, "localhost:1234")
+
+		_, _ = conn.Write([]byte("del11k"))
+		buffer := make([]byte, 3)
+		_, _ = conn.Read(buffer)
+
+		actualResponse := string(buffer)
+
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		_, _ = conn.Write([]byte("bye"))
+
+		// bye only closes this connection
+		if _, err := conn.Read(buffer); err != io.EOF {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", io.EOF, err))
+		}
+
+		conn = dialServer(t, "localhost:1234")
+		conn.Close()
+
+		// Make sure the port is free for the next test
+		tcpServer.Shutdown(context.Background())
+	})
+
+	t.Run("InitClientListenerInvalidAddress", func(t *testing.T) {
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		go tcpServer.InitClientListener("localhost:")
+
+		_, err := net.Dial("tcp", "localhost:1234")
+		if err == nil {
+			t.Error("Expected the connection to fail")
+		}
+	})
+
+	t.Run("InitClientListenerConnectAfterListenerClosed", func(t *testing.T) {
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		tcpServer.SetAdminToken("secret")
+		go tcpServer.InitClientListener("localhost:1234")
+
+		conn := dialServer(t, "localhost:1234")
+
+		_, _ = conn.Write([]byte("sdn16secret"))
+		buffer := make([]byte, 3)
+		_, _ = conn.Read(buffer)
+
+		if string(buffer) != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", string(buffer)))
+		}
+
+		if !listenerClosed("localhost:1234") {
+			t.Error("Expected the connection to fail")
+		}
+	})
+
+	t.Run("InitClientListenerShutdownBadToken", func(t *testing.T) {
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		tcpServer.SetAdminToken("secret")
+		go tcpServer.InitClientListener("localhost:1234")
+
+		conn := dialServer(t, "localhost:1234")
+
+		_, _ = conn.Write([]byte("sdn15guess"))
+		buffer := make([]byte, 3)
+		_, _ = conn.Read(buffer)
+
+		if string(buffer) != "err" {
+			t.Error(fmt.Sprintf("Expected: err, Actual: %s", string(buffer)))
+		}
+
+		_, _ = conn.Write([]byte("get11k"))
+		_, _ = conn.Read(buffer)
+
+		if string(buffer) != "nil" {
+			t.Error(fmt.Sprintf("Expected: nil, Actual: %s", string(buffer)))
+		}
+
+		tcpServer.Shutdown(context.Background())
+	})
+
+	t.Run("InitClientListenerShutdownDrainsConnections", func(t *testing.T) {
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		tcpServer.SetAdminToken("secret")
+
+		stopped := make(chan struct{})
+		go func() {
+			tcpServer.InitClientListener("localhost:1234")
+			close(stopped)
+		}()
+
+		idle := dialServer(t, "localhost:1234")
+		admin := dialServer(t, "localhost:1234")
+
+		// Send a pipelined put ahead of the shutdown, it must still be acknowledged
+		_, _ = admin.Write([]byte("put11k11vsdn16secret"))
+		buffer := make([]byte, 6)
+		_, _ = io.ReadFull(admin, buffer)
+
+		if string(buffer) != "ackack" {
+			t.Error(fmt.Sprintf("Expected: ackack, Actual: %s", string(buffer)))
+		}
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("Listener didn't return after shutdown")
+		}
+
+		// Idle connections are closed as part of the shutdown
+		if _, err := idle.Read(buffer); err == nil {
+			t.Error("Expected the idle connection to be closed")
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+
+	t.Run("shutdownDeadlineClosesStuckConnection", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+
+		handlerDone := make(chan struct{})
+		go func() {
+			tcpServer.handleTCP(server)
+			close(handlerDone)
+		}()
+
+		// Never read the response so the handler is stuck writing it
+		_, _ = client.Write([]byte("get11k"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := tcpServer.Shutdown(ctx)
+		if err != context.DeadlineExceeded {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", context.DeadlineExceeded, err))
+		}
+
+		select {
+		case <-handlerDone:
+		case <-time.After(time.Second):
+			t.Error("Handler still running after shutdown")
+		}
+	})
+
+	t.Run("shutdownTwice", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		if err := tcpServer.Shutdown(context.Background()); err != nil {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", nil, err))
+		}
+
+		if err := tcpServer.Shutdown(context.Background()); err != nil {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", nil, err))
+		}
+	})
+
+	t.Run("shutdownDuringStartup", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		listenerDone := make(chan struct{})
+		go func() {
+			tcpServer.InitClientListener("127.0.0.1:0")
+			close(listenerDone)
+		}()
+
+		// Races with the listener being set up, -race catches it if unguarded
+		tcpServer.Shutdown(context.Background())
+
+		select {
+		case <-listenerDone:
+		case <-time.After(time.Second):
+			t.Error("Listener still running after shutdown")
+		}
+	})
+}
+
+func TestReadArg(t *testing.T) {
+
+	t.Run("readArgKVSuccessful", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("11k11v"), commandArgs, DefaultMaxArgSize)
+
+		expectedKey := "k"
+		expectedValue := "v"
+
+		actualKey, err := decoder.readArg()
+		if err != nil {
+			t.Error("Failed to retrieve the key! ", err)
+		}
+
+		actualValue, err := decoder.readArg()
+		if err != nil {
+			t.Error("Failed to retrieve the value! ", err)
+		}
+
+		if expectedKey != actualKey {
+			t.Error(fmt.Sprintf("Expected key: %s, Actual key: %s", expectedKey, actualKey))
+		}
+
+		if expectedValue != actualValue {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedValue, actualValue))
+		}
+	})
+
+	t.Run("readArgKVInvalidBuffer", func(t *testing.T) {
+		arg, err := decodeArg("")
+		if arg != "" || err == nil {
+			t.Error("Expected this to fail as invalid buffer was passed in")
+		}
+	})
+
+	t.Run("readArgKVValueMissing", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("11k"), commandArgs, DefaultMaxArgSize)
+
+		expectedKey := "k"
+
+		actualKey, err := decoder.readArg()
+		if err != nil {
+			t.Error("Failed to retrieve the key! ", err)
+		}
+
+		actualValue, err := decoder.readArg()
+		if actualValue != "" || err == nil {
+			t.Error("Expected retrieving the value to fail")
+		}
+
+		if expectedKey != actualKey {
+			t.Error(fmt.Sprintf("Expected key: %s, Actual key: %s", expectedKey, actualKey))
+		}
+	})
+
+	t.Run("readArgEmptyValue", func(t *testing.T) {
+		actualValue, err := decodeArg("10")
+		if actualValue != "" || err != nil {
+			t.Error(fmt.Sprintf("Expected an empty value, Actual value: %s, error: %v", actualValue, err))
+		}
+	})
+
+	t.Run("readArgBadLength", func(t *testing.T) {
+		arg, err := decodeArg("1x")
+		if arg != "" || err != errInvalidArg {
+			t.Error("Expected a non numeric length to fail")
+		}
+	})
+
+	t.Run("readArgTruncated", func(t *testing.T) {
+		for _, buffer := range []string{"1", "2", "25", "9123", "19", "15abc", "212dominic"} {
+			arg, err := decodeArg(buffer)
+			if arg != "" || err == nil {
+				t.Error(fmt.Sprintf("Expected %s to fail, Actual: %s", buffer, arg))
+			}
+		}
+	})
+
+	t.Run("readArgMultipleArgsStress", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("11k11v14test15value15lorem15ipsum13del16value114nine13ten17destiny14halo15seven15eight15maria212dominicxasgd15Apple15jesus183m4aNu3L16GoLang"), commandArgs, DefaultMaxArgSize)
+
+		expectedResults := [20]string{
+			"k", "v", "test", "value", "lorem", "ipsum", "del", "value1", "nine", "ten",
+			"destiny", "halo", "seven", "eight", "maria", "dominicxasgd", "Apple", "jesus", "3m4aNu3L", "GoLang",
+		}
+
+		actualResults := [20]string{}
+		for i := 0; i < 20; i++ {
+			arg, err := decoder.readArg()
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Failed to parse arg. Expected: %s, Error: %v", expectedResults[i], err))
+			}
+			actualResults[i] = arg
+		}
+
+		if expectedResults != actualResults {
+			t.Error(fmt.Sprintf("Expected results: %v, Actual results: %v", expectedResults, actualResults))
+		}
+	})
+}
+
+func TestDecoder(t *testing.T) {
+
+	t.Run("decoderPipelinedCommands", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("put11k11vget11kdel11kbye"), commandArgs, DefaultMaxArgSize)
+
+		expected := []command{
+			{name: "put", args: []string{"k", "v"}},
+			{name: "get", args: []string{"k"}},
+			{name: "del", args: []string{"k"}},
+			{name: "bye", args: []string{}},
+		}
+
+		for _, expectedCmd := range expected {
+			actual, err := decoder.next()
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Failed to decode %s: %v", expectedCmd.name, err))
+			}
+
+			if actual.encode() != expectedCmd.encode() {
+				t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedCmd.encode(), actual.encode()))
+			}
+		}
+
+		if _, err := decoder.next(); err != io.EOF {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", io.EOF, err))
+		}
+	})
+
+	t.Run("decoderCommandSplitAcrossReads", func(t *testing.T) {
+		value := strings.Repeat("v", 5000)
+		decoder := newDecoder(iotest.OneByteReader(strings.NewReader("put11k"+encodeArg(value))), commandArgs, DefaultMaxArgSize)
+
+		actual, err := decoder.next()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Failed to decode: %v", err))
+		}
+
+		if actual.name != "put" || actual.args[0] != "k" || actual.args[1] != value {
+			t.Error(fmt.Sprintf("Unexpected command: %s %s (%d bytes)", actual.name, actual.args[0], len(actual.args[1])))
+		}
+	})
+
+	t.Run("decoderInvalidArgLength", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("get21v"), commandArgs, DefaultMaxArgSize)
+
+		_, err := decoder.next()
+		if !errors.Is(err, errInvalidArg) {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errInvalidArg, err))
+		}
+	})
+
+	t.Run("decoderEmptyArg", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("put11k10"), commandArgs, DefaultMaxArgSize)
+
+		actual, err := decoder.next()
+		if err != nil || actual.args[1] != "" || actual.encode() != "put11k10" {
+			t.Error(fmt.Sprintf("Expected: put11k10, Actual: %s (%v)", actual.encode(), err))
+		}
+	})
+
+	t.Run("decoderUnknownCommand", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("abc11k"), commandArgs, DefaultMaxArgSize)
+
+		_, err := decoder.next()
+		if !errors.Is(err, errUnknownCommand) {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errUnknownCommand, err))
+		}
+	})
+
+	t.Run("decoderArgTooLarge", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("put11k"+encodeArg(strings.Repeat("v", 100))+"get11k"), commandArgs, 10)
+
+		_, err := decoder.next()
+		if !errors.Is(err, errArgTooLarge) {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errArgTooLarge, err))
+		}
+
+		// The oversized value is skipped so the next command still decodes
+		actual, err := decoder.next()
+		if err != nil || actual.encode() != "get11k" {
+			t.Error(fmt.Sprintf("Expected: get11k, Actual: %s (%v)", actual.encode(), err))
+		}
+	})
+
+	t.Run("decoderBatchTooLarge", func(t *testing.T) {
+		value := encodeArg(strings.Repeat("v", 20))
+		decoder := newDecoder(strings.NewReader("mpt11111k"+value+"mpt11211k"+value+"11j"+value+"get11k"), commandArgs, 100)
+		decoder.maxBatchBytes = 40
+
+		if _, err := decoder.next(); err != nil {
+			t.Error(fmt.Sprintf("Expected: a batch under the limit, Actual: %v", err))
+		}
+
+		_, err := decoder.next()
+		if !errors.Is(err, errBatchTooLarge) {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errBatchTooLarge, err))
+		}
+
+		// The rest of the batch is skipped so the next command still decodes
+		actual, err := decoder.next()
+		if err != nil || actual.encode() != "get11k" {
+			t.Error(fmt.Sprintf("Expected: get11k, Actual: %s (%v)", actual.encode(), err))
+		}
+	})
+
+	t.Run("decoderErrorPosition", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("put11k2xv"), commandArgs, DefaultMaxArgSize)
+
+		expected := "put arg 2: Invalid arg"
+
+		_, err := decoder.next()
+		if err == nil || err.Error() != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %v", expected, err))
+		}
+	})
+
+	t.Run("decoderBatch", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("mpt11211a11x11b10mgt11111a"), commandArgs, DefaultMaxArgSize)
+
+		for _, expected := range []string{"mpt11211a11x11b10", "mgt11111a"} {
+			actual, err := decoder.next()
+			if err != nil || actual.encode() != expected {
+				t.Error(fmt.Sprintf("Expected: %s, Actual: %s (%v)", expected, actual.encode(), err))
+			}
+		}
+	})
+
+	t.Run("decoderBatchBadCount", func(t *testing.T) {
+		for _, count := range []string{"0", "x", "01", "-1", "1025"} {
+			decoder := newDecoder(strings.NewReader("mgt"+encodeArg(count)+"11a"), commandArgs, DefaultMaxArgSize)
+
+			_, err := decoder.next()
+			if !errors.Is(err, errInvalidArg) {
+				t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errInvalidArg, err))
+			}
+		}
+	})
+
+	t.Run("decoderTruncatedCommand", func(t *testing.T) {
+		decoder := newDecoder(strings.NewReader("put11k12"), commandArgs, DefaultMaxArgSize)
+
+		_, err := decoder.next()
+		if err != io.ErrUnexpectedEOF {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", io.ErrUnexpectedEOF, err))
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		cmd      command
+		expected error
+	}{
+		{"validatePut", command{name: "put", args: []string{"k", "v"}}, nil},
+		{"validatePutEmptyValue", command{name: "put", args: []string{"k", ""}}, nil},
+		{"validatePutEmptyKey", command{name: "put", args: []string{"", "v"}}, errEmptyKey},
+		{"validateDelEmptyKey", command{name: "del", args: []string{""}}, errEmptyKey},
+		{"validatePex", command{name: "pex", args: []string{"k", "v", "100"}}, nil},
+		{"validatePexZeroTTL", command{name: "pex", args: []string{"k", "v", "0"}}, errBadTTL},
+		{"validatePexBadTTL", command{name: "pex", args: []string{"k", "v", "soon"}}, errBadTTL},
+		{"validatePexLongestTTL", command{name: "pex", args: []string{"k", "v", strconv.FormatInt(maxTTL, 10)}}, nil},
+		{"validatePexTTLTooLong", command{name: "pex", args: []string{"k", "v", strconv.FormatInt(maxTTL+1, 10)}}, errBadTTL},
+		{"validateStats", command{name: "sts", args: []string{}}, nil},
+		{"validateBatch", command{name: "mpt", args: []string{"2", "a", "", "b", "v"}}, nil},
+		{"validateBatchEmptyKey", command{name: "mpt", args: []string{"2", "a", "v", "", "v"}}, errEmptyKey},
+		{"validateBatchEmptyValueNotKey", command{name: "mgt", args: []string{"2", "a", ""}}, errEmptyKey},
+		{"validateConsistency", command{name: "cns", args: []string{"quorum"}}, nil},
+		{"validateConsistencyDefault", command{name: "cns", args: []string{""}}, nil},
+		{"validateConsistencyBad", command{name: "cns", args: []string{"most"}}, errBadConsistency},
+		{"validateAddMember", command{name: "mad", args: []string{"token", "127.0.0.1:8004"}}, nil},
+		{"validateAddMemberBadAddress", command{name: "mad", args: []string{"token", "8004"}}, errBadAddress},
+		{"validateRemoveMemberBadAddress", command{name: "mrm", args: []string{"token", ""}}, errBadAddress},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.cmd.validate(); actual != test.expected {
+				t.Error(fmt.Sprintf("Expected: %v, Actual: %v", test.expected, actual))
+			}
+		})
+	}
+
+	t.Run("validateLongestTTLFitsTheLog", func(t *testing.T) {
+		// The store logs expiry as UnixNano, which is garbage once it overflows
+		expiry := time.Now().Add(time.Duration(maxTTL) * time.Millisecond)
+		if !time.Unix(0, expiry.UnixNano()).Equal(expiry) {
+			t.Error(fmt.Sprintf("Expected: %v to survive UnixNano, Actual: %v", expiry, time.Unix(0, expiry.UnixNano())))
+		}
+	})
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range []string{"put11k11v", "get11kdel11k", "pex11k11v13100", "ver112", "get21v", "abc11k", "put11k12", "put11k10sts", "mpt11211a11x11b10", "mgt110"} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		decoder := newDecoder(bytes.NewReader(input), commandArgs, 16)
+
+		// Every call consumes at least a byte, so this is enough to reach the end
+		for i := 0; i <= len(input); i++ {
+			cmd, err := decoder.next()
+
+			if isProtocolError(err) {
+				decoder.reset()
+				continue
+			}
+			if errors.Is(err, errArgTooLarge) {
+				continue
+			}
+			if err != nil {
+				return
+			}
+
+			// handleTCP checks every command before running it, whatever the
+			// answer it mustn't panic
+			cmd.validate()
+
+			expected := commandArgs[cmd.name]
+			if batchCommands[cmd.name] {
+				count, _ := strconv.Atoi(cmd.args[0])
+				expected = 1 + count*commandArgs[cmd.name]
+			}
+
+			if len(cmd.args) != expected {
+				t.Fatal(fmt.Sprintf("Expected %d args for %s, Actual: %d", expected, cmd.name, len(cmd.args)))
+			}
+
+			// A decoded command encodes back to something that decodes the same
+			again, err := newDecoder(strings.NewReader(cmd.encode()), commandArgs, 16).next()
+			if err != nil || again.encode() != cmd.encode() {
+				t.Fatal(fmt.Sprintf("Round trip of %s failed: %s (%v)", cmd.encode(), again.encode(), err))
+			}
+		}
+	})
+}
+
+func TestFragment(t *testing.T) {
+
+	t.Run("fragmentSmallMessage", func(t *testing.T) {
+		msg := "put11k11v"
+
+		datagrams := fragment(1, msg)
+
+		if len(datagrams) != 1 || datagrams[0] != msg {
+			t.Error(fmt.Sprintf("Expected: [%s], Actual: %v", msg, datagrams))
+		}
+	})
+
+	t.Run("fragmentReassembleLargeMessage", func(t *testing.T) {
+		msg := command{name: "put", args: []string{"k", strings.Repeat("lorem ipsum ", 1000)}}.encode()
+		fragments := newReassembler(len(msg))
+
+		datagrams := fragment(7, msg)
+		if len(datagrams) < 2 {
+			t.Fatal(fmt.Sprintf("Expected the message to be split, got %d datagrams", len(datagrams)))
+		}
+
+		// Deliver in reverse order with a duplicate
+		for i, j := 0, len(datagrams)-1; i < j; i, j = i+1, j-1 {
+			datagrams[i], datagrams[j] = datagrams[j], datagrams[i]
+		}
+		datagrams = append([]string{datagrams[0]}, datagrams...)
+
+		for i, datagram := range datagrams {
+			if len(datagram) > maxDatagramSize {
+				t.Error(fmt.Sprintf("Datagram too large: %d bytes", len(datagram)))
+			}
+
+			frg, err := newDecoder(strings.NewReader(datagram), clusterCommandArgs, maxDatagramSize).next()
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Failed to decode fragment: %v", err))
+			}
+
+			actual, complete := fragments.add("127.0.0.1:8001", frg)
+
+			if complete != (i == len(datagrams)-1) {
+				t.Fatal(fmt.Sprintf("Unexpected completion at fragment %d", i))
+			}
+
+			if complete && actual != msg {
+				t.Error("Reassembled message doesn't match")
+			}
+		}
+	})
+}
+
+func TestCluster(t *testing.T) {
+
+	t.Run("clusterReplicatesToPeers", func(t *testing.T) {
+		peers := []string{"127.0.0.1:18001", "127.0.0.1:18002", "127.0.0.1:18003"}
+		var nodes []*DataServer
+		var stores []store.Store
+
+		for _, peer := range peers {
+			dataStore := store.NewDataStore()
+			node := NewDataServer(dataStore, false, "server.log", peer)
+			node.SetPeers(peers)
+			if err := node.SetupClusterConn(); err != nil {
+				t.Fatal(fmt.Sprintf("Failed to open cluster conn: %v", err))
+			}
+			go node.InitClusterListener()
+
+			nodes = append(nodes, node)
+			stores = append(stores, dataStore)
+			defer node.Shutdown(context.Background())
+		}
+
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go nodes[0].handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		// Big enough to be split into fragments
+		value := strings.Repeat("lorem ipsum ", 500)
+		put := command{name: "put", args: []string{"k", value}}.encode()
+
+		go func() {
+			_, _ = client.Write([]byte(put))
+		}()
+
+		buffer := make([]byte, 3)
+		if _, err := io.ReadFull(client, buffer); err != nil || string(buffer) != "ack" {
+			t.Fatal(fmt.Sprintf("Expected: ack, Actual: %s %v", string(buffer), err))
+		}
+
+		for i, dataStore := range stores[1:] {
+			actual := ""
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if actual, _ = dataStore.Get(context.Background(), "k"); actual == value {
+					break
+				}
+			}
+
+			if actual != value {
+				t.Error(fmt.Sprintf("Expected node %d to have the value, Actual: %d bytes", i+2, len(actual)))
+			}
+		}
+	})
+
+	t.Run("clusterSkipsOwnAddress", func(t *testing.T) {
+		node := NewDataServer(store.NewDataStore(), false, "server.log", "127.0.0.1:18001")
+		node.SetPeers([]string{"127.0.0.1:18001", "127.0.0.1:18002"})
+
+		if fmt.Sprint(node.peers) != "[127.0.0.1:18002]" {
+			t.Error(fmt.Sprintf("Expected: [127.0.0.1:18002], Actual: %v", node.peers))
+		}
+	})
+
+	t.Run("clusterAdvertiseAddr", func(t *testing.T) {
+		node := NewDataServer(store.NewDataStore(), false, "server.log", "0.0.0.0:18001")
+
+		// Peers would answer 0.0.0.0, which is ourselves to them
+		if err := node.SetupClusterConn(); err == nil {
+			node.transport.Close()
+			t.Error("Expected a wildcard address to be refused")
+		}
+		if err := node.SetAdvertiseAddr("0.0.0.0:18001"); err == nil {
+			t.Error("Expected a wildcard address to be refused")
+		}
+
+		if err := node.SetAdvertiseAddr("127.0.0.1:18001"); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to advertise: %v", err))
+		}
+		node.SetPeers([]string{"127.0.0.1:18001", "127.0.0.1:18002"})
+
+		if err := node.SetupClusterConn(); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to open cluster conn: %v", err))
+		}
+		defer node.transport.Close()
+
+		expected := "127.0.0.1:18001 alive, 127.0.0.1:18002 alive"
+		if actual := memberStates(node); actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+
+	t.Run("clusterParsePeers", func(t *testing.T) {
+		tests := []struct {
+			list     string
+			expected string
+			valid    bool
+		}{
+			{"", "[]", true},
+			{"127.0.0.1:8001", "[127.0.0.1:8001]", true},
+			{" 127.0.0.1:8001, localhost:8002 ,", "[127.0.0.1:8001 localhost:8002]", true},
+			{"127.0.0.1", "", false},
+			{":8001", "", false},
+			{"127.0.0.1:0", "", false},
+			{"127.0.0.1:http", "", false},
+		}
+
+		for _, test := range tests {
+			peers, err := ParsePeers(test.list)
+
+			if (err == nil) != test.valid || (test.valid && fmt.Sprint(peers) != test.expected) {
+				t.Error(fmt.Sprintf("List: %q, Expected: %s %v, Actual: %v %v", test.list, test.expected, test.valid, peers, err))
+			}
+		}
+	})
+
+	t.Run("clusterLoadPeersFile", func(t *testing.T) {
+		path := t.TempDir() + "/peers"
+		contents := "# three nodes on this box\n127.0.0.1:8001\n\n  127.0.0.1:8002\n127.0.0.1:8003\n"
+		if err := os.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		peers, err := LoadPeersFile(path)
+
+		expected := "[127.0.0.1:8001 127.0.0.1:8002 127.0.0.1:8003]"
+		if err != nil || fmt.Sprint(peers) != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %v %v", expected, peers, err))
+		}
+
+		if err := os.WriteFile(path, []byte("127.0.0.1:8001\nnonsense\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadPeersFile(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+			t.Error(fmt.Sprintf("Expected an error on line 2, Actual: %v", err))
+		}
+	})
+}
+
+func TestMembership(t *testing.T) {
+
+	t.Run("membershipApplyRules", func(t *testing.T) {
+		members := newMembership("a", func(addr, msg string) {})
+		members.add("b")
+
+		tests := []struct {
+			state       string
+			incarnation uint64
+			expected    string
+		}{
+			{stateSuspect, 0, "suspect 0"},
+			{stateAlive, 0, "suspect 0"},
+			{stateAlive, 1, "alive 1"},
+			{stateDead, 0, "alive 1"},
+			{stateDead, 1, "dead 1"},
+			{stateAlive, 1, "dead 1"},
+			{stateAlive, 2, "alive 2"},
+		}
+
+		for _, test := range tests {
+			members.apply([]*memberUpdate{{addr: "b", state: test.state, incarnation: test.incarnation}})
+
+			mbr := members.members["b"]
+			actual := fmt.Sprintf("%s %d", mbr.state, mbr.incarnation)
+			if actual != test.expected {
+				t.Error(fmt.Sprintf("Update: %s %d, Expected: %s, Actual: %s", test.state, test.incarnation, test.expected, actual))
+			}
+		}
+	})
+
+	t.Run("membershipRefutesSuspicion", func(t *testing.T) {
+		members := newMembership("a", func(addr, msg string) {})
+
+		members.apply([]*memberUpdate{{addr: "a", state: stateSuspect, incarnation: 0}})
+
+		self := members.members["a"]
+		if self.state != stateAlive || self.incarnation != 1 {
+			t.Error(fmt.Sprintf("Expected: alive 1, Actual: %s %d", self.state, self.incarnation))
+		}
+
+		ping, err := newDecoder(strings.NewReader(members.message("png", "1", "a")), clusterCommandArgs, maxDatagramSize).next()
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Failed to decode ping: %v", err))
+		}
+
+		updates := decodeUpdates(ping.args[2])
+		if len(updates) != 1 || *updates[0] != (memberUpdate{addr: "a", state: stateAlive, incarnation: 1}) {
+			t.Error("Expected the refutation to be gossiped")
+		}
+	})
+
+	t.Run("membershipJoinThroughSeed", func(t *testing.T) {
+		network := newMemNetwork()
+		a := startGossipNode(t, network, "a")
+		b := startGossipNode(t, network, "b", "a")
+		c := startGossipNode(t, network, "c", "a")
+
+		for _, node := range []*DataServer{a, b, c} {
+			waitForMembers(t, node, "a alive, b alive, c alive")
+		}
+
+		// b only knew about a to begin with
+		b.put(context.Background(), protocolV1, "k", "v")
+		b.broadcast(command{name: "put", args: []string{"k", "v"}}.encode(), []string{"k"})
+
+		waitForValue(t, c, "k", "v")
+	})
+
+	t.Run("membershipDetectsFailure", func(t *testing.T) {
+		network := newMemNetwork()
+		a := startGossipNode(t, network, "a")
+		b := startGossipNode(t, network, "b", "a")
+		c := startGossipNode(t, network, "c", "a")
+
+		waitForMembers(t, a, "a alive, b alive, c alive")
+		waitForMembers(t, b, "a alive, b alive, c alive")
+
+		c.Shutdown(context.Background())
+
+		waitForMembers(t, a, "a alive, b alive, c dead")
+		waitForMembers(t, b, "a alive, b alive, c dead")
+
+		if fmt.Sprint(a.members.live()) != "[b]" {
+			t.Error(fmt.Sprintf("Expected: [b], Actual: %v", a.members.live()))
+		}
+	})
+
+	t.Run("membershipPartitionHeals", func(t *testing.T) {
+		network := newMemNetwork()
+		a := startGossipNode(t, network, "a", "b")
+		b := startGossipNode(t, network, "b", "a")
+		c := startGossipNode(t, network, "c", "a")
+
+		waitForMembers(t, a, "a alive, b alive, c alive")
+
+		// c on its own, the rest of the cluster on the other side
+		network.cut("a", "c")
+		network.cut("b", "c")
+
+		waitForMembers(t, a, "a alive, b alive, c dead")
+		waitForMembers(t, b, "a alive, b alive, c dead")
+		waitForMembers(t, c, "a dead, b dead, c alive")
+
+		network.heal("a", "c")
+		network.heal("b", "c")
+
+		for _, node := range []*DataServer{a, b, c} {
+			waitForMembers(t, node, "a alive, b alive, c alive")
+		}
+	})
+
+	t.Run("membershipIndirectProbe", func(t *testing.T) {
+		network := newMemNetwork()
+		a := startGossipNode(t, network, "a", "b", "c")
+		startGossipNode(t, network, "b", "a", "c")
+		startGossipNode(t, network, "c", "a", "b")
+
+		// a can't reach c itself but b can
+		network.cut("a", "c")
+
+		time.Sleep(20 * testGossipOptions.ProbeInterval)
+
+		for _, mbr := range a.members.list() {
+			if mbr.state != stateAlive {
+				t.Error(fmt.Sprintf("Expected: %s alive, Actual: %s", mbr.addr, mbr.state))
+			}
+		}
+	})
+
+	t.Run("membershipCommand", func(t *testing.T) {
+		network := newMemNetwork()
+		node := startGossipNode(t, network, "a")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go node.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("mem"))
+		}()
+
+		expectedResponse := "arr113val11aval15aliveval110"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+}
+
+func TestReplication(t *testing.T) {
+
+	t.Run("replicationExactlyOnceInOrder", func(t *testing.T) {
+		network := newMemNetwork()
+		network.loss = 0.3
+		network.duplicate = 0.2
+		network.delay = 2 * time.Millisecond
+
+		quit := make(chan struct{})
+		defer close(quit)
+
+		a := startReplicator(network, "a", nil, quit)
+
+		var mutex sync.Mutex
+		var applied []string
+		startReplicator(network, "b", func(msg string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			applied = append(applied, msg)
+			return nil
+		}, quit)
+
+		go a.run(func() []string { return []string{"b"} }, quit)
+
+		var expected []string
+		for i := 0; i < 200; i++ {
+			msg := "m" + strconv.Itoa(i)
+			expected = append(expected, msg)
+			a.replicate([]string{"b"}, msg, nil)
+		}
+
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && a.pending("b") > 0; time.Sleep(10 * time.Millisecond) {
+		}
+
+		// Anything still in flight would show up as a duplicate
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if a.pending("b") != 0 || fmt.Sprint(applied) != fmt.Sprint(expected) {
+			t.Error(fmt.Sprintf("Expected: %d writes in order, Actual: %d pending, %d applied %v", len(expected), a.pending("b"), len(applied), applied))
+		}
+	})
+
+	t.Run("replicationRetriesFailedApply", func(t *testing.T) {
+		network := newMemNetwork()
+		quit := make(chan struct{})
+		defer close(quit)
+
+		a := startReplicator(network, "a", nil, quit)
+
+		var mutex sync.Mutex
+		var applied []string
+		failures := 2
+		startReplicator(network, "b", func(msg string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failures > 0 {
+				failures--
+				return errors.New("store unavailable")
+			}
+			applied = append(applied, msg)
+			return nil
+		}, quit)
+
+		go a.run(func() []string { return []string{"b"} }, quit)
+
+		a.replicate([]string{"b"}, "m0", nil)
+		a.replicate([]string{"b"}, "m1", nil)
+
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline) && a.pending("b") > 0; time.Sleep(10 * time.Millisecond) {
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if a.pending("b") != 0 || fmt.Sprint(applied) != "[m0 m1]" {
+			t.Error(fmt.Sprintf("Expected: both writes applied once in order, Actual: %d pending, %v applied", a.pending("b"), applied))
+		}
+	})
+
+	t.Run("replicationOriginRestarts", func(t *testing.T) {
+		var applied []string
+		b := newReplicator("b", func(addr, msg string) {}, func(msg string) error { applied = append(applied, msg); return nil })
+
+		a := newReplicator("a", nil, nil)
+		a.send = connectReplicators(a, b)
+		a.replicate([]string{"b"}, "1", nil)
+		a.replicate([]string{"b"}, "2", nil)
+
+		// Same address, new epoch, seqs start from 1 again
+		restarted := newReplicator("a", nil, nil)
+		restarted.epoch = a.epoch + "0"
+		restarted.send = connectReplicators(restarted, b)
+		restarted.replicate([]string{"b"}, "3", nil)
+
+		if fmt.Sprint(applied) != "[1 2 3]" || restarted.pending("b") != 0 {
+			t.Error(fmt.Sprintf("Expected: [1 2 3], Actual: %v, %d pending", applied, restarted.pending("b")))
+		}
+	})
+
+	t.Run("replicationKeepsWritesForDeadPeer", func(t *testing.T) {
+		var applied []string
+		b := newReplicator("b", func(addr, msg string) {}, func(msg string) error { applied = append(applied, msg); return nil })
+
+		a := newReplicator("a", nil, nil)
+		connected := connectReplicators(a, b)
+		a.send = connected
+		a.replicate([]string{"b"}, "1", nil)
+
+		// b misses 2 and then is declared dead
+		a.send = func(addr, msg string) {}
+		a.replicate([]string{"b"}, "2", nil)
+		a.retransmit(nil)
+
+		if a.pending("b") != 1 {
+			t.Error(fmt.Sprintf("Expected: 1 pending, Actual: %d", a.pending("b")))
+		}
+
+		// Back again
+		a.send = connected
+		a.replicate([]string{"b"}, "3", nil)
+		a.retransmit([]string{"b"})
+
+		if fmt.Sprint(applied) != "[1 2 3]" || a.pending("b") != 0 {
+			t.Error(fmt.Sprintf("Expected: [1 2 3], Actual: %v, %d pending", applied, a.pending("b")))
+		}
+	})
+
+	t.Run("replicationResyncsAfterDroppingWrites", func(t *testing.T) {
+		var applied []string
+		b := newReplicator("b", func(addr, msg string) {}, func(msg string) error { applied = append(applied, msg); return nil })
+
+		a := newReplicator("a", func(addr, msg string) {}, nil)
+		a.maxPending = 2
+		var resynced []string
+		a.resync = func(peer string, keys []string) error {
+			resynced = append(resynced, keys...)
+			for _, key := range keys {
+				a.repair(peer, "current "+key, []string{key})
+			}
+			return nil
+		}
+
+		// b is down long enough that the write to x is dropped
+		a.replicate([]string{"b"}, "x", []string{"x"})
+		a.replicate([]string{"b"}, "y", []string{"y"})
+		a.replicate([]string{"b"}, "z", []string{"z"})
+
+		// It waits for x rather than skip it while the resync is going out
+		a.send = connectReplicators(a, b)
+		a.retransmit([]string{"b"})
+
+		if len(applied) != 0 || fmt.Sprint(resynced) != "[x]" {
+			t.Error(fmt.Sprintf("Expected: nothing applied, x resynced, Actual: %v applied, %v resynced", applied, resynced))
+		}
+
+		a.retransmit([]string{"b"})
+
+		if fmt.Sprint(applied) != "[y z current x]" || a.pending("b") != 0 {
+			t.Error(fmt.Sprintf("Expected: [y z current x], Actual: %v, %d pending", applied, a.pending("b")))
+		}
+	})
+
+	t.Run("replicationResyncSendsCurrentValues", func(t *testing.T) {
+		node := NewDataServer(store.NewDataStore(), false, "server.log", "a")
+		ctx := context.Background()
+
+		node.put(ctx, protocolV1, "k", "v")
+		expiry := time.Now().Add(time.Hour)
+		node.putWithExpiry(ctx, protocolV1, "e", "w", expiry)
+
+		for key, expected := range map[string]string{
+			"k":       command{name: "put", args: []string{"k", "v"}}.encode(),
+			"e":       command{name: "pxa", args: []string{"e", "w", strconv.FormatInt(expiry.UnixMilli(), 10)}}.encode(),
+			"missing": command{name: "del", args: []string{"missing"}}.encode(),
+		} {
+			if actual, err := node.currentWrite(ctx, key); err != nil || actual != expected {
+				t.Error(fmt.Sprintf("Expected: %q, Actual: %q, %v", expected, actual, err))
+			}
+		}
+	})
+
+	t.Run("replicationBetweenServers", func(t *testing.T) {
+		network := newMemNetwork()
+		network.loss = 0.2
+		network.duplicate = 0.1
+		network.delay = time.Millisecond
+
+		// Lossy enough that probes fail now and again, keep everyone live
+		options := testGossipOptions
+		options.SuspectTimeout = time.Minute
+
+		a := startGossipNodeWith(t, network, options, "a", "b", "c")
+		b := startGossipNodeWith(t, network, options, "b", "a", "c")
+		c := startGossipNodeWith(t, network, options, "c", "a", "b")
+
+		// Later writes to the same key have to land last
+		for i := 0; i < 50; i++ {
+			key := "k" + strconv.Itoa(i%10)
+			put := command{name: "put", args: []string{key, strconv.Itoa(i)}}
+			a.put(context.Background(), protocolV1, key, strconv.Itoa(i))
+			a.broadcast(put.encode(), []string{key})
+		}
+		a.delete(context.Background(), protocolV1, "k0")
+		a.broadcast(command{name: "del", args: []string{"k0"}}.encode(), []string{"k0"})
+
+		for _, node := range []*DataServer{b, c} {
+			for i := 1; i < 10; i++ {
+				waitForValue(t, node, "k"+strconv.Itoa(i), strconv.Itoa(40+i))
+			}
+			waitForMissing(t, node, "k0")
+		}
+	})
+
+	t.Run("replicationLocksByShard", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		node := NewDataServer(dataStore, false, "server.log", "a")
+
+		other := "b"
+		for dataStore.ShardIndex(other) == dataStore.ShardIndex("a") {
+			other += "b"
+		}
+
+		unlock := node.lockKeys([]string{"a"})
+		done := make(chan string, 1)
+
+		// Another shard's write goes ahead, a batch touching a's shard waits
+		go func() {
+			done <- node.write(protocolV1, ConsistencyOne, command{name: "put", args: []string{other, "v"}})
+		}()
+		select {
+		case actual := <-done:
+			if actual != "ack" {
+				t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actual))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Write to another shard waited")
+		}
+
+		go func() {
+			done <- node.write(protocolV1, ConsistencyOne, command{name: "mpt", args: []string{"2", other, "w", "a", "w"}})
+		}()
+		select {
+		case <-done:
+			t.Fatal("Batch didn't wait for the lock")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		unlock()
+		if actual := <-done; actual != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actual))
+		}
+	})
+
+	t.Run("replicationConcurrentWritesSameKey", func(t *testing.T) {
+		network := newMemNetwork()
+		network.loss = 0.2
+		network.duplicate = 0.1
+		network.delay = time.Millisecond
+
+		options := testGossipOptions
+		options.SuspectTimeout = time.Minute
+
+		a := startGossipNodeWith(t, network, options, "a", "b", "c")
+		b := startGossipNodeWith(t, network, options, "b", "a", "c")
+		c := startGossipNodeWith(t, network, options, "c", "a", "b")
+
+		// Peers have to end up with whichever write a applied last
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					key := "k" + strconv.Itoa(i%20)
+					a.write(protocolV1, ConsistencyOne, command{name: "put", args: []string{key, strconv.Itoa(w*1000 + i)}})
+					a.write(protocolV1, ConsistencyOne, command{name: "inc", args: []string{"counter", "1"}})
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for _, node := range []*DataServer{b, c} {
+			for i := 0; i < 20; i++ {
+				key := "k" + strconv.Itoa(i)
+				last, _ := decodeArg(strings.TrimPrefix(a.get(protocolV1, key), "val"))
+				waitForValue(t, node, key, last)
+			}
+			waitForValue(t, node, "counter", "1600")
+		}
+	})
+}
+
+func TestConsistency(t *testing.T) {
+
+	t.Run("consistencyQuorumWaitsForReplica", func(t *testing.T) {
+		network := newMemNetwork()
+		a := startGossipNode(t, network, "a", "b", "c")
+		b := startGossipNode(t, network, "b", "a", "c")
+		c := startGossipNode(t, network, "c", "a", "b")
+
+		expectedResponse := "ackack"
+		actualResponse := exchange(t, a, "cns16quorumput11k11v", len(expectedResponse))
+
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		// Acked by a majority, so one of the others has it already
+		if b.get(protocolV1, "k") != "val11v" && c.get(protocolV1, "k") != "val11v" {
+			t.Error("Expected a replica to have the write before the ack")
+		}
+	})
+
+	t.Run("consistencyAllTimesOut", func(t *testing.T) {
+		network := newMemNetwork()
+		a := startGossipNode(t, network, "a", "b", "c")
+		startGossipNode(t, network, "b", "a", "c")
+		startGossipNode(t, network, "c", "a", "b")
+		a.SetConsistency(ConsistencyAll, 100*time.Millisecond)
+
+		// c stays alive through b but never sees a's writes
+		network.cut("a", "c")
+
+		expectedResponse := "val112err219replication_timeout247Not enough replicas confirmed the write in timeack"
+		actualResponse := exchange(t, a, "ver112put11k11vcns16quorumput11j11v", len(expectedResponse))
+
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		// Still applied here
+		if actual := a.get(protocolV1, "k"); actual != "val11v" {
+			t.Error(fmt.Sprintf("Expected: val11v, Actual: %s", actual))
+		}
+	})
+
+	t.Run("consistencyStandalone", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		tcpServer.SetConsistency(ConsistencyAll, time.Second)
+
+		expectedResponse := "ackackackerr"
+		actualResponse := exchange(t, tcpServer, "put11k11vcns16quorumput11k11vcns14most", len(expectedResponse))
+
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+	})
+
+	t.Run("consistencyParse", func(t *testing.T) {
+		for _, level := range []Consistency{ConsistencyOne, ConsistencyQuorum, ConsistencyAll} {
+			if actual, err := ParseConsistency(string(level)); actual != level || err != nil {
+				t.Error(fmt.Sprintf("Expected: %s, Actual: %s %v", level, actual, err))
+			}
+		}
+
+		if _, err := ParseConsistency("most"); err == nil {
+			t.Error("Expected an error for an unknown consistency")
+		}
+	})
+}
+
+func TestRaft(t *testing.T) {
+
+	t.Run("raftElectsOneLeader", func(t *testing.T) {
+		network := newMemNetwork()
+		nodes := startRaftCluster(t, network, testRaftOptions, "a:1", "b:1", "c:1")
+		leader := waitForLeader(t, nodes...)
+
+		_, _, term := raftStatus(leader)
+		for _, node := range nodes {
+			if _, _, actual := raftStatus(node); actual != term {
+				t.Error(fmt.Sprintf("Expected: %d, Actual: %d", term, actual))
+			}
+		}
+
+		if actualResponse := leader.memberList(); !strings.HasPrefix(actualResponse, "arr119") {
+			t.Error(fmt.Sprintf("Expected: arr119..., Actual: %s", actualResponse))
+		}
+		if actualResponse := leader.memberList(); !strings.Contains(actualResponse, "val1"+strconv.Itoa(len(leader.udpIP))+leader.udpIP+"val16leader") {
+			t.Error(fmt.Sprintf("Expected %s to be listed as leader, Actual: %s", leader.udpIP, actualResponse))
+		}
+	})
+
+	t.Run("raftAppliesWritesInOrder", func(t *testing.T) {
+		network := newMemNetwork()
+		nodes := startRaftCluster(t, network, testRaftOptions, "a:1", "b:1", "c:1")
+		leader := waitForLeader(t, nodes...)
+
+		expectedResponse := "ackackval111val112ackacknak"
+		actualResponse := exchange(t, leader, "put11k11vput11k12v2inc11n111inc11n111del11kpnx11j11vpnx11j11w", len(expectedResponse))
+
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		for _, node := range nodes {
+			waitForValue(t, node, "n", "2")
+			waitForValue(t, node, "j", "v")
+			waitForMissing(t, node, "k")
+		}
+	})
+
+	t.Run("raftRetriesFailedApply", func(t *testing.T) {
+		network := newMemNetwork()
+		flaky := &flakyStore{DataStore: store.NewDataStore()}
+		flaky.fail(true)
+
+		// a and b are enough to elect a leader and commit, c can't apply anything
+		addrs := []string{"a:1", "b:1", "c:1"}
+		a := startRaftNode(t, network, testRaftOptions, "a:1", addrs...)
+		b := startRaftNode(t, network, testRaftOptions, "b:1", addrs...)
+		leader := waitForLeader(t, a, b)
+		c := startRaftNodeWith(t, network, testRaftOptions, flaky, "c:1", addrs...)
+
+		expectedResponse := "ackack"
+		actualResponse := exchange(t, leader, "put11k11vput11j11v", len(expectedResponse))
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		waitForValue(t, a, "j", "v")
+		waitForValue(t, b, "j", "v")
+
+		// Stuck on the first write rather than skipping past it
+		time.Sleep(5 * applyRetryInterval)
+		c.raft.mutex.Lock()
+		lastApplied, commitIndex := c.raft.lastApplied, c.raft.commitIndex
+		c.raft.mutex.Unlock()
+		if commitIndex == 0 || lastApplied >= commitIndex {
+			t.Error(fmt.Sprintf("Expected c behind, applied %d of %d", lastApplied, commitIndex))
+		}
+
+		flaky.fail(false)
+		waitForValue(t, c, "k", "v")
+		waitForValue(t, c, "j", "v")
+	})
+
+	t.Run("raftRejectsForMemory", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 100, Policy: store.EvictLRU})
+
+		evicting := NewDataServer(dataStore, false, "server.log", "a:1")
+		if err := evicting.EnableRaft(testRaftOptions); err == nil {
+			t.Error("Expected raft to refuse a store that evicts")
+		}
+
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 100, Policy: store.EvictReject})
+		node := startRaftNodeWith(t, newMemNetwork(), testRaftOptions, dataStore, "a:1")
+		waitForLeader(t, node)
+
+		// Turned down the same everywhere, the applier carries on past it
+		expectedResponse := "errack"
+		request := command{name: "put", args: []string{"big", strings.Repeat("v", 200)}}.encode() + "put11k11v"
+		if actualResponse := exchange(t, node, request, len(expectedResponse)); actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+		waitForMissing(t, node, "big")
+	})
+
+	t.Run("raftFollowerForwardsWrites", func(t *testing.T) {
+		network := newMemNetwork()
+		nodes := startRaftCluster(t, network, testRaftOptions, "a:1", "b:1", "c:1")
+		leader := waitForLeader(t, nodes...)
+
+		follower := nodes[0]
+		if follower == leader {
+			follower = nodes[1]
+		}
+
+		// Answered in the follower's client's protocol version
+		expectedResponse := "val112ack" + errorResponse(protocolV2, store.ErrKeyNotFound)
+		actualResponse := exchange(t, follower, "ver112pex11f11v171000000del14none", len(expectedResponse))
+
+		if actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		for _, node := range nodes {
+			waitForValue(t, node, "f", "v")
+		}
+	})
+
+	t.Run("raftForwardAfterFollowerRestarts", func(t *testing.T) {
+		network := newMemNetwork()
+		addrs := []string{"a:1", "b:1", "c:1"}
+		dirs := map[string]string{"a:1": t.TempDir(), "b:1": t.TempDir(), "c:1": t.TempDir()}
+
+		start := func(addr string) *DataServer {
+			options := testRaftOptions
+			options.Dir = dirs[addr]
+			return startRaftNode(t, network, options, addr, addrs...)
+		}
+
+		nodes := []*DataServer{start("a:1"), start("b:1"), start("c:1")}
+		leader := waitForLeader(t, nodes...)
+
+		follower := nodes[0]
+		if follower == leader {
+			follower = nodes[1]
+		}
+
+		if actualResponse := exchange(t, follower, "put11k11v", 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+		follower.Shutdown(context.Background())
+
+		// Its ids start from 1 again, the leader still has the answer to the
+		// first one
+		restarted := start(follower.udpIP)
+		waitForLeader(t, leader, restarted)
+
+		if actualResponse := exchange(t, restarted, "put11k11w", 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+		waitForValue(t, leader, "k", "w")
+	})
+
+	t.Run("raftNewLeaderAfterFailure", func(t *testing.T) {
+		network := newMemNetwork()
+		nodes := startRaftCluster(t, network, testRaftOptions, "a:1", "b:1", "c:1")
+		leader := waitForLeader(t, nodes...)
+		_, _, term := raftStatus(leader)
+
+		var rest []*DataServer
+		for _, node := range nodes {
+			if node != leader {
+				rest = append(rest, node)
+			}
+		}
+
+		leader.Shutdown(context.Background())
+
+		newLeader := waitForLeader(t, rest...)
+		if _, _, newTerm := raftStatus(newLeader); newTerm <= term {
+			t.Error(fmt.Sprintf("Expected a term after %d, Actual: %d", term, newTerm))
+		}
+
+		expectedResponse := "ack"
+		if actualResponse := exchange(t, rest[0], "put11k11v", len(expectedResponse)); actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		for _, node := range rest {
+			waitForValue(t, node, "k", "v")
+		}
+	})
+
+	t.Run("raftMinorityCantCommit", func(t *testing.T) {
+		network := newMemNetwork()
+		nodes := startRaftCluster(t, network, testRaftOptions, "a:1", "b:1", "c:1")
+		leader := waitForLeader(t, nodes...)
+
+		var rest []*DataServer
+		for _, node := range nodes {
+			if node != leader {
+				rest = append(rest, node)
+				network.cut(leader.udpIP, node.udpIP)
+			}
+		}
+
+		// Still thinks it's leader but can't get a majority
+		expectedResponse := "val112" + errorResponse(protocolV2, errNotCommitted)
+		if actualResponse := exchange(t, leader, "ver112put11m11v", len(expectedResponse)); actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		newLeader := waitForLeader(t, rest...)
+		if actualResponse := exchange(t, newLeader, "put11z11z", 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+
+		for _, node := range rest {
+			network.heal(leader.udpIP, node.udpIP)
+		}
+
+		// The old leader's uncommitted write is replaced by the new leader's log
+		waitForValue(t, leader, "z", "z")
+		for _, node := range nodes {
+			if actual := node.get(protocolV1, "m"); actual != "nil" {
+				t.Error(fmt.Sprintf("Expected: nil, Actual: %s", actual))
+			}
+		}
+	})
+
+	t.Run("raftPersistsAcrossRestart", func(t *testing.T) {
+		network := newMemNetwork()
+		options := testRaftOptions
+		options.Dir = t.TempDir()
+
+		node := startRaftNode(t, network, options, "a:1")
+		waitForLeader(t, node)
+		_, _, term := raftStatus(node)
+
+		if actualResponse := exchange(t, node, "put11k11vinc11n111", 9); actualResponse != "ackval111" {
+			t.Error(fmt.Sprintf("Expected: ackval111, Actual: %s", actualResponse))
+		}
+		node.Shutdown(context.Background())
+
+		// Applied again from the log, not twice over
+		restarted := startRaftNode(t, network, options, "a:1")
+		waitForLeader(t, restarted)
+		waitForValue(t, restarted, "k", "v")
+		waitForValue(t, restarted, "n", "1")
+
+		if _, _, newTerm := raftStatus(restarted); newTerm <= term {
+			t.Error(fmt.Sprintf("Expected a term after %d, Actual: %d", term, newTerm))
+		}
+	})
+
+	t.Run("raftSnapshotCatchesUpFollower", func(t *testing.T) {
+		network := newMemNetwork()
+		options := testRaftOptions
+		options.SnapshotEntries = 5
+		options.Dir = t.TempDir()
+
+		a := startRaftNode(t, network, options, "a:1", "b:1", "c:1")
+		options.Dir = t.TempDir()
+		b := startRaftNode(t, network, options, "b:1", "a:1", "c:1")
+		options.Dir = t.TempDir()
+		c := startRaftNode(t, network, options, "c:1", "a:1", "b:1")
+
+		network.cut("a:1", "c:1")
+		network.cut("b:1", "c:1")
+		leader := waitForLeader(t, a, b)
+
+		// Big enough that the snapshot goes over in several pieces
+		value := strings.Repeat("v", 4096)
+		var requests, expectedResponse strings.Builder
+		for i := 0; i < 20; i++ {
+			requests.WriteString(command{name: "put", args: []string{"k" + strconv.Itoa(i), value}}.encode())
+			expectedResponse.WriteString("ack")
+		}
+
+		if actualResponse := exchange(t, leader, requests.String(), expectedResponse.Len()); actualResponse != expectedResponse.String() {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse.String(), actualResponse))
+		}
+
+		leader.raft.mutex.Lock()
+		compacted := leader.raft.snapshotIndex
+		leader.raft.mutex.Unlock()
+		if compacted == 0 {
+			t.Error("Expected the leader to have compacted its log")
+		}
+
+		network.heal("a:1", "c:1")
+		network.heal("b:1", "c:1")
+
+		for i := 0; i < 20; i++ {
+			waitForValue(t, c, "k"+strconv.Itoa(i), value)
+		}
+	})
+
+	t.Run("raftMembershipChanges", func(t *testing.T) {
+		network := newMemNetwork()
+		nodes := startRaftCluster(t, network, testRaftOptions, "127.0.0.1:9001", "127.0.0.1:9002", "127.0.0.1:9003")
+		leader := waitForLeader(t, nodes...)
+
+		if actualResponse := exchange(t, leader, "put11k11v", 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+
+		options := testRaftOptions
+		options.Join = true
+		joiner := startRaftNode(t, network, options, "127.0.0.1:9004")
+
+		follower := nodes[0]
+		if follower == leader {
+			follower = nodes[1]
+		}
+
+		// Through a follower so it's forwarded too
+		request := command{name: "mad", args: []string{"token", "127.0.0.1:9004"}}.encode()
+		if actualResponse := exchange(t, follower, request, 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+
+		// Catches up on everything from before it joined
+		waitForValue(t, joiner, "k", "v")
+		if actual := len(leader.raft.members()); actual != 4 {
+			t.Error(fmt.Sprintf("Expected: 4, Actual: %d", actual))
+		}
+
+		// The leader takes itself out and hands over
+		request = command{name: "mrm", args: []string{"token", leader.udpIP}}.encode()
+		if actualResponse := exchange(t, leader, request, 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+
+		var rest []*DataServer
+		for _, node := range append(nodes, joiner) {
+			if node != leader {
+				rest = append(rest, node)
+			}
+		}
+		newLeader := waitForLeader(t, rest...)
+
+		if actualResponse := exchange(t, newLeader, "put11j11v", 3); actualResponse != "ack" {
+			t.Error(fmt.Sprintf("Expected: ack, Actual: %s", actualResponse))
+		}
+		for _, node := range rest {
+			waitForValue(t, node, "j", "v")
+		}
+
+		// No longer sent anything
+		if actual := leader.get(protocolV1, "j"); actual != "nil" {
+			t.Error(fmt.Sprintf("Expected: nil, Actual: %s", actual))
+		}
+		if role, _, _ := raftStatus(leader); role != roleFollower {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", roleFollower, role))
+		}
+	})
+
+	t.Run("raftMembershipErrors", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), false, "server.log", "")
+		tcpServer.SetAdminToken("token")
+
+		request := command{name: "mad", args: []string{"token", "127.0.0.1:9004"}}.encode()
+		if actualResponse := exchange(t, tcpServer, request, 3); actualResponse != "err" {
+			t.Error(fmt.Sprintf("Expected: err, Actual: %s", actualResponse))
+		}
+
+		network := newMemNetwork()
+		node := startRaftNode(t, network, testRaftOptions, "127.0.0.1:9001")
+		waitForLeader(t, node)
+
+		expectedResponse := "val112" + errorResponse(protocolV2, errLastMember)
+		request = "ver112" + command{name: "mrm", args: []string{"token", "127.0.0.1:9001"}}.encode()
+		if actualResponse := exchange(t, node, request, len(expectedResponse)); actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+
+		expectedResponse = errorResponse(protocolV1, errBadToken)
+		request = command{name: "mad", args: []string{"wrong", "127.0.0.1:9002"}}.encode()
+		if actualResponse := exchange(t, node, request, len(expectedResponse)); actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+	})
+
+	t.Run("raftAppendsInFlight", func(t *testing.T) {
+		// Entries in each append sent to b
+		var sent []int
+		send := func(addr, msg string) {
+			cmd, _ := newDecoder(strings.NewReader(msg), clusterCommandArgs, maxAppendBytes*2).next()
+			if entries, err := decodeEntries(cmd.args[5]); addr == "b" && cmd.name == "aen" && err == nil {
+				sent = append(sent, len(entries))
+			}
+		}
+		apply := func(data string, version int) (string, error) { return "ack", nil }
+
+		r := newRaft("a", testRaftOptions, send, apply, store.NewDataStore())
+		if err := r.open([]string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+		r.mutex.Lock()
+		r.term = 1
+		r.becomeLeader()
+		r.nextIndex["b"] = 1
+		r.mutex.Unlock()
+
+		// b doesn't answer, heartbeats only until the noop and the write are
+		// taken as lost
+		r.sendAll(r.tick())
+		r.propose(command{name: "put", args: []string{"k", "v"}}.encode(), protocolV1)
+		r.sendAll(r.tick())
+		time.Sleep(appendTimeoutBeats * testRaftOptions.HeartbeatInterval)
+		r.sendAll(r.tick())
+
+		// Nothing more to send once it has them all, the next write goes
+		// straight out
+		r.handle(command{name: "aer", args: []string{"1", "b", "1", "2"}})
+		r.propose(command{name: "put", args: []string{"k", "w"}}.encode(), protocolV1)
+
+		if expected, actual := "[1 0 2 1]", fmt.Sprint(sent); actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+
+		big := command{name: "put", args: []string{"k", strings.Repeat("v", maxAppendBytes)}}.encode()
+		if _, err := r.propose(big, protocolV1); err != errArgTooLarge {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errArgTooLarge, err))
+		}
+	})
+
+	t.Run("raftReplacedEntryFails", func(t *testing.T) {
+		apply := func(data string, version int) (string, error) { return "ack", nil }
+		r := newRaft("a", testRaftOptions, func(addr, msg string) {}, apply, store.NewDataStore())
+		if err := r.open([]string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Proposed in term 1, but what committed at its index came from term 2
+		r.mutex.Lock()
+		r.appendLocal(logEntry{term: 2, kind: entryWrite, data: command{name: "put", args: []string{"k", "w"}}.encode()})
+		done := make(chan string, 1)
+		r.proposals[r.lastIndex()] = &proposal{term: 1, version: protocolV2, done: done}
+		r.commitIndex = r.lastIndex()
+		r.mutex.Unlock()
+
+		r.applyCommitted(make(chan struct{}))
+
+		expected := errResponse(protocolV2, codeNoLeader, errEntryReplaced)
+		if actual := <-done; actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+
+	t.Run("raftLogReplay", func(t *testing.T) {
+		dir := t.TempDir()
+
+		storage, _, err := openRaftStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.append(1, []logEntry{{1, entryWrite, "a"}, {1, entryWrite, "b"}, {1, entryWrite, "c"}})
+		storage.append(2, []logEntry{{2, entryNoop, ""}})
+		storage.saveState(raftState{Term: 2, Vote: "x"})
+		storage.close()
+
+		// Torn record on the end
+		file, _ := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+		file.Write([]byte{9, 0, 0})
+		file.Close()
+
+		storage, saved, err := openRaftStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "{2 x} [{1 w a} {2 n }]"
+		if actual := fmt.Sprint(saved.state, " ", saved.entries); actual != expected || saved.snapshot != nil {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+
+		storage.saveSnapshot(raftSnapshot{Index: 1, Term: 1, Config: []string{"x"}, Data: []byte("data")}, saved.entries[1:])
+		storage.append(3, []logEntry{{2, entryWrite, "d"}})
+		storage.close()
+
+		_, saved, err = openRaftStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected = "1 [x] data [{2 n } {2 w d}]"
+		if actual := fmt.Sprint(saved.snapshot.Index, " ", saved.snapshot.Config, " ", string(saved.snapshot.Data), " ", saved.entries); actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+}
+
+func TestHandleTCPPipelined(t *testing.T) {
+
+	t.Run("handleTCPPipelinedPuts", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("put11a11xput11b11yget11aget11b"))
+		}()
+
+		expectedResponse := "ackackval11xval11y"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPOneResponsePerRequest", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("put1011vpex11k11v10get11kbye"))
+		}()
+
+		// The rejected puts store nothing and the connection closes after bye
+		expectedResponse := "errerrnil"
+		response, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(response) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(response)))
+		}
+	})
+
+	t.Run("handleTCPEmptyValue", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("put11k10get11kget11mput1011v"))
+		}()
+
+		// Present but empty, missing, then an empty key is still refused
+		expectedResponse := "ackval10nilerr"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+}
+
+func TestHandleTCPConditional(t *testing.T) {
+
+	t.Run("handleTCPConditionalPuts", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			// Only a put if exists on a missing key, a second put if absent
+			// and a swap from the wrong value are turned down
+			_, _ = client.Write([]byte("pxx11k11vpnx11k11vpnx11k11wcas11k11x11ycas11k11v11yget11k"))
+		}()
+
+		expectedResponse := "nakacknaknakackval11y"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPConditionalEmptyKey", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("cas101011vpnx1011v"))
+		}()
+
+		expectedResponse := "errerr"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+}
+
+func TestHandleTCPCounters(t *testing.T) {
+
+	t.Run("handleTCPIncrementDecrement", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("inc11k11ainc11k15-1000inc11k13+10dec11k1225get11k"))
+		}()
+
+		// The bad delta is refused before it gets near the store
+		expectedResponse := "errval15-1000val14-990val15-1015val15-1015"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPIncrementErrors", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		maxInt := strconv.FormatInt(math.MaxInt64, 10)
+		minInt := strconv.FormatInt(math.MinInt64, 10)
+
+		go func() {
+			_, _ = client.Write([]byte("ver112put11s13abcinc11s111" +
+				"put11n" + encodeArg(maxInt) + "inc11n111" + "dec11n" + encodeArg(minInt)))
+		}()
+
+		expectedResponse := "val112ack" +
+			"err" + encodeArg(codeNotInteger) + encodeArg(store.ErrNotInteger.Error()) +
+			"ack" +
+			"err" + encodeArg(codeOverflow) + encodeArg(store.ErrOverflow.Error()) +
+			"err" + encodeArg(codeMalformed) + encodeArg(errBadDelta.Error())
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+}
+
+func TestHandleTCPScan(t *testing.T) {
+
+	t.Run("handleTCPScanPages", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewShardedDataStore(4), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("mpt11413u:11013u:21013u:31011x10cnt" +
+				"scn1013u:*112" + "scn13u:213u:*112" + "scn1011x111"))
+		}()
+
+		// Two pages of the u: keys then the x key on its own, each page
+		// starting with the cursor for the next
+		expectedResponse := "ackval114" +
+			"arr113val13u:2val13u:1val13u:2" +
+			"arr112val10val13u:3" +
+			"arr112val10val11x"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPRange", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewShardedDataStore(4), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("mpt11411a11111b11211c11311d114" +
+				"rng11b11d113" + "rrg1010112" + "rng11x10111"))
+		}()
+
+		// b to d, the last two from the top and nothing past the end
+		expectedResponse := "ack" +
+			"arr116val11bval112val11cval113val11dval114" +
+			"arr114val11dval114val11cval113" +
+			"arr110"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPScanBadCount", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("scn101011" + "0" + "scn1010141001"))
+		}()
+
+		expectedResponse := "errerr"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+}
+
+func TestHandleTCPBatch(t *testing.T) {
+
+	t.Run("handleTCPBatchCommands", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewShardedDataStore(4), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("mpt11211a11x11b10mgt11311a11c11bmdl11211a11cmgt11111a"))
+		}()
+
+		expectedResponse := "ackarr113val11xnilval10val111arr111nil"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPBatchReadOnly", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		tcpServer.SetReadOnly(true)
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("mpt11111a11xmdl11111amgt11111a"))
+		}()
+
+		expectedResponse := "errerrarr111nil"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+
+	t.Run("handleTCPBatchTooLarge", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		tcpServer.SetMaxArgSize(100)
+
+		// Every value fits but together they're more than one cluster message
+		var request strings.Builder
+		request.WriteString("ver112mpt" + encodeArg(strconv.Itoa(maxBatchSize)))
+		for i := 0; i < maxBatchSize; i++ {
+			request.WriteString(encodeArg("k"+strconv.Itoa(i)) + encodeArg(strings.Repeat("v", 100)))
+		}
+		request.WriteString("get12k0")
+
+		expectedResponse := "val112" + errResponse(protocolV2, codeTooLarge, &parseError{command: "mpt", err: errBatchTooLarge}) + "nil"
+		if actualResponse := exchange(t, tcpServer, request.String(), len(expectedResponse)); actualResponse != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, actualResponse))
+		}
+	})
+}
+
+func TestProtocolVersion(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		readOnly bool
+		request  string
+		expected string
+	}{
+		{"protocolV1DeleteMissingKey", false, "del11k", "ack"},
+		{"protocolV2DeleteMissingKey", false, "ver112del11k", "val112err211missing_key211Unknown key"},
+		{"protocolVersionClamped", false, "ver119", "val112"},
+		{"protocolBadVersion", false, "ver11x", "err"},
+		{"protocolV2ReadOnly", true, "ver112put11k11vget11k", "val112err19read_only219Server is read onlynil"},
+		{"protocolV2Malformed", false, "ver112get21v", "val112err19malformed222get arg 1: Invalid arg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+			tcpServer.SetReadOnly(test.readOnly)
+			server, client := net.Pipe()
+			defer client.Close()
+
+			go tcpServer.handleTCP(server)
+
+			client.SetDeadline(time.Now().Add(time.Second))
+
+			go func() {
+				_, _ = client.Write([]byte(test.request))
+			}()
+
+			buffer := make([]byte, len(test.expected))
+			if _, err := io.ReadFull(client, buffer); err != nil {
+				t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+			}
+
+			if string(buffer) != test.expected {
+				t.Error(fmt.Sprintf("Expected: %s, Actual: %s", test.expected, string(buffer)))
+			}
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+
+	t.Run("errorResponseV1", func(t *testing.T) {
+		expected := "err"
+
+		actual := errorResponse(protocolV1, errArgTooLarge)
+		if actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+
+	t.Run("errorResponseV2", func(t *testing.T) {
+		expected := "err19too_large213Arg too large"
+
+		actual := errorResponse(protocolV2, errArgTooLarge)
+		if actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+
+	t.Run("errorResponseOutOfMemory", func(t *testing.T) {
+		expected := "err213out_of_memory213Out of memory"
+
+		actual := errorResponse(protocolV2, store.ErrOutOfMemory)
+		if actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+
+	t.Run("errorResponseStoreFailure", func(t *testing.T) {
+		expected := "err18internal17Bad log"
+
+		actual := errorResponse(protocolV2, errors.New("Bad log"))
+		if actual != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+		}
+	})
+}
+
+func TestPut(t *testing.T) {
+
+	t.Run("putCreate", func(t *testing.T) {
+		expected := "ack"
+		expectedVal := "val11v"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		actual1, _ := tcpServer.put(context.Background(), protocolV1, "k", "v")
+
+		if actual1 != expected {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual1))
+		}
+
+		actualVal := tcpServer.get(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+
+	})
+
+	t.Run("putUpdate", func(t *testing.T) {
+		expected := "ack"
+		expectedVal := "val11v"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		actual1, _ := tcpServer.put(context.Background(), protocolV1, "k", "v")
+
+		if actual1 != expected {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual1))
+		}
+
+		actualVal := tcpServer.get(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+
+		actual2, _ := tcpServer.put(context.Background(), protocolV1, "k", "v")
+
+		if actual2 != expected {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual2))
+		}
+
+		actualVal = tcpServer.get(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+
+	t.Run("ttlRemaining", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		tcpServer.putWithExpiry(context.Background(), protocolV1, "k", "v", time.Now().Add(time.Minute))
+
+		actualVal := tcpServer.ttl(protocolV1, "k")
+		if !strings.HasPrefix(actualVal, "val") {
+			t.Fatal(fmt.Sprintf("Expected a val response, Actual value: %s", actualVal))
+		}
+
+		remaining, _ := decodeArg(actualVal[3:])
+		ms, err := strconv.Atoi(remaining)
+		if err != nil || ms <= 59000 || ms > 60000 {
+			t.Error(fmt.Sprintf("Expected about 60000ms, Actual value: %s", remaining))
+		}
+	})
+
+	t.Run("ttlNoExpiry", func(t *testing.T) {
+		expectedVal := "val12-1"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		tcpServer.put(context.Background(), protocolV1, "k", "v")
+
+		actualVal := tcpServer.ttl(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+
+	t.Run("ttlExpired", func(t *testing.T) {
+		expectedVal := "nil"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		tcpServer.putWithExpiry(context.Background(), protocolV1, "k", "v", time.Now().Add(-time.Millisecond))
+
+		if actualVal := tcpServer.get(protocolV1, "k"); actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+
+		if actualVal := tcpServer.ttl(protocolV1, "k"); actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+
+	t.Run("persistKey", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		tcpServer.putWithExpiry(context.Background(), protocolV1, "k", "v", time.Now().Add(time.Minute))
+
+		if actualVal, _ := tcpServer.persist(context.Background(), protocolV1, "k"); actualVal != "ack" {
+			t.Error(fmt.Sprintf("Expected Value: ack, Actual value: %s", actualVal))
+		}
+
+		if actualVal := tcpServer.ttl(protocolV1, "k"); actualVal != "val12-1" {
+			t.Error(fmt.Sprintf("Expected Value: val12-1, Actual value: %s", actualVal))
+		}
+
+		if actualVal, _ := tcpServer.persist(context.Background(), protocolV1, "missing"); actualVal != "nil" {
+			t.Error(fmt.Sprintf("Expected Value: nil, Actual value: %s", actualVal))
+		}
+	})
+
+	t.Run("pexOverConnection", func(t *testing.T) {
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+		server, client := net.Pipe()
+		defer client.Close()
+
+		go tcpServer.handleTCP(server)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+
+		go func() {
+			_, _ = client.Write([]byte("pex11k11v13100get11kpex11k11v110"))
+		}()
+
+		expectedResponse := "ackval11verr"
+		buffer := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(client, buffer); err != nil {
+			t.Fatal(fmt.Sprintf("Failed to read responses: %v", err))
+		}
+
+		if string(buffer) != expectedResponse {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expectedResponse, string(buffer)))
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+
+	t.Run("statsAfterEviction", func(t *testing.T) {
+		expectedVal := "val" + encodeArg("keys=1 memory=2 maxMemory=2 evictions=1 rejections=0")
+
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 2, Policy: store.EvictLRU})
+		tcpServer := NewDataServer(dataStore, true, "server.log", "")
+
+		tcpServer.put(context.Background(), protocolV1, "a", "1")
+		tcpServer.put(context.Background(), protocolV1, "b", "2")
+
+		actualVal := tcpServer.stats(protocolV1)
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+
+	t.Run("putRejectedForMemory", func(t *testing.T) {
+		expectedVal := "err"
+
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 2, Policy: store.EvictReject})
+		tcpServer := NewDataServer(dataStore, true, "server.log", "")
+
+		tcpServer.put(context.Background(), protocolV1, "a", "1")
+
+		actualVal, _ := tcpServer.put(context.Background(), protocolV1, "b", "2")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+}
+
+func TestGet(t *testing.T) {
+
+	t.Run("getSuccessfull", func(t *testing.T) {
+		expected := "ack"
+		expectedVal := "val11v"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		actual1, _ := tcpServer.put(context.Background(), protocolV1, "k", "v")
+
+		if actual1 != expected {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual1))
+		}
+
+		actualVal := tcpServer.get(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+
+	t.Run("getEmptyValue", func(t *testing.T) {
+		expectedVal := "val10"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		tcpServer.put(context.Background(), protocolV1, "k", "")
+
+		actualVal := tcpServer.get(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+
+	t.Run("getKeyNotFound", func(t *testing.T) {
+		expectedVal := "nil"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		actualVal := tcpServer.get(protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+
+	t.Run("deleteSuccessful", func(t *testing.T) {
+		expectedVal := "ack"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		tcpServer.put(context.Background(), protocolV1, "k", "v")
+		actualVal, _ := tcpServer.delete(context.Background(), protocolV1, "k")
+
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+
+	t.Run("deleteKeyNotFound", func(t *testing.T) {
+		expectedVal := "ack"
+
+		tcpServer := NewDataServer(store.NewDataStore(), true, "server.log", "")
+
+		actualVal, _ := tcpServer.delete(context.Background(), protocolV1, "k")
+		if actualVal != expectedVal {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expectedVal, actualVal))
+		}
+	})
+}
+
+func TestStoreInterface(t *testing.T) {
+
+	t.Run("storeErrorReturnsErr", func(t *testing.T) {
+		expected := "err"
+
+		tcpServer := NewDataServer(&fakeStore{err: errors.New("disk full")}, true, "server.log", "")
+
+		put, _ := tcpServer.put(context.Background(), protocolV1, "k", "v")
+		del, _ := tcpServer.delete(context.Background(), protocolV1, "k")
+
+		for _, actual := range []string{put, tcpServer.get(protocolV1, "k"), del, tcpServer.stats(protocolV1)} {
+			if actual != expected {
+				t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual))
+			}
+		}
+	})
+
+	t.Run("requestTimeout", func(t *testing.T) {
+		expected := "err"
+
+		tcpServer := NewDataServer(&fakeStore{block: true}, true, "server.log", "")
+		tcpServer.SetRequestTimeout(20 * time.Millisecond)
+
+		actual := tcpServer.get(protocolV1, "k")
+		if actual != expected {
+			t.Error(fmt.Sprintf("Expected Value: %s, Actual value: %s", expected, actual))
+		}
+	})
+
+	t.Run("shutdownDeadlineCancelsStoreCalls", func(t *testing.T) {
+		tcpServer := NewDataServer(&fakeStore{block: true}, true, "server.log", "")
+
+		go tcpServer.InitClientListener("localhost:1234")
+		conn := dialServer(t, "localhost:1234")
+		defer conn.Close()
+
+		io.WriteString(conn, "get11k")
+		time.Sleep(20 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := tcpServer.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Error(fmt.Sprintf("Expected Value: %v, Actual value: %v", context.DeadlineExceeded, err))
+		}
+	})
+}
+
+// Helper functions
+
+// Store that fails every call with err, or waits for the context when block is set
+// A real store whose puts fail while fail(true) is in effect
+type flakyStore struct {
+	*store.DataStore
+	failing int32
+}
+
+func (f *flakyStore) fail(failing bool) {
+	var n int32
+	if failing {
+		n = 1
+	}
+	atomic.StoreInt32(&f.failing, n)
+}
+
+func (f *flakyStore) Put(ctx context.Context, key, value string) error {
+	if atomic.LoadInt32(&f.failing) == 1 {
+		return errors.New("disk full")
+	}
+	return f.DataStore.Put(ctx, key, value)
+}
+
+type fakeStore struct {
+	err   error
+	block bool
+}
+
+func (f *fakeStore) wait(ctx context.Context) error {
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return f.err
+}
+
+func (f *fakeStore) Get(ctx context.Context, key string) (string, error) {
+	return "", f.wait(ctx)
+}
+
+func (f *fakeStore) Put(ctx context.Context, key, value string) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) PutWithExpiry(ctx context.Context, key, value string, expiry time.Time) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) Delete(ctx context.Context, key string) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) TTL(ctx context.Context, key string) (time.Time, error) {
+	return time.Time{}, f.wait(ctx)
+}
+
+func (f *fakeStore) Persist(ctx context.Context, key string) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) Stats(ctx context.Context) (store.StoreStats, error) {
+	return store.StoreStats{}, f.wait(ctx)
+}
+
+func (f *fakeStore) CompareAndSwap(ctx context.Context, key, expected, value string) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) PutIfAbsent(ctx context.Context, key, value string) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) PutIfExists(ctx context.Context, key, value string) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) Increment(ctx context.Context, key string, delta int64) (int64, time.Time, error) {
+	return 0, time.Time{}, f.wait(ctx)
+}
+
+func (f *fakeStore) Scan(ctx context.Context, cursor, pattern string, count int) ([]string, string, error) {
+	return nil, "", f.wait(ctx)
+}
+
+func (f *fakeStore) Range(ctx context.Context, start, end string, limit int) ([]store.KeyValue, error) {
+	return nil, f.wait(ctx)
+}
+
+func (f *fakeStore) ReverseRange(ctx context.Context, start, end string, limit int) ([]store.KeyValue, error) {
+	return nil, f.wait(ctx)
+}
+
+func (f *fakeStore) GetMany(ctx context.Context, keys []string) (map[string]string, error) {
+	return nil, f.wait(ctx)
+}
+
+func (f *fakeStore) PutMany(ctx context.Context, entries []store.KeyValue) error {
+	return f.wait(ctx)
+}
+
+func (f *fakeStore) DeleteMany(ctx context.Context, keys []string) (int, error) {
+	return 0, f.wait(ctx)
+}
+
+func (f *fakeStore) Close() error {
+	return nil
+}
+
+// Fast enough for tests to watch failures being detected
+var testGossipOptions = GossipOptions{
+	ProbeInterval:  40 * time.Millisecond,
+	ProbeTimeout:   15 * time.Millisecond,
+	SuspectTimeout: 200 * time.Millisecond,
+	IndirectProbes: 3,
+}
+
+// Cluster node on network at addr joining through seeds, shut down when the
+// test ends
+func startGossipNode(t *testing.T, network *memNetwork, addr string, seeds ...string) *DataServer {
+	return startGossipNodeWith(t, network, testGossipOptions, addr, seeds...)
+}
+
+func startGossipNodeWith(t *testing.T, network *memNetwork, options GossipOptions, addr string, seeds ...string) *DataServer {
+	node := NewDataServer(store.NewDataStore(), false, "server.log", addr)
+	node.SetTransport(network.listen(addr))
+	node.SetPeers(seeds)
+	node.SetGossipOptions(options)
+	node.replicator.interval = 20 * time.Millisecond
+	go node.InitClusterListener()
+
+	t.Cleanup(func() {
+		node.Shutdown(context.Background())
+	})
+	return node
+}
+
+func memberStates(node *DataServer) string {
+	var states []string
+	for _, mbr := range node.members.list() {
+		states = append(states, mbr.addr+" "+mbr.state)
+	}
+	return strings.Join(states, ", ")
+}
+
+func waitForMembers(t *testing.T, node *DataServer, expected string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if memberStates(node) == expected {
+			return
+		}
+	}
+	t.Fatal(fmt.Sprintf("Expected: %s, Actual: %s", expected, memberStates(node)))
+}
+
+func waitForValue(t *testing.T, node *DataServer, key, value string) {
+	expected := "val" + encodeArg(value)
+	actual := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if actual = node.get(protocolV1, key); actual == expected {
+			return
+		}
+	}
+	t.Fatal(fmt.Sprintf("Expected: %s, Actual: %s", expected, actual))
+}
+
+// In process stand in for UDP. Datagrams are queued straight onto the
+// receiver and, like UDP, dropped without an error when they can't be
+// delivered. It can also be made to lose, duplicate and reorder them.
+type memNetwork struct {
+	mutex     sync.Mutex
+	nodes     map[string]*memTransport
+	cuts      map[[2]string]bool
+	loss      float64       // chance a datagram is dropped
+	duplicate float64       // chance a datagram is delivered twice
+	delay     time.Duration // most a datagram is held back, so later ones can overtake it
+}
+
+type memDatagram struct {
+	from string
+	msg  []byte
+}
+
+type memTransport struct {
+	network *memNetwork
+	addr    string
+	inbox   chan memDatagram
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{nodes: make(map[string]*memTransport), cuts: make(map[[2]string]bool)}
+}
+
+func (n *memNetwork) listen(addr string) *memTransport {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	transport := &memTransport{network: n, addr: addr, inbox: make(chan memDatagram, 1024), closed: make(chan struct{})}
+	n.nodes[addr] = transport
+	return transport
+}
+
+// Drop everything between a and b, both ways
+func (n *memNetwork) cut(a, b string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.cuts[[2]string{a, b}] = true
+	n.cuts[[2]string{b, a}] = true
+}
+
+func (n *memNetwork) heal(a, b string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.cuts, [2]string{a, b})
+	delete(n.cuts, [2]string{b, a})
+}
+
+func (t *memTransport) Send(addr string, msg []byte) error {
+	t.network.mutex.Lock()
+	to, ok := t.network.nodes[addr]
+	cut := t.network.cuts[[2]string{t.addr, addr}]
+	loss, duplicate, delay := t.network.loss, t.network.duplicate, t.network.delay
+	t.network.mutex.Unlock()
+
+	if !ok || cut || rand.Float64() < loss {
+		return nil
+	}
+
+	copies := 1
+	if rand.Float64() < duplicate {
+		copies = 2
+	}
+
+	datagram := memDatagram{from: t.addr, msg: append([]byte(nil), msg...)}
+	for i := 0; i < copies; i++ {
+		if delay <= 0 {
+			to.deliver(datagram)
+			continue
+		}
+		time.AfterFunc(time.Duration(rand.Int63n(int64(delay))), func() {
+			to.deliver(datagram)
+		})
+	}
+	return nil
+}
+
+func (t *memTransport) deliver(datagram memDatagram) {
+	select {
+	case t.inbox <- datagram:
+	case <-t.closed:
+	default:
+	}
+}
+
+func (t *memTransport) Receive(buffer []byte) (int, string, error) {
+	select {
+	case datagram := <-t.inbox:
+		return copy(buffer, datagram.msg), datagram.from, nil
+	case <-t.closed:
+		return 0, "", net.ErrClosed
+	}
+}
+
+func (t *memTransport) LocalAddr() string {
+	return t.addr
+}
+
+func (t *memTransport) Close() error {
+	t.once.Do(func() {
+		t.network.mutex.Lock()
+		delete(t.network.nodes, t.addr)
+		t.network.mutex.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
+
+// Replicator at addr on network, handling its own datagrams until quit is
+// closed
+func startReplicator(network *memNetwork, addr string, apply func(msg string) error, quit chan struct{}) *replicator {
+	transport := network.listen(addr)
+	r := newReplicator(addr, func(to, msg string) { transport.Send(to, []byte(msg)) }, apply)
+	r.interval = 10 * time.Millisecond
+
+	go func() {
+		<-quit
+		transport.Close()
+	}()
+
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, _, err := transport.Receive(buffer)
+			if err != nil {
+				return
+			}
+
+			cmd, err := newDecoder(bytes.NewReader(buffer[:n]), clusterCommandArgs, maxDatagramSize).next()
+			if err != nil {
+				continue
+			}
+
+			switch cmd.name {
+			case "rep":
+				r.receive(cmd)
+			case "rak":
+				r.acked(cmd)
+			}
+		}
+	}()
+
+	return r
+}
+
+// Send function for from that hands writes straight to to and its acks
+// straight back
+func connectReplicators(from, to *replicator) func(addr, msg string) {
+	to.send = func(addr, msg string) {
+		cmd, _ := newDecoder(strings.NewReader(msg), clusterCommandArgs, maxDatagramSize).next()
+		from.acked(cmd)
+	}
+
+	return func(addr, msg string) {
+		cmd, _ := newDecoder(strings.NewReader(msg), clusterCommandArgs, maxDatagramSize).next()
+		to.receive(cmd)
+	}
+}
+
+func waitForMissing(t *testing.T, node *DataServer, key string) {
+	actual := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if actual = node.get(protocolV1, key); actual == "nil" {
+			return
+		}
+	}
+	t.Fatal(fmt.Sprintf("Expected: nil, Actual: %s", actual))
+}
+
+var testRaftOptions = RaftOptions{
+	HeartbeatInterval: 10 * time.Millisecond,
+	ElectionTimeout:   50 * time.Millisecond,
+	CommitTimeout:     500 * time.Millisecond,
+}
+
+// Raft node at addr on network with peers as the other members
+func startRaftNode(t *testing.T, network *memNetwork, options RaftOptions, addr string, peers ...string) *DataServer {
+	return startRaftNodeWith(t, network, options, store.NewDataStore(), addr, peers...)
+}
+
+func startRaftNodeWith(t *testing.T, network *memNetwork, options RaftOptions, dataStore store.Store, addr string, peers ...string) *DataServer {
+	node := NewDataServer(dataStore, false, "server.log", addr)
+	node.SetTransport(network.listen(addr))
+	node.SetPeers(peers)
+	node.SetAdminToken("token")
+	if err := node.EnableRaft(options); err != nil {
+		t.Fatal(fmt.Sprintf("Failed to enable raft: %v", err))
+	}
+	go node.InitClusterListener()
+
+	t.Cleanup(func() {
+		node.Shutdown(context.Background())
+	})
+	return node
+}
+
+func startRaftCluster(t *testing.T, network *memNetwork, options RaftOptions, addrs ...string) []*DataServer {
+	var nodes []*DataServer
+	for _, addr := range addrs {
+		nodes = append(nodes, startRaftNode(t, network, options, addr, addrs...))
+	}
+	return nodes
+}
+
+func raftStatus(node *DataServer) (string, string, uint64) {
+	node.raft.mutex.Lock()
+	defer node.raft.mutex.Unlock()
+
+	return node.raft.role, node.raft.leader, node.raft.term
+}
+
+// The one leader every node in nodes has heard from
+func waitForLeader(t *testing.T, nodes ...*DataServer) *DataServer {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var leaders []*DataServer
+		agreed := true
+
+		for _, node := range nodes {
+			role, leader, _ := raftStatus(node)
+			if role == roleLeader {
+				leaders = append(leaders, node)
+			}
+			if len(leaders) > 0 && leader != leaders[0].udpIP {
+				agreed = false
+			}
+		}
+
+		if len(leaders) == 1 && agreed {
+			for _, node := range nodes {
+				if _, leader, _ := raftStatus(node); leader != leaders[0].udpIP {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leaders[0]
+			}
+		}
+	}
+
+	t.Fatal("No leader elected")
+	return nil
+}
+
+// Send requests to node over a pipe and read back length bytes of responses
+func exchange(t *testing.T, node *DataServer, requests string, length int) string {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go node.handleTCP(server)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	go func() {
+		_, _ = client.Write([]byte(requests))
+	}()
+
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(client, buffer); err != nil {
+		t.Fatal(fmt.Sprintf("Failed to read responses: %v, got %q", err, buffer))
+	}
+	return string(buffer)
+}
+
+// The listener is started in a goroutine so give it a moment to come up
+// The first arg encoded in s, like the value in a val response
+func decodeArg(s string) (string, error) {
+	return newDecoder(strings.NewReader(s), commandArgs, DefaultMaxArgSize).readArg()
+}
+
+func dialServer(t *testing.T, address string) net.Conn {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Failed to connect to server")
+	return nil
+}
+
+func listenerClosed(address string) bool {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
@@ -0,0 +1,408 @@
+package dataServer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Errors
+	errUnknownCommand = errors.New("Unknown command")
+	errInvalidArg     = errors.New("Invalid arg")
+	errArgTooLarge    = errors.New("Arg too large")
+	errBatchTooLarge  = errors.New("Batch too large")
+)
+
+// Where a request went wrong, wraps one of the errors above so errors.Is
+// still matches it
+type parseError struct {
+	command string
+	arg     int // 1 based, 0 when the command name itself is bad
+	err     error
+}
+
+func (e *parseError) Error() string {
+	if e.arg == 0 {
+		return fmt.Sprintf("%s %q", e.err, e.command)
+	}
+	return fmt.Sprintf("%s arg %d: %s", e.command, e.arg, e.err)
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// Number of length prefixed args each command expects after its 3 byte name
+var commandArgs = map[string]int{
+	"get": 1,
+	"del": 1,
+	"put": 2,
+	"pex": 3,
+	"ttl": 1,
+	"per": 1,
+	"sts": 0,
+	"bye": 0,
+	"sdn": 1,
+	"ver": 1,
+	"mgt": 1,
+	"mpt": 2,
+	"mdl": 1,
+	"cas": 3,
+	"pnx": 2,
+	"pxx": 2,
+	"inc": 2,
+	"dec": 2,
+	"scn": 3,
+	"cnt": 0,
+	"rng": 3,
+	"rrg": 3,
+	"mem": 0,
+	"cns": 1,
+	"mad": 2,
+	"mrm": 2,
+}
+
+// Commands on many keys at once. Their first arg is a count of the entries
+// that follow, the number in commandArgs is the args in each entry.
+var batchCommands = map[string]bool{
+	"mgt": true,
+	"mpt": true,
+	"mdl": true,
+}
+
+// Most entries a batch command can carry
+const maxBatchSize = 1024
+
+// Largest page a client can ask scn, rng or rrg for
+const maxPageSize = 1000
+
+// Commands exchanged between cluster nodes over UDP
+var clusterCommandArgs = map[string]int{
+	"del": 1,
+	"put": 2,
+	"pxa": 3,
+	"per": 1,
+	"frg": 4,
+	"mpt": 2,
+	"mdl": 1,
+	"png": 3, // gossip ping: seq, from, member updates
+	"prq": 4, // ping target for us: seq, from, target, member updates
+	"pak": 3, // ping answered: seq, from, member updates
+	"jon": 2, // join: from, member updates
+	"syn": 2, // every member, in answer to jon: from, member updates
+	"rep": 5, // replicated write: origin, epoch, seq, oldest unacked seq, write
+	"rak": 3, // replicated writes applied: from, epoch, seq
+	"rvt": 4, // raft vote request: term, candidate, last log index, last log term
+	"rvr": 3, // raft vote: term, from, granted
+	"aen": 6, // raft append: term, leader, previous index, previous term, commit index, entries
+	"aer": 4, // raft append result: term, from, success, matching index
+	"isn": 8, // raft snapshot piece: term, leader, index, term, members, offset, data, last piece
+	"isr": 4, // raft snapshot received: term, from, index, bytes so far
+	"fwd": 6, // write for the raft leader: from, epoch, id, version, op, write or member
+	"fwr": 3, // answer to fwd: epoch, id, response
+}
+
+// Writes as they are kept in the raft log, client writes with pex turned
+// into pxa
+var logCommandArgs = map[string]int{
+	"put": 2,
+	"del": 1,
+	"pxa": 3,
+	"per": 1,
+	"cas": 3,
+	"pnx": 2,
+	"pxx": 2,
+	"inc": 2,
+	"dec": 2,
+	"mpt": 2,
+	"mdl": 1,
+}
+
+type command struct {
+	name string
+	args []string
+}
+
+// Re-encode a command in wire format, used when forwarding it to the cluster
+func (cmd command) encode() string {
+	var sb strings.Builder
+	sb.WriteString(cmd.name)
+	for _, arg := range cmd.args {
+		sb.WriteString(encodeArg(arg))
+	}
+	return sb.String()
+}
+
+func encodeArg(arg string) string {
+	return fmt.Sprintf("%d%d%s", lengthDigits(len(arg)), len(arg), arg)
+}
+
+// Digits in an arg length, unlike getDigits a 0 length still takes one
+func lengthDigits(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return getDigits(n)
+}
+
+// Streaming decoder for the client protocol. Reads are buffered so a command
+// split over several TCP segments is reassembled, and several commands sent in
+// one segment are handed out one at a time.
+type decoder struct {
+	reader     *bufio.Reader
+	commands   map[string]int
+	maxArgSize int
+
+	// Most bytes a batch command can come to as it's encoded, 0 for no limit
+	maxBatchBytes int
+}
+
+func newDecoder(r io.Reader, commands map[string]int, maxArgSize int) *decoder {
+	return &decoder{
+		reader:     bufio.NewReader(r),
+		commands:   commands,
+		maxArgSize: maxArgSize,
+	}
+}
+
+// Blocks until a full command is available. Errors other than the protocol
+// errors above come from the underlying reader and mean the stream is done.
+func (d *decoder) next() (command, error) {
+	name := make([]byte, 3)
+	if _, err := io.ReadFull(d.reader, name); err != nil {
+		return command{}, err
+	}
+
+	argCount, ok := d.commands[string(name)]
+	if !ok {
+		return command{}, &parseError{command: string(name), err: errUnknownCommand}
+	}
+
+	// An oversized arg is skipped rather than failing straight away so the
+	// rest of the command is consumed and the stream stays in sync
+	tooLarge := 0
+	var tooLargeErr error
+
+	// Left of maxBatchBytes, once it runs out the rest of a batch is skipped
+	// the same way instead of being buffered
+	limited := false
+	remaining := 0
+
+	cmd := command{name: string(name)}
+
+	if batchCommands[cmd.name] {
+		// Keep the count as the first arg so the command re-encodes as it came
+		count, err := d.readCount()
+		if err == io.EOF {
+			return command{}, io.ErrUnexpectedEOF
+		}
+		if err == errInvalidArg {
+			return command{}, &parseError{command: cmd.name, arg: 1, err: err}
+		}
+		if err != nil {
+			return command{}, err
+		}
+
+		cmd.args = append(cmd.args, strconv.Itoa(count))
+		argCount = 1 + count*argCount
+
+		if d.maxBatchBytes > 0 {
+			limited = true
+			remaining = d.maxBatchBytes - len(cmd.encode())
+		}
+	}
+
+	for i := len(cmd.args); i < argCount; i++ {
+		limit := d.maxArgSize
+		if limited && remaining < limit {
+			limit = remaining
+		}
+
+		arg, err := d.readArgUpTo(limit)
+		if err == io.EOF {
+			// Stream ended part way through the command
+			return command{}, io.ErrUnexpectedEOF
+		}
+		if err == errArgTooLarge {
+			if tooLarge == 0 {
+				tooLarge = i + 1
+				tooLargeErr = errArgTooLarge
+				if limit < d.maxArgSize {
+					tooLargeErr = errBatchTooLarge
+				}
+			}
+			remaining = -1
+			continue
+		}
+		if err == errInvalidArg {
+			return command{}, &parseError{command: cmd.name, arg: i + 1, err: err}
+		}
+		if err != nil {
+			return command{}, err
+		}
+		cmd.args = append(cmd.args, arg)
+
+		if limited {
+			// The length prefix can still tip it over
+			remaining -= len(encodeArg(arg))
+			if remaining < 0 && tooLarge == 0 {
+				tooLarge = i + 1
+				tooLargeErr = errBatchTooLarge
+			}
+		}
+	}
+
+	if tooLargeErr == errBatchTooLarge {
+		return command{}, &parseError{command: cmd.name, err: errBatchTooLarge}
+	}
+	if tooLarge != 0 {
+		return command{}, &parseError{command: cmd.name, arg: tooLarge, err: errArgTooLarge}
+	}
+
+	return cmd, nil
+}
+
+// One digit giving the size of the length field, the length itself and then
+// the arg
+func (d *decoder) readArg() (string, error) {
+	return d.readArgUpTo(d.maxArgSize)
+}
+
+// readArg, skipping an arg longer than limit instead
+func (d *decoder) readArgUpTo(limit int) (string, error) {
+	lengthByte, err := d.reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	lengthBytes, _ := strconv.Atoi(string(lengthByte))
+	if lengthBytes < 1 || lengthBytes > 9 {
+		return "", errInvalidArg
+	}
+
+	lengthField := make([]byte, lengthBytes)
+	if _, err := io.ReadFull(d.reader, lengthField); err != nil {
+		return "", err
+	}
+
+	argLength, err := strconv.Atoi(string(lengthField))
+	if err != nil || lengthBytes != lengthDigits(argLength) {
+		return "", errInvalidArg
+	}
+
+	if argLength > limit {
+		// Don't buffer it, just throw the bytes away as they arrive
+		if _, err := d.reader.Discard(argLength); err != nil {
+			return "", err
+		}
+		return "", errArgTooLarge
+	}
+
+	arg := make([]byte, argLength)
+	if _, err := io.ReadFull(d.reader, arg); err != nil {
+		return "", err
+	}
+
+	return string(arg), nil
+}
+
+// Entry count of a batch command, anything we can't trust to say how many
+// args follow is invalid
+func (d *decoder) readCount() (int, error) {
+	arg, err := d.readArg()
+	if err == errArgTooLarge {
+		return 0, errInvalidArg
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := strconv.Atoi(arg)
+	if err != nil || count < 1 || count > maxBatchSize || arg != strconv.Itoa(count) {
+		return 0, errInvalidArg
+	}
+
+	return count, nil
+}
+
+// Keyed client commands
+var keyCommands = map[string]bool{
+	"get": true,
+	"del": true,
+	"put": true,
+	"pex": true,
+	"ttl": true,
+	"per": true,
+	"cas": true,
+	"pnx": true,
+	"pxx": true,
+	"inc": true,
+	"dec": true,
+}
+
+// Check the args of a decoded client command make sense, the decoder only
+// checks the framing
+func (cmd command) validate() error {
+	if keyCommands[cmd.name] && cmd.args[0] == "" {
+		return errEmptyKey
+	}
+
+	if cmd.name == "inc" || cmd.name == "dec" {
+		// dec negates the delta, which the smallest int64 can't survive
+		delta, err := strconv.ParseInt(cmd.args[1], 10, 64)
+		if err != nil || (cmd.name == "dec" && delta == math.MinInt64) {
+			return errBadDelta
+		}
+	}
+
+	if cmd.name == "scn" || cmd.name == "rng" || cmd.name == "rrg" {
+		count, err := strconv.Atoi(cmd.args[2])
+		if err != nil || count < 1 || count > maxPageSize {
+			return errBadCount
+		}
+	}
+
+	if batchCommands[cmd.name] {
+		for i := 1; i < len(cmd.args); i += commandArgs[cmd.name] {
+			if cmd.args[i] == "" {
+				return errEmptyKey
+			}
+		}
+	}
+
+	if cmd.name == "cns" && cmd.args[0] != "" {
+		if _, err := ParseConsistency(cmd.args[0]); err != nil {
+			return errBadConsistency
+		}
+	}
+
+	if (cmd.name == "mad" || cmd.name == "mrm") && checkPeer(cmd.args[1]) != nil {
+		return errBadAddress
+	}
+
+	if cmd.name == "pex" {
+		ttl, err := strconv.ParseInt(cmd.args[2], 10, 64)
+		if err != nil || ttl <= 0 || ttl > maxTTL {
+			return errBadTTL
+		}
+	}
+
+	return nil
+}
+
+// Drop whatever is left of the current read after a bad command, there is no
+// way to find the start of the next command in it
+func (d *decoder) reset() {
+	_, _ = d.reader.Discard(d.reader.Buffered())
+}
+
+// The stream can't be trusted after these, unlike errArgTooLarge and
+// errBatchTooLarge
+func isProtocolError(err error) bool {
+	return errors.Is(err, errUnknownCommand) || errors.Is(err, errInvalidArg)
+}
@@ -0,0 +1,105 @@
+package dataServer
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Emanuel-Nunes/Go-TCPServer/store"
+)
+
+// Protocol versions a client can ask for with ver. Connections start on v1
+// where every failure is a bare err.
+const (
+	protocolV1         = 1
+	protocolV2         = 2 // err is followed by a code and a message
+	maxProtocolVersion = protocolV2
+)
+
+// Codes sent with a v2 err so clients can tell failures apart
+const (
+	codeMissingKey   = "missing_key"
+	codeMalformed    = "malformed"
+	codeTooLarge     = "too_large"
+	codeReadOnly     = "read_only"
+	codeUnauthorized = "unauthorized"
+	codeInternal     = "internal"
+	codeNotInteger   = "not_integer"
+	codeOverflow     = "overflow"
+
+	// The store is at its memory limit and the policy is to reject writes
+	codeOutOfMemory = "out_of_memory"
+
+	// The write was applied here but not enough replicas confirmed it in time
+	codeReplicationTimeout = "replication_timeout"
+
+	// Raft mode, there is no leader to take the write just now, or the one
+	// that took it lost it. Either way it wasn't applied.
+	codeNoLeader = "no_leader"
+
+	// Raft mode, the members can't be changed as asked
+	codeMembership = "membership"
+)
+
+var (
+	errEmptyKey   = errors.New("Empty key")
+	errBadTTL     = errors.New("Bad TTL")
+	errBadVersion = errors.New("Bad protocol version")
+	errReadOnly   = errors.New("Server is read only")
+	errBadToken   = errors.New("Bad admin token")
+	errBadDelta   = errors.New("Bad delta")
+	errBadCount   = errors.New("Bad count")
+
+	errBadConsistency     = errors.New("Bad consistency")
+	errReplicationTimeout = errors.New("Not enough replicas confirmed the write in time")
+
+	errNoLeader           = errors.New("No raft leader to take the write")
+	errNotCommitted       = errors.New("The write wasn't committed in time, it may still be applied")
+	errEntryReplaced      = errors.New("The write was replaced by another leader's and won't be applied")
+	errBadAddress         = errors.New("Bad member address")
+	errNotRaft            = errors.New("Server isn't running raft")
+	errMembershipChanging = errors.New("A membership change is already in progress")
+	errLastMember         = errors.New("Can't remove the last member")
+)
+
+// Failure response in the format the client asked for
+func errResponse(version int, code string, err error) string {
+	if version < protocolV2 {
+		return "err"
+	}
+	return "err" + encodeArg(code) + encodeArg(err.Error())
+}
+
+// Failure response for an error from the decoder or the store
+func errorResponse(version int, err error) string {
+	switch {
+	case errors.Is(err, store.ErrKeyNotFound):
+		return errResponse(version, codeMissingKey, err)
+	case errors.Is(err, errUnknownCommand), errors.Is(err, errInvalidArg), errors.Is(err, store.ErrBadData):
+		return errResponse(version, codeMalformed, err)
+	case errors.Is(err, errEmptyKey), errors.Is(err, errBadTTL), errors.Is(err, errBadVersion), errors.Is(err, errBadDelta), errors.Is(err, errBadCount), errors.Is(err, errBadConsistency), errors.Is(err, errBadAddress):
+		return errResponse(version, codeMalformed, err)
+	case errors.Is(err, store.ErrNotInteger):
+		return errResponse(version, codeNotInteger, err)
+	case errors.Is(err, store.ErrOverflow):
+		return errResponse(version, codeOverflow, err)
+	case errors.Is(err, store.ErrOutOfMemory):
+		return errResponse(version, codeOutOfMemory, err)
+	case errors.Is(err, errArgTooLarge), errors.Is(err, errBatchTooLarge):
+		return errResponse(version, codeTooLarge, err)
+	case errors.Is(err, errReadOnly):
+		return errResponse(version, codeReadOnly, err)
+	case errors.Is(err, errBadToken):
+		return errResponse(version, codeUnauthorized, err)
+	case errors.Is(err, errReplicationTimeout), errors.Is(err, errNotCommitted):
+		return errResponse(version, codeReplicationTimeout, err)
+	case errors.Is(err, errNoLeader), errors.Is(err, errEntryReplaced):
+		return errResponse(version, codeNoLeader, err)
+	case errors.Is(err, errNotRaft), errors.Is(err, errMembershipChanging), errors.Is(err, errLastMember):
+		return errResponse(version, codeMembership, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return errResponse(version, codeInternal, errors.New("Store timed out"))
+	}
+
+	// A failed log write and anything else on our side
+	return errResponse(version, codeInternal, err)
+}
@@ -0,0 +1,132 @@
+package dataServer
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	// Largest datagram we will try to read off the cluster socket
+	maxDatagramSize = 65535
+
+	// Keep replicated datagrams under a typical ethernet MTU
+	maxFragmentPayload = 1200
+
+	// Give up on a message if its fragments stop arriving
+	fragmentTimeout = 30 * time.Second
+)
+
+// Split a replication message into "frg" commands small enough for a single
+// datagram. Each fragment carries the message id, its index and the total
+// number of fragments so the receiver can put it back together.
+func fragment(id uint64, msg string) []string {
+	if len(msg) <= maxFragmentPayload {
+		return []string{msg}
+	}
+
+	total := (len(msg) + maxFragmentPayload - 1) / maxFragmentPayload
+	datagrams := make([]string, 0, total)
+
+	for i := 0; i < total; i++ {
+		upperBound := (i + 1) * maxFragmentPayload
+		if upperBound > len(msg) {
+			upperBound = len(msg)
+		}
+
+		frg := command{
+			name: "frg",
+			args: []string{
+				strconv.FormatUint(id, 10),
+				strconv.Itoa(i),
+				strconv.Itoa(total),
+				msg[i*maxFragmentPayload : upperBound],
+			},
+		}
+		datagrams = append(datagrams, frg.encode())
+	}
+
+	return datagrams
+}
+
+type partialMessage struct {
+	parts    []string
+	received int
+	lastSeen time.Time
+}
+
+// Collects fragments per sender until a whole message has arrived. Only used
+// from the cluster listener goroutine so it isn't locked.
+type reassembler struct {
+	pending     map[string]*partialMessage
+	maxMessages int
+	maxParts    int
+}
+
+func newReassembler(maxMessageSize int) *reassembler {
+	return &reassembler{
+		pending:     make(map[string]*partialMessage),
+		maxMessages: 64,
+		maxParts:    maxMessageSize/maxFragmentPayload + 1,
+	}
+}
+
+// Returns the full message once the last missing fragment is added
+func (r *reassembler) add(source string, frg command) (string, bool) {
+	index, err1 := strconv.Atoi(frg.args[1])
+	total, err2 := strconv.Atoi(frg.args[2])
+
+	if err1 != nil || err2 != nil || total < 1 || total > r.maxParts || index < 0 || index >= total {
+		return "", false
+	}
+
+	r.expire()
+
+	id := source + "/" + frg.args[0]
+	msg, ok := r.pending[id]
+	if !ok {
+		if len(r.pending) >= r.maxMessages {
+			// Too much in flight, drop it and let the sender's next update win
+			return "", false
+		}
+		msg = &partialMessage{parts: make([]string, total)}
+		r.pending[id] = msg
+	}
+
+	if len(msg.parts) != total {
+		// Doesn't agree with the fragments we already have
+		delete(r.pending, id)
+		return "", false
+	}
+
+	msg.lastSeen = time.Now()
+	if msg.parts[index] == "" {
+		msg.parts[index] = frg.args[3]
+		msg.received++
+	}
+
+	if msg.received < total {
+		return "", false
+	}
+
+	delete(r.pending, id)
+
+	size := 0
+	for _, part := range msg.parts {
+		size += len(part)
+	}
+
+	buffer := make([]byte, 0, size)
+	for _, part := range msg.parts {
+		buffer = append(buffer, part...)
+	}
+
+	return string(buffer), true
+}
+
+func (r *reassembler) expire() {
+	for id, msg := range r.pending {
+		if time.Since(msg.lastSeen) > fragmentTimeout {
+			delete(r.pending, id)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package dataServer
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States a member goes through as it stops answering. A suspect member can
+// still clear its name, a dead one has to rejoin.
+const (
+	stateAlive   = "alive"
+	stateSuspect = "suspect"
+	stateDead    = "dead"
+)
+
+// Timings of the gossip protocol, see SetGossipOptions
+type GossipOptions struct {
+	ProbeInterval  time.Duration // how often one member is pinged
+	ProbeTimeout   time.Duration // wait for an answer before asking others to ping it
+	SuspectTimeout time.Duration // how long a suspect member has to answer before it is dead
+	IndirectProbes int           // members asked to ping one that didn't answer
+}
+
+var DefaultGossipOptions = GossipOptions{
+	ProbeInterval:  time.Second,
+	ProbeTimeout:   300 * time.Millisecond,
+	SuspectTimeout: 5 * time.Second,
+	IndirectProbes: 3,
+}
+
+const (
+	// Most member updates carried on each gossip message
+	maxPiggyback = 8
+
+	// Updates are sent this many times the log of the cluster size, enough
+	// for everyone to hear about them with high probability
+	retransmitMult = 3
+
+	// Every this many protocol periods a dead member is asked to join us,
+	// so the two halves of a healed partition find each other again
+	deadProbePeriods = 10
+)
+
+type member struct {
+	addr        string
+	state       string
+	incarnation uint64 // bumped by the member itself to refute a suspicion
+	changed     time.Time
+}
+
+// A member's state as passed around in gossip
+type memberUpdate struct {
+	addr        string
+	state       string
+	incarnation uint64
+	transmits   int
+}
+
+// Where to send the answer to a ping we made for someone else
+type relay struct {
+	origin  string
+	seq     string
+	started time.Time
+}
+
+// A message to send once the lock is released
+type outgoing struct {
+	addr string
+	msg  string
+}
+
+// SWIM style membership. Each probe interval one member is pinged, in a
+// shuffled round robin. If it doesn't answer in time some others are asked to
+// ping it, and if none of them hear from it either it becomes suspect. A
+// suspect that doesn't refute the suspicion within the timeout is dead.
+// Changes spread by riding along on the pings and acks.
+type membership struct {
+	self    string
+	options GossipOptions
+	send    func(addr, msg string)
+
+	mutex   sync.Mutex
+	members map[string]*member // including ourselves
+	updates []*memberUpdate    // still being gossiped
+	probes  map[string]chan struct{}
+	relays  map[string]relay
+	seq     uint64
+	order   []string // probe order for this round
+	next    int
+	joined  bool // a seed has sent us the member list
+}
+
+func newMembership(self string, send func(addr, msg string)) *membership {
+	m := &membership{
+		self:    self,
+		options: DefaultGossipOptions,
+		send:    send,
+		members: make(map[string]*member),
+		probes:  make(map[string]chan struct{}),
+		relays:  make(map[string]relay),
+	}
+	m.members[self] = &member{addr: self, state: stateAlive, changed: time.Now()}
+	return m
+}
+
+// Assume addr is up until probing says otherwise
+func (m *membership) add(addr string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.members[addr]; !ok && addr != m.self {
+		m.members[addr] = &member{addr: addr, state: stateAlive, changed: time.Now()}
+	}
+}
+
+// Ask seed for the member list, it tells the rest of the cluster about us.
+// Everything we know goes with it, so a member we had down as dead hears
+// about it and refutes it.
+func (m *membership) join(seed string) {
+	m.mutex.Lock()
+	var all []*memberUpdate
+	for _, mbr := range m.members {
+		all = append(all, m.update(mbr))
+	}
+	msg := command{name: "jon", args: []string{m.self, encodeUpdates(all)}}.encode()
+	m.mutex.Unlock()
+
+	m.send(seed, msg)
+}
+
+// Addresses of the other members that aren't dead, in order
+func (m *membership) live() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var addrs []string
+	for addr, mbr := range m.members {
+		if addr != m.self && mbr.state != stateDead {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Number of members we know of, ourselves and dead ones included
+func (m *membership) size() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.members)
+}
+
+// Every member we know of, ourselves included, in address order
+func (m *membership) list() []member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	members := make([]member, 0, len(m.members))
+	for _, mbr := range m.members {
+		members = append(members, *mbr)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].addr < members[j].addr })
+	return members
+}
+
+// Join through seeds, then probe a member every interval until quit is
+// closed. Seeds are asked again each interval until one of them answers, in
+// case they weren't up yet. Dead members are asked to join now and again in
+// case they were only cut off.
+func (m *membership) run(seeds []string, quit <-chan struct{}) {
+	ticker := time.NewTicker(m.options.ProbeInterval)
+	defer ticker.Stop()
+
+	for periods := 1; ; periods++ {
+		m.mutex.Lock()
+		joined := m.joined || len(seeds) == 0
+		m.mutex.Unlock()
+
+		if !joined {
+			for _, seed := range seeds {
+				m.join(seed)
+			}
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			m.probe(quit)
+			m.expire()
+		}
+
+		if periods%deadProbePeriods == 0 {
+			if dead := m.randomDead(); dead != "" {
+				m.join(dead)
+			}
+		}
+	}
+}
+
+// A dead member picked at random, "" if there aren't any
+func (m *membership) randomDead() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var dead []string
+	for addr, mbr := range m.members {
+		if mbr.state == stateDead {
+			dead = append(dead, addr)
+		}
+	}
+
+	if len(dead) == 0 {
+		return ""
+	}
+	return dead[rand.Intn(len(dead))]
+}
+
+// One protocol period: ping the next member, then ask others to ping it for
+// us, then suspect it
+func (m *membership) probe(quit <-chan struct{}) {
+	m.mutex.Lock()
+	target := m.nextTarget()
+	if target == "" {
+		m.mutex.Unlock()
+		return
+	}
+
+	seq, acked := m.newProbe()
+	ping := m.message("png", seq, m.self)
+	m.mutex.Unlock()
+
+	defer m.endProbe(seq)
+
+	m.send(target, ping)
+
+	select {
+	case <-acked:
+		return
+	case <-quit:
+		return
+	case <-time.After(m.options.ProbeTimeout):
+	}
+
+	m.mutex.Lock()
+	var requests []outgoing
+	for _, helper := range m.helpers(target) {
+		requests = append(requests, outgoing{helper, m.message("prq", seq, m.self, target)})
+	}
+	m.mutex.Unlock()
+
+	for _, request := range requests {
+		m.send(request.addr, request.msg)
+	}
+
+	select {
+	case <-acked:
+		return
+	case <-quit:
+		return
+	case <-time.After(m.options.ProbeInterval - m.options.ProbeTimeout):
+	}
+
+	m.mutex.Lock()
+	if mbr, ok := m.members[target]; ok && mbr.state == stateAlive {
+		m.setState(mbr, stateSuspect, mbr.incarnation)
+	}
+	m.mutex.Unlock()
+}
+
+// Declare suspects that ran out of time dead and forget relays nobody
+// answered
+func (m *membership) expire() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, mbr := range m.members {
+		if mbr.state == stateSuspect && now.Sub(mbr.changed) >= m.options.SuspectTimeout {
+			m.setState(mbr, stateDead, mbr.incarnation)
+		}
+	}
+
+	for seq, r := range m.relays {
+		if now.Sub(r.started) >= m.options.ProbeInterval {
+			delete(m.relays, seq)
+		}
+	}
+}
+
+// Deal with a gossip message from another member
+func (m *membership) handle(cmd command) {
+	m.mutex.Lock()
+
+	m.apply(decodeUpdates(cmd.args[len(cmd.args)-1]))
+
+	var replies []outgoing
+
+	switch cmd.name {
+	case "png":
+		seq, from := cmd.args[0], cmd.args[1]
+		replies = append(replies, outgoing{from, m.message("pak", seq, m.self)})
+	case "prq":
+		// Ping target for from, passing on the ack if one comes back
+		seq, from, target := cmd.args[0], cmd.args[1], cmd.args[2]
+		ourSeq := m.nextSeq()
+		m.relays[ourSeq] = relay{origin: from, seq: seq, started: time.Now()}
+		replies = append(replies, outgoing{target, m.message("png", ourSeq, m.self)})
+	case "pak":
+		seq := cmd.args[0]
+		if acked, ok := m.probes[seq]; ok {
+			close(acked)
+			delete(m.probes, seq)
+		}
+		if r, ok := m.relays[seq]; ok {
+			delete(m.relays, seq)
+			replies = append(replies, outgoing{r.origin, m.message("pak", r.seq, m.self)})
+		}
+	case "jon":
+		// Everything we know, in one go rather than a few at a time
+		from := cmd.args[0]
+		var all []*memberUpdate
+		for _, mbr := range m.members {
+			all = append(all, m.update(mbr))
+		}
+		replies = append(replies, outgoing{from, command{name: "syn", args: []string{m.self, encodeUpdates(all)}}.encode()})
+	case "syn":
+		// Already applied
+		m.joined = true
+	}
+
+	m.mutex.Unlock()
+
+	for _, reply := range replies {
+		m.send(reply.addr, reply.msg)
+	}
+}
+
+// Merge what another member told us. Higher incarnations win, and at the
+// same incarnation dead beats suspect beats alive. Anything said about us
+// other than that we're alive is refuted with a higher incarnation.
+func (m *membership) apply(updates []*memberUpdate) {
+	for _, u := range updates {
+		if u.addr == m.self {
+			self := m.members[m.self]
+			if u.incarnation > self.incarnation || (u.incarnation == self.incarnation && u.state != stateAlive) {
+				incarnation := u.incarnation
+				if u.state != stateAlive {
+					incarnation++
+				}
+				m.setState(self, stateAlive, incarnation)
+			}
+			continue
+		}
+
+		mbr, ok := m.members[u.addr]
+		if !ok {
+			mbr = &member{addr: u.addr, state: u.state, incarnation: u.incarnation}
+			m.members[u.addr] = mbr
+			m.setState(mbr, u.state, u.incarnation)
+			continue
+		}
+
+		if u.incarnation > mbr.incarnation || (u.incarnation == mbr.incarnation && stateRank(u.state) > stateRank(mbr.state)) {
+			m.setState(mbr, u.state, u.incarnation)
+		}
+	}
+}
+
+func stateRank(state string) int {
+	switch state {
+	case stateSuspect:
+		return 1
+	case stateDead:
+		return 2
+	}
+	return 0
+}
+
+// Change a member's state and start telling everyone
+func (m *membership) setState(mbr *member, state string, incarnation uint64) {
+	mbr.state = state
+	mbr.incarnation = incarnation
+	mbr.changed = time.Now()
+
+	// Only the latest news about a member is worth passing on
+	for i, u := range m.updates {
+		if u.addr == mbr.addr {
+			m.updates = append(m.updates[:i], m.updates[i+1:]...)
+			break
+		}
+	}
+	m.updates = append(m.updates, m.update(mbr))
+}
+
+func (m *membership) update(mbr *member) *memberUpdate {
+	return &memberUpdate{addr: mbr.addr, state: mbr.state, incarnation: mbr.incarnation}
+}
+
+// A gossip message with args, followed by the updates sent the fewest times
+// so far
+func (m *membership) message(name string, args ...string) string {
+	sort.SliceStable(m.updates, func(i, j int) bool { return m.updates[i].transmits < m.updates[j].transmits })
+
+	limit := retransmitMult * (1 + int(logBase2(len(m.members))))
+
+	var piggyback []*memberUpdate
+	for i := 0; i < len(m.updates) && len(piggyback) < maxPiggyback; i++ {
+		m.updates[i].transmits++
+		piggyback = append(piggyback, m.updates[i])
+	}
+
+	kept := m.updates[:0]
+	for _, u := range m.updates {
+		if u.transmits < limit {
+			kept = append(kept, u)
+		}
+	}
+	m.updates = kept
+
+	return command{name: name, args: append(args, encodeUpdates(piggyback))}.encode()
+}
+
+func logBase2(n int) int {
+	log := 0
+	for n > 1 {
+		n >>= 1
+		log++
+	}
+	return log
+}
+
+// Next member to ping, going through them all in a random order before
+// starting again. "" if there is nobody to ping.
+func (m *membership) nextTarget() string {
+	for attempt := 0; attempt < 2; attempt++ {
+		for m.next < len(m.order) {
+			addr := m.order[m.next]
+			m.next++
+			if mbr, ok := m.members[addr]; ok && mbr.state != stateDead {
+				return addr
+			}
+		}
+
+		m.order = m.order[:0]
+		for addr, mbr := range m.members {
+			if addr != m.self && mbr.state != stateDead {
+				m.order = append(m.order, addr)
+			}
+		}
+		rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		m.next = 0
+	}
+	return ""
+}
+
+// Members to ask to ping target for us
+func (m *membership) helpers(target string) []string {
+	var helpers []string
+	for addr, mbr := range m.members {
+		if addr != m.self && addr != target && mbr.state == stateAlive {
+			helpers = append(helpers, addr)
+		}
+	}
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > m.options.IndirectProbes {
+		helpers = helpers[:m.options.IndirectProbes]
+	}
+	return helpers
+}
+
+func (m *membership) nextSeq() string {
+	m.seq++
+	return strconv.FormatUint(m.seq, 10)
+}
+
+// Start waiting for an ack, the channel is closed when it arrives
+func (m *membership) newProbe() (string, chan struct{}) {
+	seq := m.nextSeq()
+	acked := make(chan struct{})
+	m.probes[seq] = acked
+	return seq, acked
+}
+
+func (m *membership) endProbe(seq string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.probes, seq)
+}
+
+// Updates travel as one arg holding address, state and incarnation args for
+// each member, so they fit the fixed arg counts of the cluster commands
+func encodeUpdates(updates []*memberUpdate) string {
+	var sb strings.Builder
+	for _, u := range updates {
+		sb.WriteString(encodeArg(u.addr))
+		sb.WriteString(encodeArg(u.state))
+		sb.WriteString(encodeArg(strconv.FormatUint(u.incarnation, 10)))
+	}
+	return sb.String()
+}
+
+// Anything after a malformed update is dropped
+func decodeUpdates(arg string) []*memberUpdate {
+	d := newDecoder(strings.NewReader(arg), nil, len(arg))
+
+	var updates []*memberUpdate
+	for {
+		addr, err := d.readArg()
+		if err != nil {
+			return updates
+		}
+		state, err := d.readArg()
+		if err != nil || stateRank(state) == 0 && state != stateAlive {
+			return updates
+		}
+		incarnationArg, err := d.readArg()
+		if err != nil {
+			return updates
+		}
+		incarnation, err := strconv.ParseUint(incarnationArg, 10, 64)
+		if err != nil || addr == "" {
+			return updates
+		}
+
+		updates = append(updates, &memberUpdate{addr: addr, state: state, incarnation: incarnation})
+	}
+}
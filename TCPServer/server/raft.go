@@ -0,0 +1,1365 @@
+package dataServer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles a raft node can be in
+const (
+	roleFollower  = "follower"
+	roleCandidate = "candidate"
+	roleLeader    = "leader"
+)
+
+// Kinds of raft log entry
+const (
+	entryWrite  = "w" // a client write in wire format
+	entryConfig = "c" // the voting members from here on, comma separated
+	entryNoop   = "n" // added by a new leader so entries from earlier terms can commit
+)
+
+// What a follower asks the leader to do with fwd
+const (
+	forwardWrite  = "w"
+	forwardAdd    = "a"
+	forwardRemove = "r"
+)
+
+const (
+	// Most entries sent in one append, and the most bytes of them. A write
+	// has to fit in one append so that is also the biggest one raft takes.
+	maxAppendEntries = 64
+	maxAppendBytes   = 64 * 1024
+
+	// Heartbeats an append with entries goes unanswered before it is taken
+	// as lost and sent again
+	appendTimeoutBeats = 4
+
+	// Snapshots are sent to followers that are too far behind in pieces
+	snapshotChunkSize = 32 * 1024
+
+	// How long the applier waits before trying an entry or snapshot the store
+	// failed on again
+	applyRetryInterval = 100 * time.Millisecond
+)
+
+type RaftOptions struct {
+	// Where the term, vote, log and snapshots are kept. Nothing survives a
+	// restart if empty.
+	Dir string
+
+	HeartbeatInterval time.Duration
+
+	// A follower that hasn't heard from a leader for somewhere between this
+	// and twice this stands for election
+	ElectionTimeout time.Duration
+
+	// Entries applied since the last snapshot before the log is compacted
+	// into a new one, 0 never compacts
+	SnapshotEntries int
+
+	// How long a client write waits to be committed
+	CommitTimeout time.Duration
+
+	// Start with no members and wait to be added with mad, for a node
+	// joining a cluster that is already running
+	Join bool
+}
+
+var DefaultRaftOptions = RaftOptions{
+	HeartbeatInterval: 50 * time.Millisecond,
+	ElectionTimeout:   500 * time.Millisecond,
+	SnapshotEntries:   10000,
+	CommitTimeout:     2 * time.Second,
+}
+
+// What raft needs from the store to compact its log, the store is the state
+// machine
+type snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+var errNotLeader = errors.New("Not the raft leader")
+
+type logEntry struct {
+	term uint64
+	kind string
+	data string
+}
+
+// A client waiting on the leader for its entry to be applied
+type proposal struct {
+	term    uint64
+	version int // the client's, for the response
+	done    chan string
+}
+
+// A write sent on to the leader that hasn't been answered. It is sent again
+// every heartbeat, but only to the same leader, another one wouldn't know it
+// had already been proposed.
+type forwarded struct {
+	leader string
+	msg    string
+	done   chan string
+}
+
+// Entries sent to a follower that it hasn't answered yet
+type appendInFlight struct {
+	last uint64 // newest entry in the append
+	at   time.Time
+}
+
+// A forwarded write we took as leader, kept for a while so one sent again
+// isn't proposed twice
+type receivedForward struct {
+	response string // "" until it has one
+	at       time.Time
+}
+
+// A snapshot on its way from the leader
+type incomingSnapshot struct {
+	index  uint64
+	term   uint64
+	config []string
+	data   []byte
+}
+
+// Raft consensus over the cluster transport. Writes are appended to the
+// leader's log, copied to the followers and applied to the store on every
+// node in log order once a majority have them. Members are changed one at a
+// time with config entries, which take effect as soon as they are in a
+// node's log.
+//
+// Messages go through handle from the cluster listener, elections and
+// heartbeats run off a ticker and committed entries are applied on their own
+// goroutine so a slow store never holds up the protocol.
+type raft struct {
+	self      string
+	options   RaftOptions
+	send      func(addr, msg string)
+	apply     func(data string, version int) (string, error) // error if the store failed to apply it
+	snapshots snapshotter
+	storage   *raftStorage
+
+	mutex            sync.Mutex
+	term             uint64
+	votedFor         string
+	role             string
+	leader           string // "" while we don't know of one
+	heardFromLeader  time.Time
+	electionDeadline time.Time
+
+	// Entries after the snapshot, the first is at snapshotIndex+1
+	log            []logEntry
+	snapshotIndex  uint64
+	snapshotTerm   uint64
+	snapshotConfig []string
+	snapshotData   []byte // kept to send to followers that need it
+
+	config      []string // as of the newest config entry in the log
+	configIndex uint64   // where that entry is
+
+	commitIndex uint64
+	lastApplied uint64
+	restore     *incomingSnapshot // installed, waiting for the applier to hand it to the store
+	incoming    *incomingSnapshot
+
+	// Candidate
+	votes map[string]bool
+
+	// Leader
+	nextIndex      map[string]uint64
+	matchIndex     map[string]uint64
+	inFlight       map[string]appendInFlight // by peer, heartbeats only until it's answered
+	snapshotOffset map[string]int
+	proposals      map[uint64]*proposal // by index
+
+	// Writes sent on to the leader, by id. Ids start again from 1 when we
+	// restart so they go with an epoch that doesn't.
+	epoch     string
+	forwardID uint64
+	forwards  map[uint64]*forwarded
+
+	// Writes forwarded to us, by sender, epoch and id
+	received map[string]*receivedForward
+
+	commits chan struct{} // wakes the applier
+	wait    sync.WaitGroup
+}
+
+func newRaft(self string, options RaftOptions, send func(addr, msg string), apply func(data string, version int) (string, error), snapshots snapshotter) *raft {
+	return &raft{
+		self:      self,
+		options:   options,
+		send:      send,
+		apply:     apply,
+		snapshots: snapshots,
+		epoch:     strconv.FormatInt(time.Now().UnixNano(), 10),
+		role:      roleFollower,
+		proposals: make(map[uint64]*proposal),
+		forwards:  make(map[uint64]*forwarded),
+		received:  make(map[string]*receivedForward),
+		commits:   make(chan struct{}, 1),
+	}
+}
+
+// Load whatever was saved in options.Dir, restoring the store from the last
+// snapshot. members are the ones to start with if nothing was.
+func (r *raft) open(members []string) error {
+	storage, saved, err := openRaftStorage(r.options.Dir)
+	if err != nil {
+		return err
+	}
+	r.storage = storage
+
+	r.term = saved.state.Term
+	r.votedFor = saved.state.Vote
+	r.snapshotConfig = members
+
+	if snapshot := saved.snapshot; snapshot != nil {
+		if err := r.snapshots.Restore(bytes.NewReader(snapshot.Data)); err != nil {
+			storage.close()
+			return err
+		}
+
+		r.snapshotIndex = snapshot.Index
+		r.snapshotTerm = snapshot.Term
+		r.snapshotConfig = snapshot.Config
+		r.snapshotData = snapshot.Data
+		r.commitIndex = snapshot.Index
+		r.lastApplied = snapshot.Index
+	}
+
+	// The rest is applied again once we learn how far it was committed
+	r.log = saved.entries
+	r.updateConfig()
+	r.resetElectionTimer()
+
+	log.Println("Raft starting at term", r.term, "with entries up to", r.lastIndex(), "and members", r.config)
+	return nil
+}
+
+// Run elections, heartbeats and the applier until quit is closed
+func (r *raft) start(quit <-chan struct{}) {
+	r.wait.Add(2)
+
+	go func() {
+		defer r.wait.Done()
+
+		ticker := time.NewTicker(r.options.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				r.sendAll(r.tick())
+			}
+		}
+	}()
+
+	go func() {
+		defer r.wait.Done()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-r.commits:
+				r.applyCommitted(quit)
+			}
+		}
+	}()
+}
+
+// Wait for start's goroutines to finish once quit is closed, nothing touches
+// the store after this
+func (r *raft) stop() {
+	r.wait.Wait()
+
+	if err := r.storage.close(); err != nil {
+		log.Println("Failed to close raft log:", err)
+	}
+}
+
+func (r *raft) tick() []outgoing {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, forward := range r.received {
+		if forward.response != "" && time.Since(forward.at) > 2*r.options.CommitTimeout {
+			delete(r.received, key)
+		}
+	}
+
+	if r.role == roleLeader {
+		r.heardFromLeader = time.Now()
+		return r.replicateAll()
+	}
+
+	var out []outgoing
+	for _, forward := range r.forwards {
+		if forward.leader == r.leader {
+			out = append(out, outgoing{forward.leader, forward.msg})
+		}
+	}
+
+	// A node that isn't a member, or isn't one yet, just follows
+	if time.Now().After(r.electionDeadline) && r.isMember(r.self) {
+		out = append(out, r.startElection()...)
+	}
+	return out
+}
+
+// A raft message from another node
+func (r *raft) handle(cmd command) {
+	r.mutex.Lock()
+
+	var out []outgoing
+	switch cmd.name {
+	case "rvt":
+		out = r.handleVoteRequest(cmd)
+	case "rvr":
+		out = r.handleVote(cmd)
+	case "aen":
+		out = r.handleAppend(cmd)
+	case "aer":
+		out = r.handleAppendResult(cmd)
+	case "isn":
+		out = r.handleSnapshot(cmd)
+	case "isr":
+		out = r.handleSnapshotResult(cmd)
+	case "fwr":
+		r.handleForwarded(cmd)
+	}
+
+	r.mutex.Unlock()
+	r.sendAll(out)
+}
+
+func (r *raft) sendAll(out []outgoing) {
+	for _, msg := range out {
+		r.send(msg.addr, msg.msg)
+	}
+}
+
+// Elections
+
+func (r *raft) startElection() []outgoing {
+	r.term++
+	r.role = roleCandidate
+	r.votedFor = r.self
+	r.leader = ""
+	r.votes = map[string]bool{r.self: true}
+	r.saveState()
+	r.resetElectionTimer()
+
+	log.Println("Standing for raft election in term", r.term)
+
+	if r.hasQuorum(r.votes) {
+		return r.becomeLeader()
+	}
+
+	msg := command{name: "rvt", args: []string{
+		formatIndex(r.term),
+		r.self,
+		formatIndex(r.lastIndex()),
+		formatIndex(r.lastTerm()),
+	}}.encode()
+
+	var out []outgoing
+	for _, peer := range r.peers() {
+		out = append(out, outgoing{peer, msg})
+	}
+	return out
+}
+
+// rvt: term, candidate, last log index, last log term
+func (r *raft) handleVoteRequest(cmd command) []outgoing {
+	term, lastIndex, lastTerm, ok := parseIndexes(cmd.args[0], cmd.args[2], cmd.args[3])
+	if !ok {
+		return nil
+	}
+	candidate := cmd.args[1]
+
+	// Nodes that are hearing from a leader ignore candidates, so one that was
+	// removed or cut off can't force an election by turning up with a higher
+	// term
+	if r.leader != "" && time.Since(r.heardFromLeader) < r.options.ElectionTimeout {
+		return nil
+	}
+
+	if term > r.term {
+		r.stepDown(term)
+	}
+
+	// Only for a candidate with a log at least as up to date as ours
+	upToDate := lastTerm > r.lastTerm() || (lastTerm == r.lastTerm() && lastIndex >= r.lastIndex())
+
+	granted := false
+	if term == r.term && (r.votedFor == "" || r.votedFor == candidate) && upToDate {
+		r.votedFor = candidate
+		if r.saveState() {
+			granted = true
+			r.resetElectionTimer()
+		}
+	}
+
+	return []outgoing{{candidate, command{name: "rvr", args: []string{formatIndex(r.term), r.self, formatBool(granted)}}.encode()}}
+}
+
+// rvr: term, voter, granted
+func (r *raft) handleVote(cmd command) []outgoing {
+	term, ok := parseIndex(cmd.args[0])
+	if !ok {
+		return nil
+	}
+
+	if term > r.term {
+		r.stepDown(term)
+		return nil
+	}
+
+	if r.role != roleCandidate || term != r.term || cmd.args[2] != "1" {
+		return nil
+	}
+
+	r.votes[cmd.args[1]] = true
+	if r.hasQuorum(r.votes) {
+		return r.becomeLeader()
+	}
+	return nil
+}
+
+func (r *raft) becomeLeader() []outgoing {
+	log.Println("Raft leader for term", r.term)
+
+	r.role = roleLeader
+	r.leader = r.self
+	r.heardFromLeader = time.Now()
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	r.inFlight = make(map[string]appendInFlight)
+	r.snapshotOffset = make(map[string]int)
+
+	// Entries from earlier terms only count as committed once one from ours
+	// is, so get one in straight away
+	if err := r.appendLocal(logEntry{term: r.term, kind: entryNoop}); err != nil {
+		log.Println("Failed to write raft log:", err)
+	}
+	r.advanceCommit()
+
+	return r.replicateAll()
+}
+
+// Seen a newer term in a message that isn't from its leader
+func (r *raft) stepDown(term uint64) {
+	r.term = term
+	r.votedFor = ""
+	r.saveState()
+
+	if r.role != roleFollower {
+		r.becomeFollower()
+		r.resetElectionTimer()
+	}
+	r.leader = ""
+}
+
+// Heard from the leader of term
+func (r *raft) follow(term uint64, leader string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.saveState()
+	}
+
+	r.becomeFollower()
+	r.leader = leader
+	r.heardFromLeader = time.Now()
+	r.resetElectionTimer()
+}
+
+func (r *raft) becomeFollower() {
+	if r.role == roleLeader {
+		log.Println("No longer the raft leader in term", r.term)
+
+		// Their entries may still commit under the next leader, or may not
+		for index, p := range r.proposals {
+			if index > r.commitIndex {
+				p.done <- errorResponse(p.version, errNotCommitted)
+				delete(r.proposals, index)
+			}
+		}
+	}
+	r.role = roleFollower
+}
+
+func (r *raft) resetElectionTimer() {
+	timeout := r.options.ElectionTimeout + time.Duration(rand.Int63n(int64(r.options.ElectionTimeout)))
+	r.electionDeadline = time.Now().Add(timeout)
+}
+
+// Log replication
+
+// Leader only. Add an entry to the log for a client, who hears back on the
+// channel once it has been applied or can't be.
+func (r *raft) propose(data string, version int) (chan string, error) {
+	if len(data) > maxAppendBytes {
+		return nil, errArgTooLarge
+	}
+
+	r.mutex.Lock()
+	done, out, err := r.appendProposal(entryWrite, data, version)
+	r.mutex.Unlock()
+
+	r.sendAll(out)
+	return done, err
+}
+
+// Leader only. Add or remove a voting member, one change at a time.
+func (r *raft) changeMembers(add bool, addr string, version int) (chan string, error) {
+	r.mutex.Lock()
+
+	if r.role != roleLeader {
+		r.mutex.Unlock()
+		return nil, errNotLeader
+	}
+
+	// Two changes in flight at once could leave two majorities that don't
+	// overlap
+	if r.configIndex > r.commitIndex {
+		r.mutex.Unlock()
+		return nil, errMembershipChanging
+	}
+
+	var config []string
+	for _, member := range r.config {
+		if member != addr {
+			config = append(config, member)
+		}
+	}
+	if add {
+		config = append(config, addr)
+	}
+
+	if len(config) == 0 {
+		r.mutex.Unlock()
+		return nil, errLastMember
+	}
+
+	if len(config) == len(r.config) {
+		// Already the way it was asked for
+		r.mutex.Unlock()
+		done := make(chan string, 1)
+		done <- "ack"
+		return done, nil
+	}
+
+	log.Println("Changing raft members to", config)
+
+	done, out, err := r.appendProposal(entryConfig, strings.Join(config, ","), version)
+	r.mutex.Unlock()
+
+	r.sendAll(out)
+	return done, err
+}
+
+func (r *raft) appendProposal(kind, data string, version int) (chan string, []outgoing, error) {
+	if r.role != roleLeader {
+		return nil, nil, errNotLeader
+	}
+
+	if err := r.appendLocal(logEntry{term: r.term, kind: kind, data: data}); err != nil {
+		log.Println("Failed to write raft log:", err)
+		return nil, nil, err
+	}
+
+	done := make(chan string, 1)
+	r.proposals[r.lastIndex()] = &proposal{term: r.term, version: version, done: done}
+	r.advanceCommit()
+
+	// Followers still working through the last append get this one once
+	// they answer
+	var out []outgoing
+	for _, peer := range r.peers() {
+		if _, waiting := r.inFlight[peer]; !waiting {
+			out = append(out, outgoing{peer, r.appendFor(peer)})
+		}
+	}
+	return done, out, nil
+}
+
+// Add entries to the end of our log, on disk first
+func (r *raft) appendLocal(entries ...logEntry) error {
+	if err := r.storage.append(r.lastIndex()+1, entries); err != nil {
+		return err
+	}
+
+	r.log = append(r.log, entries...)
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].kind == entryConfig {
+			r.config = splitConfig(entries[i].data)
+			r.configIndex = r.lastIndex() - uint64(len(entries)-1-i)
+			break
+		}
+	}
+	return nil
+}
+
+// An append or a piece of the snapshot for every other member
+func (r *raft) replicateAll() []outgoing {
+	var out []outgoing
+	for _, peer := range r.peers() {
+		out = append(out, outgoing{peer, r.appendFor(peer)})
+	}
+	return out
+}
+
+// aen: term, leader, previous index, previous term, commit index, entries.
+// Only a heartbeat, with no entries, while the last ones sent to peer are
+// still waiting on an answer.
+func (r *raft) appendFor(peer string) string {
+	next, ok := r.nextIndex[peer]
+	if !ok {
+		// New to us, start from the end and back up
+		next = r.lastIndex() + 1
+		r.nextIndex[peer] = next
+	}
+
+	if next <= r.snapshotIndex {
+		// What it needs has been compacted away
+		return r.snapshotFor(peer)
+	}
+
+	prev := next - 1
+	prevTerm, _ := r.termAt(prev)
+
+	// Still waiting to hear about the last lot, it's sent again once it has
+	// had long enough to be taken as lost
+	last := r.lastIndex()
+	if sent, ok := r.inFlight[peer]; ok && sent.last >= next && time.Since(sent.at) < appendTimeoutBeats*r.options.HeartbeatInterval {
+		last = prev
+	}
+
+	var entries strings.Builder
+	size := 0
+	for index := next; index <= last && index-next < maxAppendEntries; index++ {
+		entry := r.entryAt(index)
+
+		// The first always goes, writes are capped when they're proposed but
+		// one from an older log could still be bigger
+		if index > next && size+len(entry.data) > maxAppendBytes {
+			break
+		}
+		size += len(entry.data)
+
+		entries.WriteString(encodeArg(formatIndex(entry.term)))
+		entries.WriteString(encodeArg(entry.kind))
+		entries.WriteString(encodeArg(entry.data))
+		r.inFlight[peer] = appendInFlight{last: index, at: time.Now()}
+	}
+
+	return command{name: "aen", args: []string{
+		formatIndex(r.term),
+		r.self,
+		formatIndex(prev),
+		formatIndex(prevTerm),
+		formatIndex(r.commitIndex),
+		entries.String(),
+	}}.encode()
+}
+
+func (r *raft) handleAppend(cmd command) []outgoing {
+	term, prev, prevTerm, commit, ok := parseIndexes4(cmd.args[0], cmd.args[2], cmd.args[3], cmd.args[4])
+	entries, err := decodeEntries(cmd.args[5])
+	if !ok || err != nil {
+		log.Println("Bad raft append:", err)
+		return nil
+	}
+	leader := cmd.args[1]
+
+	if term < r.term {
+		// From a deposed leader, the reply tells it so
+		return r.appendResult(leader, false, 0)
+	}
+	r.follow(term, leader)
+
+	if prev < r.snapshotIndex {
+		// Entries up to the snapshot are committed so they already match
+		skip := r.snapshotIndex - prev
+		if skip >= uint64(len(entries)) {
+			return r.appendResult(leader, true, r.snapshotIndex)
+		}
+		entries = entries[skip:]
+		prev, prevTerm = r.snapshotIndex, r.snapshotTerm
+	}
+
+	if prev > r.lastIndex() {
+		return r.appendResult(leader, false, r.lastIndex())
+	}
+
+	if t, _ := r.termAt(prev); t != prevTerm {
+		// Back up past the whole term that doesn't match rather than one
+		// entry at a time
+		hint := prev - 1
+		for hint > r.snapshotIndex {
+			if earlier, _ := r.termAt(hint); earlier != t {
+				break
+			}
+			hint--
+		}
+		return r.appendResult(leader, false, hint)
+	}
+
+	for i, entry := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if t, _ := r.termAt(index); t == entry.term {
+				continue
+			}
+
+			// Ours never committed, the leader's replace it and everything after
+			r.log = r.log[:index-r.snapshotIndex-1]
+			r.updateConfig()
+		}
+
+		if err := r.appendLocal(entries[i:]...); err != nil {
+			log.Println("Failed to write raft log:", err)
+			return nil
+		}
+		break
+	}
+
+	match := prev + uint64(len(entries))
+	if commit > r.commitIndex && match > r.commitIndex {
+		r.commitIndex = minIndex(commit, match)
+		r.wakeApplier()
+	}
+
+	return r.appendResult(leader, true, match)
+}
+
+// aer: term, from, success, how far our log matches the leader's, or where to
+// try next when it doesn't
+func (r *raft) appendResult(leader string, success bool, match uint64) []outgoing {
+	msg := command{name: "aer", args: []string{formatIndex(r.term), r.self, formatBool(success), formatIndex(match)}}.encode()
+	return []outgoing{{leader, msg}}
+}
+
+func (r *raft) handleAppendResult(cmd command) []outgoing {
+	term, match, ok := parseIndexes2(cmd.args[0], cmd.args[3])
+	if !ok {
+		return nil
+	}
+	from := cmd.args[1]
+
+	if term > r.term {
+		r.stepDown(term)
+		return nil
+	}
+
+	if _, ok := r.nextIndex[from]; r.role != roleLeader || term != r.term || !ok {
+		return nil
+	}
+
+	if cmd.args[2] != "1" {
+		// Try again from where it says its log might match ours
+		delete(r.inFlight, from)
+		r.nextIndex[from] = minIndex(match, r.lastIndex()) + 1
+		if r.nextIndex[from] <= r.matchIndex[from] {
+			r.nextIndex[from] = r.matchIndex[from] + 1
+		}
+		return []outgoing{{from, r.appendFor(from)}}
+	}
+
+	if match > r.lastIndex() {
+		return nil
+	}
+
+	if match > r.matchIndex[from] {
+		r.matchIndex[from] = match
+	}
+	r.nextIndex[from] = r.matchIndex[from] + 1
+	delete(r.snapshotOffset, from)
+	if sent, ok := r.inFlight[from]; ok && r.matchIndex[from] >= sent.last {
+		delete(r.inFlight, from)
+	}
+
+	r.advanceCommit()
+
+	if _, waiting := r.inFlight[from]; !waiting && r.nextIndex[from] <= r.lastIndex() {
+		// Still behind, keep going rather than wait for the next heartbeat
+		return []outgoing{{from, r.appendFor(from)}}
+	}
+	return nil
+}
+
+// Leader only. Commit the newest entry from this term a majority have.
+func (r *raft) advanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex; index-- {
+		if t, _ := r.termAt(index); t != r.term {
+			// Earlier terms' entries commit along with ours
+			break
+		}
+
+		count := 0
+		for _, member := range r.config {
+			if member == r.self || r.matchIndex[member] >= index {
+				count++
+			}
+		}
+
+		if count > len(r.config)/2 {
+			r.commitIndex = index
+			r.wakeApplier()
+			break
+		}
+	}
+
+	// A leader that removed itself hands over once that is committed
+	if r.role == roleLeader && !r.isMember(r.self) && r.configIndex <= r.commitIndex {
+		log.Println("Removed from the raft members, stepping down")
+		r.becomeFollower()
+		r.leader = ""
+	}
+}
+
+// Snapshots
+
+// isn: term, leader, snapshot index, snapshot term, members, offset, data,
+// whether this is the last piece
+func (r *raft) snapshotFor(peer string) string {
+	offset := r.snapshotOffset[peer]
+	if offset > len(r.snapshotData) {
+		offset = 0
+	}
+
+	end := offset + snapshotChunkSize
+	if end > len(r.snapshotData) {
+		end = len(r.snapshotData)
+	}
+
+	return command{name: "isn", args: []string{
+		formatIndex(r.term),
+		r.self,
+		formatIndex(r.snapshotIndex),
+		formatIndex(r.snapshotTerm),
+		strings.Join(r.snapshotConfig, ","),
+		strconv.Itoa(offset),
+		string(r.snapshotData[offset:end]),
+		formatBool(end == len(r.snapshotData)),
+	}}.encode()
+}
+
+func (r *raft) handleSnapshot(cmd command) []outgoing {
+	term, index, lastTerm, ok := parseIndexes(cmd.args[0], cmd.args[2], cmd.args[3])
+	offset, err := strconv.Atoi(cmd.args[5])
+	if !ok || err != nil || offset < 0 {
+		return nil
+	}
+	leader := cmd.args[1]
+
+	if term < r.term {
+		return r.appendResult(leader, false, 0)
+	}
+	r.follow(term, leader)
+
+	if index <= r.commitIndex {
+		// Already have everything it covers
+		return r.appendResult(leader, true, index)
+	}
+
+	if offset == 0 {
+		r.incoming = &incomingSnapshot{index: index, term: lastTerm, config: splitConfig(cmd.args[4])}
+	}
+
+	if r.incoming == nil || r.incoming.index != index || offset != len(r.incoming.data) {
+		// Missed a piece, ask for it again
+		received := 0
+		if r.incoming != nil && r.incoming.index == index {
+			received = len(r.incoming.data)
+		}
+		return r.snapshotResult(leader, index, received)
+	}
+
+	r.incoming.data = append(r.incoming.data, cmd.args[6]...)
+	if cmd.args[7] != "1" {
+		return r.snapshotResult(leader, index, len(r.incoming.data))
+	}
+
+	snapshot := r.incoming
+	r.incoming = nil
+
+	if err := r.compact(snapshot); err != nil {
+		log.Println("Failed to save raft snapshot:", err)
+		return nil
+	}
+
+	r.commitIndex = snapshot.index
+	r.restore = snapshot
+	r.wakeApplier()
+
+	log.Println("Installed raft snapshot up to", snapshot.index)
+	return r.appendResult(leader, true, snapshot.index)
+}
+
+// isr: term, from, snapshot index, bytes of it received so far
+func (r *raft) snapshotResult(leader string, index uint64, received int) []outgoing {
+	msg := command{name: "isr", args: []string{formatIndex(r.term), r.self, formatIndex(index), strconv.Itoa(received)}}.encode()
+	return []outgoing{{leader, msg}}
+}
+
+func (r *raft) handleSnapshotResult(cmd command) []outgoing {
+	term, index, ok := parseIndexes2(cmd.args[0], cmd.args[2])
+	received, err := strconv.Atoi(cmd.args[3])
+	if !ok || err != nil || received < 0 {
+		return nil
+	}
+	from := cmd.args[1]
+
+	if term > r.term {
+		r.stepDown(term)
+		return nil
+	}
+
+	if _, ok := r.nextIndex[from]; r.role != roleLeader || term != r.term || !ok {
+		return nil
+	}
+
+	// A newer snapshot was taken since, it starts again from the beginning
+	r.snapshotOffset[from] = 0
+	if index == r.snapshotIndex {
+		r.snapshotOffset[from] = received
+	}
+
+	return []outgoing{{from, r.appendFor(from)}}
+}
+
+// Replace the log up to snapshot.index with the snapshot. Entries after it
+// are kept as long as they follow on from it.
+func (r *raft) compact(snapshot *incomingSnapshot) error {
+	var remaining []logEntry
+	if t, ok := r.termAt(snapshot.index); ok && t == snapshot.term && snapshot.index >= r.snapshotIndex {
+		remaining = append(remaining, r.log[snapshot.index-r.snapshotIndex:]...)
+	}
+
+	saved := raftSnapshot{Index: snapshot.index, Term: snapshot.term, Config: snapshot.config, Data: snapshot.data}
+	if err := r.storage.saveSnapshot(saved, remaining); err != nil {
+		return err
+	}
+
+	r.log = remaining
+	r.snapshotIndex = snapshot.index
+	r.snapshotTerm = snapshot.term
+	r.snapshotConfig = snapshot.config
+	r.snapshotData = snapshot.data
+	r.updateConfig()
+	return nil
+}
+
+// Applying
+
+func (r *raft) wakeApplier() {
+	select {
+	case r.commits <- struct{}{}:
+	default:
+	}
+}
+
+// Apply everything committed since last time, in order, then compact the log
+// if it has grown enough. An entry the store fails on is tried again until it
+// goes through or quit is closed, nothing after it is applied in the meantime.
+func (r *raft) applyCommitted(quit <-chan struct{}) {
+	for {
+		r.mutex.Lock()
+
+		if snapshot := r.restore; snapshot != nil {
+			r.mutex.Unlock()
+
+			if err := r.snapshots.Restore(bytes.NewReader(snapshot.data)); err != nil {
+				log.Println("Failed to restore raft snapshot:", err)
+				if !r.waitToRetry(quit) {
+					return
+				}
+				continue
+			}
+
+			r.mutex.Lock()
+			if r.restore == snapshot {
+				r.restore = nil
+			}
+			if snapshot.index > r.lastApplied {
+				r.lastApplied = snapshot.index
+			}
+			r.mutex.Unlock()
+			continue
+		}
+
+		if r.lastApplied >= r.commitIndex {
+			r.mutex.Unlock()
+			break
+		}
+
+		index := r.lastApplied + 1
+		entry := r.entryAt(index)
+		p := r.proposals[index]
+		r.mutex.Unlock()
+
+		version := protocolV1
+		if p != nil {
+			version = p.version
+		}
+
+		response := "ack"
+		if entry.kind == entryWrite {
+			var err error
+			if response, err = r.apply(entry.data, version); err != nil {
+				log.Println("Failed to apply raft entry", index, "will try again:", err)
+				if !r.waitToRetry(quit) {
+					return
+				}
+				continue
+			}
+		}
+
+		r.mutex.Lock()
+		r.lastApplied = index
+		delete(r.proposals, index)
+		r.mutex.Unlock()
+
+		if p != nil {
+			if p.term != entry.term {
+				// Our entry was replaced by another leader's, so unlike a
+				// timeout it's certain ours never will be applied
+				response = errorResponse(p.version, errEntryReplaced)
+			}
+			p.done <- response
+		}
+	}
+
+	r.snapshot()
+}
+
+// false if quit was closed while waiting
+func (r *raft) waitToRetry(quit <-chan struct{}) bool {
+	timer := time.NewTimer(applyRetryInterval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// Compact the log into a snapshot of the store once enough has been applied
+// since the last one. Only the applier changes the store so it is exactly
+// as of lastApplied.
+func (r *raft) snapshot() {
+	r.mutex.Lock()
+	index := r.lastApplied
+	due := r.options.SnapshotEntries > 0 && index-r.snapshotIndex >= uint64(r.options.SnapshotEntries)
+	r.mutex.Unlock()
+
+	if !due {
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := r.snapshots.Snapshot(&buffer); err != nil {
+		log.Println("Failed to snapshot store:", err)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if index <= r.snapshotIndex {
+		// Installed one from the leader in the meantime
+		return
+	}
+
+	term, _ := r.termAt(index)
+	snapshot := &incomingSnapshot{index: index, term: term, config: r.configAt(index), data: buffer.Bytes()}
+	if err := r.compact(snapshot); err != nil {
+		log.Println("Failed to save raft snapshot:", err)
+		return
+	}
+
+	log.Println("Compacted raft log up to", index)
+}
+
+// Forwarding
+
+// Follower only. Send a write or a member change on to the leader, the
+// response comes back on the channel. Call dropForward once done waiting.
+func (r *raft) forward(op, data string, version int) (uint64, chan string, error) {
+	r.mutex.Lock()
+
+	leader := r.leader
+	if leader == "" || leader == r.self {
+		r.mutex.Unlock()
+		return 0, nil, errNoLeader
+	}
+
+	r.forwardID++
+	id := r.forwardID
+
+	// fwd: from, epoch, id, client's version, op, write or member address
+	msg := command{name: "fwd", args: []string{r.self, r.epoch, formatIndex(id), strconv.Itoa(version), op, data}}.encode()
+	done := make(chan string, 1)
+	r.forwards[id] = &forwarded{leader: leader, msg: msg, done: done}
+	r.mutex.Unlock()
+
+	r.send(leader, msg)
+	return id, done, nil
+}
+
+func (r *raft) dropForward(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.forwards, id)
+}
+
+func (r *raft) handleForwarded(cmd command) {
+	id, ok := parseIndex(cmd.args[1])
+	if !ok || cmd.args[0] != r.epoch {
+		// For a write we sent before a restart
+		return
+	}
+
+	if forward, ok := r.forwards[id]; ok {
+		forward.done <- cmd.args[2]
+		delete(r.forwards, id)
+	}
+}
+
+// Leader side of a fwd, false if we already have it. The answer is sent
+// again if it has one.
+func (r *raft) receiveForward(from, epoch, id string) bool {
+	r.mutex.Lock()
+	key := from + " " + epoch + " " + id
+	forward, ok := r.received[key]
+	var response string
+	if ok {
+		response = forward.response
+	} else {
+		r.received[key] = &receivedForward{at: time.Now()}
+	}
+	r.mutex.Unlock()
+
+	if response != "" {
+		r.send(from, command{name: "fwr", args: []string{epoch, id, response}}.encode())
+	}
+	return !ok
+}
+
+// fwr: epoch, id, response
+func (r *raft) answerForward(from, epoch, id, response string) {
+	r.mutex.Lock()
+	if forward, ok := r.received[from+" "+epoch+" "+id]; ok {
+		forward.response = response
+		forward.at = time.Now()
+	}
+	r.mutex.Unlock()
+
+	r.send(from, command{name: "fwr", args: []string{epoch, id, response}}.encode())
+}
+
+// Members as listed by mem, with the leader marked
+func (r *raft) members() []member {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	members := make([]member, 0, len(r.config))
+	for _, addr := range r.config {
+		state := roleFollower
+		if addr == r.leader {
+			state = roleLeader
+		}
+		members = append(members, member{addr: addr, state: state, incarnation: r.term})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].addr < members[j].addr })
+	return members
+}
+
+// Log helpers, call with the mutex held
+
+func (r *raft) lastIndex() uint64 {
+	return r.snapshotIndex + uint64(len(r.log))
+}
+
+func (r *raft) lastTerm() uint64 {
+	term, _ := r.termAt(r.lastIndex())
+	return term
+}
+
+// Term of the entry at index, false if it's compacted away or past the end
+func (r *raft) termAt(index uint64) (uint64, bool) {
+	if index == r.snapshotIndex {
+		return r.snapshotTerm, true
+	}
+	if index < r.snapshotIndex || index > r.lastIndex() {
+		return 0, false
+	}
+	return r.log[index-r.snapshotIndex-1].term, true
+}
+
+func (r *raft) entryAt(index uint64) logEntry {
+	return r.log[index-r.snapshotIndex-1]
+}
+
+// After the log is cut back, go back to the newest config entry left
+func (r *raft) updateConfig() {
+	for i := len(r.log) - 1; i >= 0; i-- {
+		if r.log[i].kind == entryConfig {
+			r.config = splitConfig(r.log[i].data)
+			r.configIndex = r.snapshotIndex + uint64(i) + 1
+			return
+		}
+	}
+	r.config = r.snapshotConfig
+	r.configIndex = r.snapshotIndex
+}
+
+// Members as of index, for a snapshot taken there
+func (r *raft) configAt(index uint64) []string {
+	for i := index - r.snapshotIndex; i > 0; i-- {
+		if r.log[i-1].kind == entryConfig {
+			return splitConfig(r.log[i-1].data)
+		}
+	}
+	return r.snapshotConfig
+}
+
+func (r *raft) isMember(addr string) bool {
+	for _, member := range r.config {
+		if member == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Every member but us
+func (r *raft) peers() []string {
+	var peers []string
+	for _, member := range r.config {
+		if member != r.self {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+func (r *raft) hasQuorum(votes map[string]bool) bool {
+	count := 0
+	for _, member := range r.config {
+		if votes[member] {
+			count++
+		}
+	}
+	return count > len(r.config)/2
+}
+
+// Votes don't count unless they're on disk first
+func (r *raft) saveState() bool {
+	if err := r.storage.saveState(raftState{Term: r.term, Vote: r.votedFor}); err != nil {
+		log.Println("Failed to save raft state:", err)
+		return false
+	}
+	return true
+}
+
+// Entries in an aen, each as its term, kind and data
+func decodeEntries(arg string) ([]logEntry, error) {
+	d := newDecoder(strings.NewReader(arg), nil, len(arg))
+
+	var entries []logEntry
+	for {
+		termArg, err := d.readArg()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		kind, err := d.readArg()
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.readArg()
+		if err != nil {
+			return nil, err
+		}
+
+		term, ok := parseIndex(termArg)
+		if !ok || (kind != entryWrite && kind != entryConfig && kind != entryNoop) {
+			return nil, errInvalidArg
+		}
+		entries = append(entries, logEntry{term: term, kind: kind, data: data})
+	}
+}
+
+func splitConfig(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func formatIndex(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func parseIndex(s string) (uint64, bool) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	return n, err == nil
+}
+
+func parseIndexes2(a, b string) (uint64, uint64, bool) {
+	x, okA := parseIndex(a)
+	y, okB := parseIndex(b)
+	return x, y, okA && okB
+}
+
+func parseIndexes(a, b, c string) (uint64, uint64, uint64, bool) {
+	x, y, ok := parseIndexes2(a, b)
+	z, okC := parseIndex(c)
+	return x, y, z, ok && okC
+}
+
+func parseIndexes4(a, b, c, d string) (uint64, uint64, uint64, uint64, bool) {
+	x, y, z, ok := parseIndexes(a, b, c)
+	w, okD := parseIndex(d)
+	return x, y, z, w, ok && okD
+}
+
+func minIndex(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
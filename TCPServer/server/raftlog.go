@@ -0,0 +1,321 @@
+package dataServer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	raftStateFile    = "raft.state"
+	raftSnapshotFile = "raft.snapshot"
+	raftLogFile      = "raft.log"
+
+	// Length and checksum in front of every log record
+	raftRecordHeaderSize = 8
+
+	// Index, term and kind at the start of every record's payload
+	raftRecordFixedSize = 17
+)
+
+var errBadRaftRecord = errors.New("Bad raft log record")
+
+// Term and vote, rewritten in full whenever either changes
+type raftState struct {
+	Term uint64
+	Vote string
+}
+
+// The store as of Index, along with the members at that point
+type raftSnapshot struct {
+	Index  uint64
+	Term   uint64
+	Config []string
+	Data   []byte
+}
+
+// Everything read back by openRaftStorage
+type raftSaved struct {
+	state    raftState
+	snapshot *raftSnapshot // nil if one was never taken
+	entries  []logEntry    // after the snapshot
+}
+
+// Keeps what a raft node needs to survive a restart in dir. The log is
+// append only, a record for an entry at an index replaces that entry and
+// everything after it, so a follower cutting back its log is just another
+// append. It is rewritten with only the entries after the snapshot each time
+// one is taken. Nothing is written if dir is empty.
+type raftStorage struct {
+	dir  string
+	file *os.File
+}
+
+func openRaftStorage(dir string) (*raftStorage, raftSaved, error) {
+	storage := &raftStorage{dir: dir}
+	var saved raftSaved
+
+	if dir == "" {
+		return storage, saved, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, saved, err
+	}
+
+	if err := readGob(filepath.Join(dir, raftStateFile), &saved.state); err != nil && !os.IsNotExist(err) {
+		return nil, saved, err
+	}
+
+	var snapshot raftSnapshot
+	err := readGob(filepath.Join(dir, raftSnapshotFile), &snapshot)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, saved, err
+	}
+	if err == nil {
+		saved.snapshot = &snapshot
+	}
+
+	entries, err := replayRaftLog(filepath.Join(dir, raftLogFile), snapshot.Index)
+	if err != nil {
+		return nil, saved, err
+	}
+	saved.entries = entries
+
+	storage.file, err = os.OpenFile(filepath.Join(dir, raftLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, saved, err
+	}
+
+	return storage, saved, nil
+}
+
+func (s *raftStorage) saveState(state raftState) error {
+	if s.dir == "" {
+		return nil
+	}
+	return writeGob(filepath.Join(s.dir, raftStateFile), state)
+}
+
+// Write entries starting at index, dropping anything already logged from
+// index on. They are on disk by the time this returns.
+func (s *raftStorage) append(index uint64, entries []logEntry) error {
+	if s.dir == "" || len(entries) == 0 {
+		return nil
+	}
+
+	var buffer []byte
+	for i, entry := range entries {
+		buffer = append(buffer, encodeRaftRecord(index+uint64(i), entry)...)
+	}
+
+	if _, err := s.file.Write(buffer); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Save a snapshot and start the log again with the entries that follow it.
+// The snapshot goes first so a crash in between only leaves entries it
+// already covers in the log, and those are skipped on replay.
+func (s *raftStorage) saveSnapshot(snapshot raftSnapshot, entries []logEntry) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	if err := writeGob(filepath.Join(s.dir, raftSnapshotFile), snapshot); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, raftLogFile)
+	temp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	var buffer []byte
+	for i, entry := range entries {
+		buffer = append(buffer, encodeRaftRecord(snapshot.Index+1+uint64(i), entry)...)
+	}
+
+	if _, err := temp.Write(buffer); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// Carry on appending to the new file
+	s.file.Close()
+	s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (s *raftStorage) close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// Record layout: 4 byte payload length, 4 byte CRC32 of the payload, then the
+// payload which is the 8 byte index, the 8 byte term, the kind and the data.
+func encodeRaftRecord(index uint64, entry logEntry) []byte {
+	payload := make([]byte, raftRecordFixedSize, raftRecordFixedSize+len(entry.data))
+	binary.LittleEndian.PutUint64(payload[0:8], index)
+	binary.LittleEndian.PutUint64(payload[8:16], entry.term)
+	payload[16] = entry.kind[0]
+	payload = append(payload, entry.data...)
+
+	buffer := make([]byte, raftRecordHeaderSize, raftRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buffer[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buffer[4:8], crc32.ChecksumIEEE(payload))
+
+	return append(buffer, payload...)
+}
+
+func decodeRaftRecord(payload []byte) (uint64, logEntry, error) {
+	if len(payload) < raftRecordFixedSize {
+		return 0, logEntry{}, errBadRaftRecord
+	}
+
+	index := binary.LittleEndian.Uint64(payload[0:8])
+	entry := logEntry{
+		term: binary.LittleEndian.Uint64(payload[8:16]),
+		kind: string(payload[16:17]),
+		data: string(payload[raftRecordFixedSize:]),
+	}
+
+	switch entry.kind {
+	case entryWrite, entryConfig, entryNoop:
+		return index, entry, nil
+	}
+	return 0, logEntry{}, errBadRaftRecord
+}
+
+// The entries after snapshotIndex in the log at path. Like the store's write
+// ahead log, a torn or corrupt record means we crashed part way through
+// writing it, so the log is cut back to the last good record.
+func replayRaftLog(path string, snapshotIndex uint64) ([]logEntry, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []logEntry
+	reader := bufio.NewReader(file)
+	header := make([]byte, raftRecordHeaderSize)
+	var good int64
+
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+
+		if int64(length) > info.Size()-good-raftRecordHeaderSize {
+			break
+		}
+
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		index, entry, err := decodeRaftRecord(payload)
+		if err != nil || index > snapshotIndex+uint64(len(entries))+1 {
+			// Can't follow on from what we have
+			break
+		}
+
+		good += raftRecordHeaderSize + int64(length)
+
+		if index <= snapshotIndex {
+			// Covered by the snapshot, we crashed before the log was rewritten
+			continue
+		}
+
+		entries = append(entries[:index-snapshotIndex-1], entry)
+	}
+
+	log.Println("Raft log", path, "is damaged after", good, "bytes, cutting it back")
+	if err := file.Truncate(good); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Replace the file at path with value, written to the side first so a crash
+// leaves either the old one or the new one
+func writeGob(path string, value interface{}) error {
+	temp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(temp).Encode(value); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func readGob(path string, value interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return gob.NewDecoder(file).Decode(value)
+}
@@ -0,0 +1,224 @@
+package dataServer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Emanuel-Nunes/Go-TCPServer/store"
+)
+
+// Stores that can say what they do once they are full
+type memoryLimited interface {
+	MemoryLimit() store.MemoryLimit
+}
+
+// Replicate writes through a raft log rather than sending them straight to
+// peers. The peers given to SetPeers are the members to start with unless
+// options.Join is set. Writes have to fit in one append, bigger ones get a
+// too_large err. A store with a memory limit has to reject writes rather
+// than evict, each node would evict different keys. Call before
+// InitClusterListener.
+func (ds *DataServer) EnableRaft(options RaftOptions) error {
+	if options.HeartbeatInterval <= 0 || options.ElectionTimeout <= 0 || options.CommitTimeout <= 0 {
+		return errors.New("raft heartbeat interval, election timeout and commit timeout must be set")
+	}
+
+	snapshots, ok := ds.store.(snapshotter)
+	if !ok {
+		return errors.New("raft needs a store that can be snapshotted")
+	}
+
+	if limited, ok := ds.store.(memoryLimited); ok {
+		if limit := limited.MemoryLimit(); limit.MaxMemory > 0 && limit.Policy != store.EvictReject {
+			return errors.New("raft needs the reject eviction policy when there is a memory limit")
+		}
+	}
+
+	var members []string
+	if !options.Join {
+		members = append([]string{ds.self}, ds.peers...)
+	}
+
+	r := newRaft(ds.self, options, ds.sendTo, ds.applyLogEntry, snapshots)
+	if err := r.open(members); err != nil {
+		return err
+	}
+
+	ds.raft = r
+	return nil
+}
+
+// Put a client write through the raft log and wait for it to be applied.
+// Followers send it on to the leader.
+func (ds *DataServer) propose(version int, cmd command) string {
+	if cmd.name == "pex" {
+		// Every node applies it at a different time, so they get the
+		// absolute expiry like with replication
+		ttl, _ := strconv.ParseInt(cmd.args[2], 10, 64)
+		expiry := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		cmd = command{name: "pxa", args: []string{cmd.args[0], cmd.args[1], strconv.FormatInt(expiry.UnixMilli(), 10)}}
+	}
+
+	done, err := ds.raft.propose(cmd.encode(), version)
+	if err == errNotLeader {
+		return ds.forwardToLeader(version, forwardWrite, cmd.encode())
+	}
+	if err != nil {
+		return errorResponse(version, err)
+	}
+
+	return ds.awaitCommit(version, done)
+}
+
+// Add or remove a raft member, on the leader
+func (ds *DataServer) changeMembers(version int, add bool, addr string) string {
+	if ds.raft == nil {
+		return errorResponse(version, errNotRaft)
+	}
+
+	done, err := ds.raft.changeMembers(add, addr, version)
+	if err == errNotLeader {
+		op := forwardRemove
+		if add {
+			op = forwardAdd
+		}
+		return ds.forwardToLeader(version, op, addr)
+	}
+	if err != nil {
+		return errorResponse(version, err)
+	}
+
+	return ds.awaitCommit(version, done)
+}
+
+func (ds *DataServer) forwardToLeader(version int, op, data string) string {
+	id, done, err := ds.raft.forward(op, data, version)
+	if err != nil {
+		return errorResponse(version, err)
+	}
+	defer ds.raft.dropForward(id)
+
+	return ds.awaitCommit(version, done)
+}
+
+// The response to a proposal, or an err if it takes longer than the commit
+// timeout. It may still be applied after that.
+func (ds *DataServer) awaitCommit(version int, done chan string) string {
+	timer := time.NewTimer(ds.raft.options.CommitTimeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-done:
+		return response
+	case <-timer.C:
+	case <-ds.ctx.Done():
+	}
+	return errorResponse(version, errNotCommitted)
+}
+
+// A write or member change a follower sent on to us. Runs on its own
+// goroutine, it waits for the entry to be applied.
+func (ds *DataServer) handleForward(cmd command) {
+	from, epoch, id, op, data := cmd.args[0], cmd.args[1], cmd.args[2], cmd.args[4], cmd.args[5]
+
+	if !ds.raft.receiveForward(from, epoch, id) {
+		// Sent again, it's already been proposed
+		return
+	}
+
+	version, err := strconv.Atoi(cmd.args[3])
+	if err != nil || version < protocolV1 || version > maxProtocolVersion {
+		version = protocolV1
+	}
+
+	var done chan string
+	switch op {
+	case forwardWrite:
+		done, err = ds.raft.propose(data, version)
+	case forwardAdd, forwardRemove:
+		done, err = ds.raft.changeMembers(op == forwardAdd, data, version)
+	default:
+		err = errInvalidArg
+	}
+
+	response := ""
+	switch {
+	case err == errNotLeader:
+		// Leadership moved on since the follower heard from us
+		response = errorResponse(version, errNoLeader)
+	case err != nil:
+		response = errorResponse(version, err)
+	default:
+		response = ds.awaitCommit(version, done)
+	}
+
+	ds.raft.answerForward(from, epoch, id, response)
+}
+
+// Apply a committed raft entry to the store, the response goes to the
+// client that proposed it if it's waiting on this node. Every node has to
+// apply every entry, so there's no deadline, and an error means the store
+// failed and the entry hasn't been applied.
+func (ds *DataServer) applyLogEntry(data string, version int) (string, error) {
+	cmd, err := newDecoder(strings.NewReader(data), logCommandArgs, ds.maxClusterMessage()).next()
+	if err != nil {
+		// Would be just as bad on every node
+		log.Println("Bad raft entry:", err)
+		return errorResponse(version, err), nil
+	}
+
+	response, err := ds.applyLogCommand(context.Background(), version, cmd)
+	if errors.Is(err, store.ErrOutOfMemory) && ds.rejectsWhenFull() {
+		// Every node has the same keys and, not evicting, the same memory
+		// used, so they all turn it down
+		err = nil
+	}
+	return response, err
+}
+
+// True if the store has a memory limit and fails writes that would go over
+// it rather than evicting
+func (ds *DataServer) rejectsWhenFull() bool {
+	limited, ok := ds.store.(memoryLimited)
+	if !ok {
+		return false
+	}
+	limit := limited.MemoryLimit()
+	return limit.MaxMemory > 0 && limit.Policy == store.EvictReject
+}
+
+func (ds *DataServer) applyLogCommand(ctx context.Context, version int, cmd command) (string, error) {
+	switch cmd.name {
+	case "put":
+		return ds.put(ctx, version, cmd.args[0], cmd.args[1])
+	case "del":
+		return ds.delete(ctx, version, cmd.args[0])
+	case "pxa":
+		expiry, err := strconv.ParseInt(cmd.args[2], 10, 64)
+		if err != nil {
+			return errorResponse(version, errBadTTL), nil
+		}
+		return ds.putWithExpiry(ctx, version, cmd.args[0], cmd.args[1], time.UnixMilli(expiry))
+	case "per":
+		return ds.persist(ctx, version, cmd.args[0])
+	case "cas", "pnx", "pxx":
+		return ds.conditionalPut(ctx, version, cmd)
+	case "inc", "dec":
+		delta, _ := strconv.ParseInt(cmd.args[1], 10, 64)
+		if cmd.name == "dec" {
+			delta = -delta
+		}
+		response, _, _, err := ds.increment(ctx, version, cmd.args[0], delta)
+		return response, err
+	case "mpt":
+		return ds.putMany(ctx, version, cmd.args[1:])
+	case "mdl":
+		return ds.deleteMany(ctx, version, cmd.args[1:])
+	}
+
+	return errorResponse(version, errUnknownCommand), nil
+}
@@ -0,0 +1,386 @@
+package dataServer
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How often writes a peer hasn't acked are sent again
+	retransmitInterval = 200 * time.Millisecond
+
+	// Most unacked writes resent to one peer each interval, oldest first
+	maxRetransmit = 64
+
+	// Unacked writes kept for a peer, past this the oldest are given up on
+	// and the peer needs a resync
+	maxPendingWrites = 10000
+)
+
+// Writes sent to one peer that it hasn't acked yet
+type outStream struct {
+	next    uint64 // seq of the next write
+	pending []pendingWrite
+
+	// Set once we give up on a write before it's acked. The peer can't go
+	// past dropped until a resync has sent it the current value of every
+	// key in stale.
+	dropped     uint64 // oldest seq given up on, 0 if none
+	lastDropped uint64 // newest, so a resync knows if more went meanwhile
+	stale       map[string]bool
+}
+
+type pendingWrite struct {
+	seq  uint64
+	msg  string
+	keys []string // written by msg
+	acks *replicaAcks
+}
+
+// Peers that have applied one write, for callers that want to wait for them
+type replicaAcks struct {
+	peers int           // sent to
+	acks  chan struct{} // one for each peer that has applied it
+}
+
+// Wait for needed peers to apply the write, false if ctx is done first or
+// there aren't that many to ask
+func (a *replicaAcks) wait(ctx context.Context, needed int) bool {
+	if needed > a.peers {
+		return false
+	}
+
+	for i := 0; i < needed; i++ {
+		select {
+		case <-a.acks:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// Where we have got to with one origin's writes
+type inStream struct {
+	epoch    string
+	applied  uint64            // every seq up to here has been applied
+	buffered map[uint64]string // arrived ahead of a missing one
+}
+
+// Delivers replicated writes to each peer exactly once and in order over a
+// transport that can lose, duplicate and reorder datagrams.
+//
+// Each origin numbers the writes it sends to a peer from 1, along with an
+// epoch that changes when the origin restarts. The peer applies them in seq
+// order, holding back any that arrive early and dropping any it has already
+// applied, and acks the highest seq it has applied so far. Anything unacked is
+// sent again every retransmitInterval, however long the peer is down for.
+// Every write also carries the oldest seq still pending, so a peer that
+// restarted catches up from there rather than waiting for writes it already
+// had.
+//
+// If a peer falls maxPending writes behind the oldest are dropped, but the
+// seq it carries stays at the first one dropped so the peer waits rather than
+// skipping them. Once the peer is live again resync sends it the current value
+// of every key those writes touched, and after that it can skip ahead.
+type replicator struct {
+	self       string
+	epoch      string
+	send       func(addr, msg string)
+	apply      func(msg string) error // error if the write couldn't be applied just now
+	resync     func(peer string, keys []string) error
+	interval   time.Duration
+	maxPending int
+
+	outMutex sync.Mutex
+	out      map[string]*outStream // by peer
+
+	// Only used from the cluster listener goroutine so it isn't locked
+	in map[string]*inStream // by origin
+}
+
+func newReplicator(self string, send func(addr, msg string), apply func(msg string) error) *replicator {
+	return &replicator{
+		self:       self,
+		epoch:      strconv.FormatInt(time.Now().UnixNano(), 10),
+		send:       send,
+		apply:      apply,
+		interval:   retransmitInterval,
+		maxPending: maxPendingWrites,
+		out:        make(map[string]*outStream),
+		in:         make(map[string]*inStream),
+	}
+}
+
+// Send msg, a write to keys, to each of peers
+func (r *replicator) replicate(peers []string, msg string, keys []string) *replicaAcks {
+	acks := &replicaAcks{peers: len(peers), acks: make(chan struct{}, len(peers))}
+
+	r.outMutex.Lock()
+	var writes []outgoing
+	for _, peer := range peers {
+		stream, ok := r.out[peer]
+		if !ok {
+			stream = &outStream{next: 1}
+			r.out[peer] = stream
+		}
+
+		if len(stream.pending) >= r.maxPending {
+			log.Println("Too many unacked writes for", peer, "giving up on the oldest, it needs a resync")
+			stream.drop()
+		}
+
+		writes = append(writes, outgoing{peer, r.queue(stream, msg, keys, acks)})
+	}
+	r.outMutex.Unlock()
+
+	for _, write := range writes {
+		r.send(write.addr, write.msg)
+	}
+
+	return acks
+}
+
+// Send peer a write from a resync. It doesn't count towards maxPending, or a
+// peer a long way behind would never get all of its resync.
+func (r *replicator) repair(peer, msg string, keys []string) {
+	acks := &replicaAcks{peers: 1, acks: make(chan struct{}, 1)}
+
+	r.outMutex.Lock()
+	out := r.queue(r.out[peer], msg, keys, acks)
+	r.outMutex.Unlock()
+
+	r.send(peer, out)
+}
+
+// Add a write to the end of stream, the message to send for it
+func (r *replicator) queue(stream *outStream, msg string, keys []string, acks *replicaAcks) string {
+	write := pendingWrite{seq: stream.next, msg: msg, keys: keys, acks: acks}
+	stream.next++
+	stream.pending = append(stream.pending, write)
+	return r.message(stream, write)
+}
+
+// Give up on the oldest pending write, remembering its keys for a resync
+func (stream *outStream) drop() {
+	write := stream.pending[0]
+	stream.pending = stream.pending[1:]
+
+	if stream.dropped == 0 {
+		stream.dropped = write.seq
+		stream.stale = make(map[string]bool)
+	}
+	stream.lastDropped = write.seq
+	for _, key := range write.keys {
+		stream.stale[key] = true
+	}
+}
+
+// Resend unacked writes every interval until quit is closed. live says which
+// peers are worth sending to now, the rest keep theirs until they're back.
+func (r *replicator) run(live func() []string, quit <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			r.retransmit(live())
+		}
+	}
+}
+
+func (r *replicator) retransmit(live []string) {
+	alive := make(map[string]bool, len(live))
+	for _, peer := range live {
+		alive[peer] = true
+	}
+
+	r.outMutex.Lock()
+	var writes []outgoing
+	var resyncs []resyncJob
+	for peer, stream := range r.out {
+		if !alive[peer] {
+			continue
+		}
+
+		if stream.dropped != 0 {
+			job := resyncJob{peer: peer, lastDropped: stream.lastDropped}
+			for key := range stream.stale {
+				job.keys = append(job.keys, key)
+			}
+			stream.stale = make(map[string]bool)
+			resyncs = append(resyncs, job)
+		}
+
+		for i := 0; i < len(stream.pending) && i < maxRetransmit; i++ {
+			writes = append(writes, outgoing{peer, r.message(stream, stream.pending[i])})
+		}
+	}
+	r.outMutex.Unlock()
+
+	for _, write := range writes {
+		r.send(write.addr, write.msg)
+	}
+
+	// Outside outMutex, resync takes the key locks and then replicates
+	for _, job := range resyncs {
+		var err error
+		if r.resync != nil {
+			err = r.resync(job.peer, job.keys)
+		}
+		r.resynced(job, err)
+	}
+}
+
+// Keys a peer missed writes to, and the newest of those writes
+type resyncJob struct {
+	peer        string
+	keys        []string
+	lastDropped uint64
+}
+
+// The peer can skip what it missed once it has been sent the current values.
+// Anything dropped while that was going on needs another.
+func (r *replicator) resynced(job resyncJob, err error) {
+	r.outMutex.Lock()
+	defer r.outMutex.Unlock()
+
+	stream := r.out[job.peer]
+	if err != nil {
+		log.Println("Failed to resync", job.peer, err)
+		for _, key := range job.keys {
+			stream.stale[key] = true
+		}
+		return
+	}
+
+	if stream.lastDropped == job.lastDropped {
+		stream.dropped = 0
+		stream.lastDropped = 0
+		stream.stale = nil
+		return
+	}
+
+	// Dropped writes are always the oldest, so the newer ones follow on
+	stream.dropped = job.lastDropped + 1
+}
+
+// rep: origin, epoch, seq, oldest pending seq, the write
+func (r *replicator) message(stream *outStream, write pendingWrite) string {
+	base := write.seq
+	if stream.dropped != 0 {
+		base = stream.dropped
+	} else if len(stream.pending) > 0 {
+		base = stream.pending[0].seq
+	}
+
+	return command{name: "rep", args: []string{
+		r.self,
+		r.epoch,
+		strconv.FormatUint(write.seq, 10),
+		strconv.FormatUint(base, 10),
+		write.msg,
+	}}.encode()
+}
+
+// A write from another node. Applies it and anything held back behind it,
+// then acks.
+func (r *replicator) receive(cmd command) {
+	origin, epoch := cmd.args[0], cmd.args[1]
+
+	seq, err := strconv.ParseUint(cmd.args[2], 10, 64)
+	if err != nil || seq == 0 {
+		log.Println("Bad replicated write seq:", cmd.args[2])
+		return
+	}
+	base, err := strconv.ParseUint(cmd.args[3], 10, 64)
+	if err != nil || base == 0 || base > seq {
+		log.Println("Bad replicated write base:", cmd.args[3])
+		return
+	}
+
+	stream, ok := r.in[origin]
+	if !ok || stream.epoch != epoch {
+		// New to us or the origin restarted, either way start from its oldest
+		stream = &inStream{epoch: epoch, applied: base - 1, buffered: make(map[uint64]string)}
+		r.in[origin] = stream
+	}
+
+	if base-1 > stream.applied {
+		// The origin dropped writes we're missing and has since resynced
+		// us on the keys they touched
+		log.Println("Skipping writes", stream.applied+1, "to", base-1, "from", origin)
+		for s := range stream.buffered {
+			if s < base {
+				delete(stream.buffered, s)
+			}
+		}
+		stream.applied = base - 1
+	}
+
+	if seq > stream.applied {
+		stream.buffered[seq] = cmd.args[4]
+	}
+
+	for {
+		msg, ok := stream.buffered[stream.applied+1]
+		if !ok {
+			break
+		}
+
+		// Left buffered and unacked, it's tried again when the origin
+		// sends something next
+		if err := r.apply(msg); err != nil {
+			log.Println("Failed to apply replicated write", stream.applied+1, "from", origin, err)
+			break
+		}
+		delete(stream.buffered, stream.applied+1)
+		stream.applied++
+	}
+
+	r.send(origin, command{name: "rak", args: []string{r.self, epoch, strconv.FormatUint(stream.applied, 10)}}.encode())
+}
+
+// A peer has applied everything we sent it up to a seq
+func (r *replicator) acked(cmd command) {
+	from, epoch := cmd.args[0], cmd.args[1]
+
+	applied, err := strconv.ParseUint(cmd.args[2], 10, 64)
+	if err != nil || epoch != r.epoch {
+		// For writes we sent before a restart
+		return
+	}
+
+	r.outMutex.Lock()
+	defer r.outMutex.Unlock()
+
+	stream, ok := r.out[from]
+	if !ok {
+		return
+	}
+
+	acked := 0
+	for acked < len(stream.pending) && stream.pending[acked].seq <= applied {
+		// Room for one from each peer so this never blocks
+		stream.pending[acked].acks.acks <- struct{}{}
+		acked++
+	}
+	stream.pending = stream.pending[acked:]
+}
+
+// Unacked writes for peer, for tests and monitoring
+func (r *replicator) pending(peer string) int {
+	r.outMutex.Lock()
+	defer r.outMutex.Unlock()
+
+	if stream, ok := r.out[peer]; ok {
+		return len(stream.pending)
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package dataServer
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net"
+	"time"
+)
+
+// How long the sdn command gives connections to drain
+const defaultShutdownTimeout = 10 * time.Second
+
+// Admin token required by the "sdn" command, shutdown over the wire is
+// disabled while it is empty
+func (ds *DataServer) SetAdminToken(token string) {
+	ds.adminToken = token
+}
+
+func (ds *DataServer) validAdminToken(token string) bool {
+	if ds.adminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ds.adminToken)) == 1
+}
+
+// Keep track of client connections so shutdown can wait for them
+func (ds *DataServer) trackConn(c net.Conn) bool {
+	ds.connsMutex.Lock()
+	defer ds.connsMutex.Unlock()
+
+	if ds.closing() {
+		return false
+	}
+
+	ds.conns[c] = struct{}{}
+	ds.connsWait.Add(1)
+	return true
+}
+
+func (ds *DataServer) untrackConn(c net.Conn) {
+	ds.connsMutex.Lock()
+	defer ds.connsMutex.Unlock()
+
+	delete(ds.conns, c)
+	ds.connsWait.Done()
+}
+
+func (ds *DataServer) closing() bool {
+	select {
+	case <-ds.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop accepting clients, let every connection finish the command it is
+// working on, then stop the store. Connections still busy when ctx expires are
+// cut off. Only the first call does anything, later ones wait for it to finish.
+func (ds *DataServer) Shutdown(ctx context.Context) error {
+	ds.connsMutex.Lock()
+	if ds.closing() {
+		ds.connsMutex.Unlock()
+		<-ds.done
+		return nil
+	}
+	close(ds.quit)
+
+	log.Println("Shutting down")
+
+	if ds.tcpOn {
+		ds.tcpListener.Close()
+	}
+	if ds.transport != nil {
+		ds.transport.Close()
+	}
+
+	// Wake up handlers blocked waiting on the client, anything they have
+	// already read is still processed before the read fails
+	for c := range ds.conns {
+		c.SetReadDeadline(time.Now())
+	}
+	ds.connsMutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		ds.connsWait.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.Println("Shutdown deadline passed, closing remaining connections")
+
+		// Handlers stuck waiting on the store give up too
+		ds.cancel()
+
+		ds.connsMutex.Lock()
+		for c := range ds.conns {
+			c.Close()
+		}
+		ds.connsMutex.Unlock()
+
+		<-drained
+	}
+
+	// Committed raft entries are applied on their own goroutine
+	if ds.raft != nil {
+		ds.raft.stop()
+	}
+
+	// Handlers are all gone so nothing else can reach the store, closing it
+	// writes out anything it persists
+	if storeErr := ds.store.Close(); err == nil {
+		err = storeErr
+	}
+
+	ds.cancel()
+
+	log.Println("Shutdown complete")
+	close(ds.done)
+	return err
+}
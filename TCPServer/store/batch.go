@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+)
+
+// A key and the value to give it in PutMany
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Values for the keys that exist, missing and expired keys are left out
+func (ds *DataStore) GetMany(ctx context.Context, keys []string) (map[string]string, error) {
+	release, err := ds.pauseShards(ctx, ds.shardsFor(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		contents := ds.shardFor(key).get(key)
+		if contents.Err == nil {
+			values[key] = contents.Value
+		}
+	}
+
+	return values, nil
+}
+
+// Write every entry or, if they can't all be made room for, none of them. A
+// later entry for the same key wins. The batch is logged as one record, so
+// after a crash it comes back whole or not at all.
+func (ds *DataStore) PutMany(ctx context.Context, entries []KeyValue) error {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+
+	// Under a memory limit the batch may need room from any shard
+	shards := ds.shardsFor(keys)
+	if ds.memory.limited() {
+		shards = ds.shards
+	}
+
+	release, err := ds.pauseShards(ctx, shards)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Only the last value for a key ends up stored
+	final := make(map[string]string, len(entries))
+	var records []logRecord
+	for _, entry := range entries {
+		if _, seen := final[entry.Key]; !seen {
+			records = append(records, logRecord{op: opPut, key: entry.Key})
+		}
+		final[entry.Key] = entry.Value
+	}
+	for i := range records {
+		records[i].value = final[records[i].key]
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := ds.makeRoomForBatch(shards, final); err != nil {
+		return err
+	}
+
+	// Nothing is applied until all of it is in the log, so there's nothing
+	// to undo if that fails
+	if err := shards[0].appendLog(logRecord{op: opBatch, batch: records}); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		ds.shardFor(record.key).apply(record)
+	}
+
+	for _, sh := range shards {
+		sh.compactLog()
+	}
+
+	return nil
+}
+
+// Delete the keys that exist, returning how many that was
+func (ds *DataStore) DeleteMany(ctx context.Context, keys []string) (int, error) {
+	release, err := ds.pauseShards(ctx, ds.shardsFor(keys))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	deleted := 0
+	for _, key := range keys {
+		sh := ds.shardFor(key)
+
+		err := sh.delete(key)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted++
+		sh.compactLog()
+	}
+
+	return deleted, nil
+}
+
+// The shards owning keys, each once and in index order
+func (ds *DataStore) shardsFor(keys []string) []*shard {
+	used := make([]bool, len(ds.shards))
+	for _, key := range keys {
+		used[ds.shardIndex(key)] = true
+	}
+
+	var shards []*shard
+	for i, sh := range ds.shards {
+		if used[i] {
+			shards = append(shards, sh)
+		}
+	}
+	return shards
+}
+
+// Like pauseAll for just the given shards, giving up once ctx is done. They
+// are paused in index order, as pauseAll does, so two callers can't each be
+// holding a shard the other is waiting for.
+func (ds *DataStore) pauseShards(ctx context.Context, shards []*shard) (func(), error) {
+	release := make(chan struct{})
+
+	for _, sh := range shards {
+		responseChannel := make(chan interface{}, 1)
+
+		select {
+		case sh.pauseChannel <- newStoreMessage(responseChannel, release):
+		case <-ctx.Done():
+			close(release)
+			return nil, ctx.Err()
+		}
+
+		// A shard that has taken the message waits on release, closing it
+		// lets the shard go even if it hasn't answered yet
+		select {
+		case <-responseChannel:
+		case <-ctx.Done():
+			close(release)
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		close(release)
+	}, nil
+}
+
+// Make room for a whole batch before any of it is written. Under an evicting
+// policy other keys make way, but never ones the batch itself writes, so only
+// a batch bigger than the whole limit is refused. Only call with shards, every
+// shard under a limit, paused.
+func (ds *DataStore) makeRoomForBatch(shards []*shard, batch map[string]string) error {
+	first := shards[0]
+	if first.limit.MaxMemory <= 0 {
+		return nil
+	}
+
+	batchSize := int64(0)
+	change := int64(0)
+	for key, value := range batch {
+		size := entrySize(key, value)
+		batchSize += size
+		change += size
+
+		if old, exists := ds.shardFor(key).data[key]; exists {
+			change -= entrySize(key, old)
+		}
+	}
+
+	if batchSize > first.limit.MaxMemory || (first.evictor == nil && first.memory.total()+change > first.limit.MaxMemory) {
+		first.rejections++
+		return ErrOutOfMemory
+	}
+
+	if first.evictor == nil {
+		return nil
+	}
+
+	// Out of the evictors while victims are picked. Keys that already exist
+	// go back after, new ones are added as they're written.
+	for key := range batch {
+		ds.shardFor(key).evictor.remove(key)
+	}
+	defer func() {
+		for key := range batch {
+			sh := ds.shardFor(key)
+			if _, exists := sh.data[key]; exists {
+				sh.evictor.add(key)
+			}
+		}
+	}()
+
+	for first.memory.total()+change > first.limit.MaxMemory {
+		// From the shard using the most memory that has something to give
+		var from *shard
+		var victim string
+		for _, sh := range shards {
+			if key, ok := sh.evictor.victim(); ok && (from == nil || sh.usedMemory > from.usedMemory) {
+				from, victim = sh, key
+			}
+		}
+
+		if from == nil {
+			first.rejections++
+			return ErrOutOfMemory
+		}
+		if err := from.evict(victim); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
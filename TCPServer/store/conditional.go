@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// A conditional put found the key in the wrong state and wrote nothing
+var ErrConditionFailed = errors.New("Condition not met")
+
+// When a conditional put is allowed to go ahead
+type putCondition int
+
+const (
+	ifAbsent putCondition = iota // no live value for the key
+	ifExists                     // some live value for the key
+	ifEquals                     // the live value is Expected
+)
+
+// Data for a put that depends on what is already stored. The check and the
+// write happen in one go on the shard's monitor, so nothing can slip in
+// between them.
+type conditionalEntry struct {
+	Key       string
+	Value     string
+	Condition putCondition
+	Expected  string
+}
+
+// Set key to value only if it currently holds expected
+func (ds *DataStore) CompareAndSwap(ctx context.Context, key, expected, value string) error {
+	return ds.put(ctx, key, conditionalEntry{Key: key, Value: value, Condition: ifEquals, Expected: expected})
+}
+
+// Put key only if it doesn't exist yet
+func (ds *DataStore) PutIfAbsent(ctx context.Context, key, value string) error {
+	return ds.put(ctx, key, conditionalEntry{Key: key, Value: value, Condition: ifAbsent})
+}
+
+// Put key only if it already exists
+func (ds *DataStore) PutIfExists(ctx context.Context, key, value string) error {
+	return ds.put(ctx, key, conditionalEntry{Key: key, Value: value, Condition: ifExists})
+}
+
+// An expired key counts as absent
+func (sh *shard) conditionHolds(entry conditionalEntry) bool {
+	value, exists := sh.data[entry.Key]
+	if exists && sh.expired(entry.Key) {
+		exists = false
+	}
+
+	switch entry.Condition {
+	case ifAbsent:
+		return !exists
+	case ifExists:
+		return exists
+	case ifEquals:
+		return exists && value == entry.Expected
+	}
+
+	return false
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrNotInteger = errors.New("Value is not an integer")
+	ErrOverflow   = errors.New("Increment would overflow")
+)
+
+// Data for an increment, Delta is negative to decrement
+type incrementEntry struct {
+	Key   string
+	Delta int64
+}
+
+// Response to an increment request
+type incrementContents struct {
+	Value  int64
+	Expiry time.Time
+	Err    error
+}
+
+// Add delta to the 64 bit integer stored at key and return the result. A
+// missing key starts from 0. The key keeps its expiry, which comes back too
+// (zero if it has none) so the new value can be passed on with it.
+func (ds *DataStore) Increment(ctx context.Context, key string, delta int64) (int64, time.Time, error) {
+	entry := incrementEntry{Key: key, Delta: delta}
+	result, err := request(ctx, ds.shardFor(key).incrementChannel, entry)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	contents := result.(incrementContents)
+	if contents.Err == errNeedRoom {
+		err := ds.withRoom(ctx, key, func(sh *shard) error {
+			contents = sh.increment(entry)
+			return nil
+		})
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+
+	return contents.Value, contents.Expiry, contents.Err
+}
+
+func (sh *shard) increment(data interface{}) incrementContents {
+
+	entry, ok := data.(incrementEntry)
+	if !ok {
+		return incrementContents{Err: ErrBadData}
+	}
+
+	current := int64(0)
+	if value, exists := sh.data[entry.Key]; exists && !sh.expired(entry.Key) {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return incrementContents{Err: ErrNotInteger}
+		}
+		current = parsed
+	}
+
+	if (entry.Delta > 0 && current > math.MaxInt64-entry.Delta) || (entry.Delta < 0 && current < math.MinInt64-entry.Delta) {
+		return incrementContents{Err: ErrOverflow}
+	}
+
+	result := current + entry.Delta
+	value := strconv.FormatInt(result, 10)
+
+	if err := sh.makeRoom(entry.Key, value); err != nil {
+		return incrementContents{Err: err}
+	}
+
+	// Logged as a put of the result, keeping any expiry
+	record := logRecord{op: opPut, key: entry.Key, value: value}
+	expiry, expiring := sh.expiries[entry.Key]
+	if expiring {
+		record = logRecord{op: opPutExpiring, key: entry.Key, value: value, expiry: expiry.UnixNano()}
+	}
+
+	if err := sh.appendLog(record); err != nil {
+		return incrementContents{Err: err}
+	}
+
+	sh.apply(record)
+	return incrementContents{Value: result, Expiry: expiry}
+}
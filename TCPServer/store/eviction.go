@@ -0,0 +1,491 @@
+package store
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+var ErrOutOfMemory = errors.New("Out of memory")
+
+// A write's own shard has nothing left to evict, only the DataStore can reach the others
+var errNeedRoom = errors.New("Need room from other shards")
+
+// What to do with a write that would take the store over its memory limit
+type EvictionPolicy int
+
+const (
+	EvictLRU    EvictionPolicy = iota // drop the least recently used keys
+	EvictLFU                          // drop the least frequently used keys
+	EvictRandom                       // drop keys at random
+	EvictReject                       // keep everything and fail the write
+)
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "lru":
+		return EvictLRU, nil
+	case "lfu":
+		return EvictLFU, nil
+	case "random":
+		return EvictRandom, nil
+	case "reject":
+		return EvictReject, nil
+	}
+	return EvictLRU, fmt.Errorf("invalid eviction policy %q", s)
+}
+
+// MaxMemory counts the bytes in keys and values, 0 means no limit
+type MemoryLimit struct {
+	MaxMemory int64
+	Policy    EvictionPolicy
+}
+
+type StoreStats struct {
+	Keys       int // expired keys are dropped before counting
+	UsedMemory int64
+	MaxMemory  int64
+	Evictions  uint64
+	Rejections uint64 // writes failed with ErrOutOfMemory
+}
+
+// Applies the limit straight away, evicting keys if the store is already over
+// it. The limit is on the memory used by every shard together. A write evicts
+// from its own shard, and only from the others once that has nothing left.
+func (ds *DataStore) SetMemoryLimit(limit MemoryLimit) error {
+	release := ds.pauseAll()
+	defer release()
+
+	atomic.StoreInt64(&ds.memory.max, limit.MaxMemory)
+	atomic.StoreInt32(&ds.memory.policy, int32(limit.Policy))
+	for _, sh := range ds.shards {
+		sh.limit = limit
+		sh.rebuildEvictor()
+	}
+
+	return ds.enforceLimit()
+}
+
+// The limit last given to SetMemoryLimit
+func (ds *DataStore) MemoryLimit() MemoryLimit {
+	return MemoryLimit{
+		MaxMemory: atomic.LoadInt64(&ds.memory.max),
+		Policy:    EvictionPolicy(atomic.LoadInt32(&ds.memory.policy)),
+	}
+}
+
+func (ds *DataStore) Stats(ctx context.Context) (StoreStats, error) {
+	var result StoreStats
+
+	for _, sh := range ds.shards {
+		response, err := request(ctx, sh.statsChannel, nil)
+		if err != nil {
+			return StoreStats{}, err
+		}
+		stats := response.(StoreStats)
+
+		result.Keys += stats.Keys
+		result.UsedMemory += stats.UsedMemory
+		result.MaxMemory = stats.MaxMemory
+		result.Evictions += stats.Evictions
+		result.Rejections += stats.Rejections
+	}
+
+	return result, nil
+}
+
+// Memory used by every shard together. Shards check the total without
+// stopping each other, so writes landing on different shards at the same
+// moment can take it a little over until the next write evicts.
+type memoryUsage struct {
+	used   int64 // accessed atomically
+	max    int64 // accessed atomically, the shards' limit for the DataStore to see
+	policy int32 // accessed atomically, the shards' EvictionPolicy
+}
+
+func (m *memoryUsage) total() int64 {
+	return atomic.LoadInt64(&m.used)
+}
+
+func (m *memoryUsage) limited() bool {
+	return atomic.LoadInt64(&m.max) > 0
+}
+
+// Only call with the shards paused. Evict from whichever shard uses the most
+// memory until the total is back under the limit, after the limit changes or
+// a snapshot is loaded.
+func (ds *DataStore) enforceLimit() error {
+	for {
+		sh := largestShard(ds.shards, nil)
+		if sh == nil || sh.limit.MaxMemory <= 0 || sh.evictor == nil || sh.memory.total() <= sh.limit.MaxMemory {
+			return nil
+		}
+
+		victim, ok := sh.evictor.victim()
+		if !ok {
+			return nil
+		}
+		if err := sh.evict(victim); err != nil {
+			return err
+		}
+	}
+}
+
+// A write whose shard couldn't make room for it from its own keys. With every
+// shard paused it can evict from the others as well.
+func (ds *DataStore) withRoom(ctx context.Context, key string, write func(sh *shard) error) error {
+	release, err := ds.pauseShards(ctx, ds.shards)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	sh := ds.shardFor(key)
+	sh.borrowFrom = ds.shards
+	defer func() {
+		sh.borrowFrom = nil
+	}()
+
+	err = write(sh)
+	sh.compactLog()
+	return err
+}
+
+// The shard other than skip using the most memory, nil if they're all empty
+func largestShard(shards []*shard, skip *shard) *shard {
+	var largest *shard
+	for _, sh := range shards {
+		if sh != skip && sh.usedMemory > 0 && (largest == nil || sh.usedMemory > largest.usedMemory) {
+			largest = sh
+		}
+	}
+	return largest
+}
+
+func (sh *shard) stats() StoreStats {
+	sh.dropExpired(0)
+
+	return StoreStats{
+		Keys:       len(sh.data),
+		UsedMemory: sh.usedMemory,
+		MaxMemory:  sh.limit.MaxMemory,
+		Evictions:  sh.evictions,
+		Rejections: sh.rejections,
+	}
+}
+
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// Every change to sh.data goes through setValue or removeKey so the memory
+// count, eviction order and index stay right
+func (sh *shard) setValue(key, value string) {
+	old, exists := sh.data[key]
+	change := entrySize(key, value)
+	if exists {
+		change -= entrySize(key, old)
+	}
+
+	sh.data[key] = value
+	sh.usedMemory += change
+	atomic.AddInt64(&sh.memory.used, change)
+
+	if !exists {
+		sh.index.insert(key)
+	}
+
+	if sh.evictor != nil {
+		if exists {
+			sh.evictor.touch(key)
+		} else {
+			sh.evictor.add(key)
+		}
+	}
+}
+
+func (sh *shard) removeKey(key string) {
+	value, exists := sh.data[key]
+	if !exists {
+		return
+	}
+
+	sh.usedMemory -= entrySize(key, value)
+	atomic.AddInt64(&sh.memory.used, -entrySize(key, value))
+	delete(sh.data, key)
+	delete(sh.expiries, key)
+	sh.index.remove(key)
+
+	if sh.evictor != nil {
+		sh.evictor.remove(key)
+	}
+}
+
+// Reads count as a use for LRU and LFU
+func (sh *shard) touch(key string) {
+	if sh.evictor != nil {
+		sh.evictor.touch(key)
+	}
+}
+
+// Make sure writing value to key keeps the store under the limit, evicting
+// other keys if the policy allows it. Fails with errNeedRoom if only other
+// shards have keys left to evict, see DataStore.withRoom.
+func (sh *shard) makeRoom(key, value string) error {
+	if sh.limit.MaxMemory <= 0 {
+		return nil
+	}
+
+	size := entrySize(key, value)
+	if size > sh.limit.MaxMemory {
+		sh.rejections++
+		return ErrOutOfMemory
+	}
+
+	current := int64(0)
+	if old, exists := sh.data[key]; exists {
+		current = entrySize(key, old)
+	}
+
+	for sh.memory.total()-current+size > sh.limit.MaxMemory {
+		if sh.evictor == nil {
+			sh.rejections++
+			return ErrOutOfMemory
+		}
+
+		victim, ok := sh.evictor.victim()
+		if ok && victim == key {
+			if len(sh.data) > 1 {
+				// Being overwritten anyway, look at the next candidate instead
+				sh.evictor.touch(key)
+				continue
+			}
+			ok = false
+		}
+
+		if ok {
+			if err := sh.evict(victim); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Nothing of ours left to evict
+		other := largestShard(sh.borrowFrom, sh)
+		if other == nil {
+			if sh.borrowFrom == nil {
+				return errNeedRoom
+			}
+			sh.rejections++
+			return ErrOutOfMemory
+		}
+
+		victim, _ = other.evictor.victim()
+		if err := other.evict(victim); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Evictions are logged like deletes so replaying the log ends in the same state
+func (sh *shard) evict(key string) error {
+	if err := sh.appendLog(logRecord{op: opDelete, key: key}); err != nil {
+		return err
+	}
+
+	sh.removeKey(key)
+	sh.evictions++
+	return nil
+}
+
+func (sh *shard) rebuildEvictor() {
+	sh.evictor = nil
+
+	if sh.limit.MaxMemory <= 0 {
+		return
+	}
+
+	switch sh.limit.Policy {
+	case EvictLRU:
+		sh.evictor = newLRUEvictor()
+	case EvictLFU:
+		sh.evictor = newLFUEvictor()
+	case EvictRandom:
+		sh.evictor = newRandomEvictor()
+	default:
+		// EvictReject doesn't need to track anything
+		return
+	}
+
+	for key := range sh.data {
+		sh.evictor.add(key)
+	}
+}
+
+// Keeps track of which key to evict next
+type evictor interface {
+	add(key string)
+	touch(key string)
+	remove(key string)
+	victim() (string, bool)
+}
+
+// Most recently used at the front
+type lruEvictor struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (e *lruEvictor) add(key string) {
+	e.elements[key] = e.order.PushFront(key)
+}
+
+func (e *lruEvictor) touch(key string) {
+	if element, ok := e.elements[key]; ok {
+		e.order.MoveToFront(element)
+	}
+}
+
+func (e *lruEvictor) remove(key string) {
+	if element, ok := e.elements[key]; ok {
+		e.order.Remove(element)
+		delete(e.elements, key)
+	}
+}
+
+func (e *lruEvictor) victim() (string, bool) {
+	back := e.order.Back()
+	if back == nil {
+		return "", false
+	}
+	return back.Value.(string), true
+}
+
+// Min heap on use count, ties go to the key used longest ago
+type lfuEvictor struct {
+	items lfuHeap
+	index map[string]*lfuItem
+	clock uint64
+}
+
+type lfuItem struct {
+	key      string
+	count    uint64
+	lastUsed uint64
+	position int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].lastUsed < h[j].lastUsed
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].position = i
+	h[j].position = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.position = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{index: make(map[string]*lfuItem)}
+}
+
+func (e *lfuEvictor) add(key string) {
+	e.clock++
+	item := &lfuItem{key: key, count: 1, lastUsed: e.clock}
+	heap.Push(&e.items, item)
+	e.index[key] = item
+}
+
+func (e *lfuEvictor) touch(key string) {
+	if item, ok := e.index[key]; ok {
+		e.clock++
+		item.count++
+		item.lastUsed = e.clock
+		heap.Fix(&e.items, item.position)
+	}
+}
+
+func (e *lfuEvictor) remove(key string) {
+	if item, ok := e.index[key]; ok {
+		heap.Remove(&e.items, item.position)
+		delete(e.index, key)
+	}
+}
+
+func (e *lfuEvictor) victim() (string, bool) {
+	if len(e.items) == 0 {
+		return "", false
+	}
+	return e.items[0].key, true
+}
+
+type randomEvictor struct {
+	keys  []string
+	index map[string]int
+}
+
+func newRandomEvictor() *randomEvictor {
+	return &randomEvictor{index: make(map[string]int)}
+}
+
+func (e *randomEvictor) add(key string) {
+	e.index[key] = len(e.keys)
+	e.keys = append(e.keys, key)
+}
+
+func (e *randomEvictor) touch(key string) {}
+
+// Swap the last key into the hole so removal stays O(1)
+func (e *randomEvictor) remove(key string) {
+	i, ok := e.index[key]
+	if !ok {
+		return
+	}
+
+	last := e.keys[len(e.keys)-1]
+	e.keys[i] = last
+	e.index[last] = i
+
+	e.keys = e.keys[:len(e.keys)-1]
+	delete(e.index, key)
+}
+
+func (e *randomEvictor) victim() (string, bool) {
+	if len(e.keys) == 0 {
+		return "", false
+	}
+	return e.keys[rand.Intn(len(e.keys))], true
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+const (
+	// How often each shard looks for expired keys nobody has asked for
+	sweepInterval = time.Second
+
+	// Keys checked per sweep so a big expiry set can't stall a shard
+	sweepLimit = 1000
+)
+
+// Data for a put that expires, sent to a shard in place of the usual key
+// value pair
+type expiringEntry struct {
+	Key    string
+	Value  string
+	Expiry time.Time
+}
+
+// Response to a TTL request, a zero Expiry means the key never expires
+type ttlContents struct {
+	Expiry time.Time
+	Err    error
+}
+
+// Put a key that is dropped once expiry passes
+func (ds *DataStore) PutWithExpiry(ctx context.Context, key, value string, expiry time.Time) error {
+	return ds.put(ctx, key, expiringEntry{Key: key, Value: value, Expiry: expiry})
+}
+
+func (ds *DataStore) TTL(ctx context.Context, key string) (time.Time, error) {
+	result, err := request(ctx, ds.shardFor(key).ttlChannel, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	contents := result.(ttlContents)
+	return contents.Expiry, contents.Err
+}
+
+// Remove the expiry from a key so it lives until deleted
+func (ds *DataStore) Persist(ctx context.Context, key string) error {
+	return requestErr(ctx, ds.shardFor(key).persistChannel, key)
+}
+
+// Expired keys are dropped the first time they are looked at. They don't need
+// to go in the log, replaying it brings back the expiry along with the key.
+func (sh *shard) expired(key string) bool {
+	expiry, ok := sh.expiries[key]
+	if !ok || time.Now().Before(expiry) {
+		return false
+	}
+
+	sh.removeKey(key)
+	return true
+}
+
+func (sh *shard) ttl(data interface{}) ttlContents {
+
+	key, ok := data.(string)
+	if !ok {
+		return ttlContents{Err: ErrBadData}
+	}
+
+	if _, ok := sh.data[key]; !ok || sh.expired(key) {
+		return ttlContents{Err: ErrKeyNotFound}
+	}
+
+	return ttlContents{Expiry: sh.expiries[key], Err: nil}
+}
+
+func (sh *shard) persist(data interface{}) error {
+
+	key, ok := data.(string)
+	if !ok {
+		return ErrBadData
+	}
+
+	if _, ok := sh.data[key]; !ok || sh.expired(key) {
+		return ErrKeyNotFound
+	}
+
+	if _, ok := sh.expiries[key]; !ok {
+		// Nothing to do
+		return nil
+	}
+
+	record := logRecord{op: opPersist, key: key}
+	if err := sh.appendLog(record); err != nil {
+		return err
+	}
+
+	sh.apply(record)
+	return nil
+}
+
+// Give key an expiry, everything that sets one goes through here so the
+// queue knows about it
+func (sh *shard) setExpiry(key string, expiry time.Time) {
+	sh.expiries[key] = expiry
+	heap.Push(&sh.expiryQueue, queuedExpiry{key: key, expiry: expiry})
+
+	// Entries for keys since deleted, persisted or given a new expiry stay
+	// until they come up, rebuild if they're most of it
+	if len(sh.expiryQueue) > 2*len(sh.expiries)+sweepLimit {
+		sh.expiryQueue = sh.expiryQueue[:0]
+		for key, expiry := range sh.expiries {
+			sh.expiryQueue = append(sh.expiryQueue, queuedExpiry{key: key, expiry: expiry})
+		}
+		heap.Init(&sh.expiryQueue)
+	}
+}
+
+// Drop keys that have expired, soonest first, so a count agrees with what
+// reads would find. Only the expired keys are looked at, and at most limit of
+// them unless it's 0.
+func (sh *shard) dropExpired(limit int) {
+	now := time.Now()
+
+	for checked := 0; len(sh.expiryQueue) > 0 && (limit == 0 || checked < limit); checked++ {
+		next := sh.expiryQueue[0]
+		if now.Before(next.expiry) {
+			return
+		}
+		heap.Pop(&sh.expiryQueue)
+
+		if expiry, ok := sh.expiries[next.key]; ok && expiry.Equal(next.expiry) {
+			sh.removeKey(next.key)
+		}
+	}
+}
+
+// Clear out expired keys that are never read again
+func (sh *shard) sweepExpired() {
+	sh.dropExpired(sweepLimit)
+}
+
+// Expiry times in a heap, soonest at the front. An entry only counts if it's
+// still the key's expiry.
+type expiryQueue []queuedExpiry
+
+type queuedExpiry struct {
+	key    string
+	expiry time.Time
+}
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].expiry.Before(q[j].expiry) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(queuedExpiry)) }
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"math/rand"
+)
+
+const (
+	// Enough levels for billions of keys at one in four
+	maxIndexLevel = 24
+
+	// One in this many nodes on a level also makes the next one up
+	indexLevelOdds = 4
+)
+
+// Skiplist of a shard's keys in sorted order, kept up to date alongside the
+// map by setValue and removeKey so keys can be walked in order without
+// sorting them. Only touched by the shard's monitor so it isn't locked.
+type keyIndex struct {
+	head   *indexNode
+	level  int // levels in use, at least 1
+	length int
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode // one per level the node is on, next[0] is the next key
+	prev *indexNode   // the key before, nil for the first
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  &indexNode{next: make([]*indexNode, maxIndexLevel)},
+		level: 1,
+	}
+}
+
+// Add key, a no-op if it is already there
+func (ix *keyIndex) insert(key string) {
+	var update [maxIndexLevel]*indexNode
+	node := ix.head
+
+	for level := ix.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		update[level] = node
+	}
+
+	if next := node.next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := randomIndexLevel()
+	for ix.level < level {
+		update[ix.level] = ix.head
+		ix.level++
+	}
+
+	added := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		added.next[i] = update[i].next[i]
+		update[i].next[i] = added
+	}
+
+	if update[0] != ix.head {
+		added.prev = update[0]
+	}
+	if added.next[0] != nil {
+		added.next[0].prev = added
+	}
+
+	ix.length++
+}
+
+func (ix *keyIndex) remove(key string) {
+	var update [maxIndexLevel]*indexNode
+	node := ix.head
+
+	for level := ix.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		update[level] = node
+	}
+
+	removed := node.next[0]
+	if removed == nil || removed.key != key {
+		return
+	}
+
+	for i := range removed.next {
+		update[i].next[i] = removed.next[i]
+	}
+
+	if removed.next[0] != nil {
+		removed.next[0].prev = removed.prev
+	}
+
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+
+	ix.length--
+}
+
+// First node with a key at or after key, nil if there isn't one. Follow
+// next[0] from there to walk the rest in order.
+func (ix *keyIndex) ceiling(key string) *indexNode {
+	node := ix.head
+
+	for level := ix.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+	}
+
+	return node.next[0]
+}
+
+// Last node with a key at or before key, nil if there isn't one. Follow prev
+// from there to walk back in order.
+func (ix *keyIndex) floor(key string) *indexNode {
+	node := ix.head
+
+	for level := ix.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key <= key {
+			node = node.next[level]
+		}
+	}
+
+	if node == ix.head {
+		return nil
+	}
+	return node
+}
+
+// Node with the largest key, nil if the index is empty
+func (ix *keyIndex) last() *indexNode {
+	node := ix.head
+
+	for level := ix.level - 1; level >= 0; level-- {
+		for node.next[level] != nil {
+			node = node.next[level]
+		}
+	}
+
+	if node == ix.head {
+		return nil
+	}
+	return node
+}
+
+func randomIndexLevel() int {
+	level := 1
+	for level < maxIndexLevel && rand.Intn(indexLevelOdds) == 0 {
+		level++
+	}
+	return level
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+
+	t.Run("MatchesSortedKeys", func(t *testing.T) {
+		index := newKeyIndex()
+		present := make(map[string]bool)
+
+		for i := 0; i < 5000; i++ {
+			key := strconv.Itoa(rand.Intn(1000))
+			if rand.Intn(3) == 0 {
+				index.remove(key)
+				delete(present, key)
+			} else {
+				index.insert(key)
+				present[key] = true
+			}
+		}
+
+		var expected []string
+		for key := range present {
+			expected = append(expected, key)
+		}
+		sort.Strings(expected)
+
+		var forward, backward []string
+		for node := index.ceiling(""); node != nil; node = node.next[0] {
+			forward = append(forward, node.key)
+		}
+		for node := index.last(); node != nil; node = node.prev {
+			backward = append([]string{node.key}, backward...)
+		}
+
+		if fmt.Sprint(forward) != fmt.Sprint(expected) || fmt.Sprint(backward) != fmt.Sprint(expected) || index.length != len(expected) {
+			t.Error("Expected keys: ", len(expected), " Actual forward: ", len(forward), " backward: ", len(backward), " length: ", index.length)
+		}
+	})
+
+	t.Run("CeilingAndFloor", func(t *testing.T) {
+		index := newKeyIndex()
+		for _, key := range []string{"b", "d", "f"} {
+			index.insert(key)
+		}
+
+		tests := []struct {
+			key     string
+			ceiling string
+			floor   string
+		}{
+			{"a", "b", ""},
+			{"b", "b", "b"},
+			{"c", "d", "b"},
+			{"f", "f", "f"},
+			{"g", "", "f"},
+		}
+
+		for _, test := range tests {
+			ceiling, floor := "", ""
+			if node := index.ceiling(test.key); node != nil {
+				ceiling = node.key
+			}
+			if node := index.floor(test.key); node != nil {
+				floor = node.key
+			}
+
+			if ceiling != test.ceiling || floor != test.floor {
+				t.Error("Key: ", test.key, " Expected: ", test.ceiling, test.floor, " Actual: ", ceiling, floor)
+			}
+		}
+	})
+}
+
+// Cost of keeping the index on a put and delete, against the map alone
+func BenchmarkIndexOverhead(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		keys := make([]string, size)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("user:%08d", rand.Intn(size*10))
+		}
+
+		b.Run(fmt.Sprintf("MapOnly%d", size), func(b *testing.B) {
+			data := make(map[string]string)
+			for _, key := range keys {
+				data[key] = "Apple"
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%size] + "x"
+				data[key] = "Apple"
+				delete(data, key)
+			}
+		})
+
+		b.Run(fmt.Sprintf("MapAndIndex%d", size), func(b *testing.B) {
+			data := make(map[string]string)
+			index := newKeyIndex()
+			for _, key := range keys {
+				data[key] = "Apple"
+				index.insert(key)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%size] + "x"
+				data[key] = "Apple"
+				index.insert(key)
+				delete(data, key)
+				index.remove(key)
+			}
+		})
+	}
+}
+
+// Puts and deletes through a shard, index included, for the absolute cost
+func BenchmarkShardPutDelete(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			sh := newShard(make(chan struct{}, 1), &memoryUsage{})
+			for i := 0; i < size; i++ {
+				sh.put([]string{fmt.Sprintf("user:%08d", i), "Apple"})
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("user:%08d.x", i%size)
+				sh.put([]string{key, "Apple"})
+				sh.delete(key)
+			}
+		})
+	}
+}
+
+func BenchmarkRange(b *testing.B) {
+	sh := newShard(make(chan struct{}, 1), &memoryUsage{})
+	for i := 0; i < 100000; i++ {
+		sh.put([]string{fmt.Sprintf("user:%08d", i), "Apple"})
+	}
+
+	for _, reverse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Reverse%v", reverse), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				start := fmt.Sprintf("user:%08d", i%99000)
+				end := fmt.Sprintf("user:%08d", i%99000+99)
+				sh.readRange(rangeRequest{Start: start, End: end, Reverse: reverse, Limit: 100})
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotFile    = "snapshot.gob"
+	snapshotVersion = 1
+)
+
+var ErrBadSnapshot = errors.New("Bad snapshot")
+
+// Written at the start of a snapshot, followed by Count entries
+type snapshotHeader struct {
+	Version int
+	Count   int
+}
+
+type snapshotEntry struct {
+	Key    string
+	Value  string
+	Expiry int64 // unix nanoseconds, 0 if the key never expires
+}
+
+// Write a consistent copy of the store to w. Every shard is paused while it
+// runs so no writes can land part way through.
+func (ds *DataStore) Snapshot(w io.Writer) error {
+	release := ds.pauseAll()
+	defer release()
+
+	return ds.snapshot(w)
+}
+
+// Replace the contents of the store with a snapshot read from r. The store is
+// left untouched if the snapshot can't be read in full.
+func (ds *DataStore) Restore(r io.Reader) error {
+	release := ds.pauseAll()
+	defer release()
+
+	return ds.restore(r)
+}
+
+// Only call with the shards paused
+func (ds *DataStore) snapshot(w io.Writer) error {
+
+	count := 0
+	for _, sh := range ds.shards {
+		count += len(sh.data)
+	}
+
+	encoder := gob.NewEncoder(w)
+	if err := encoder.Encode(snapshotHeader{Version: snapshotVersion, Count: count}); err != nil {
+		return err
+	}
+
+	for _, sh := range ds.shards {
+		for key, value := range sh.data {
+			entry := snapshotEntry{Key: key, Value: value}
+			if expiry, ok := sh.expiries[key]; ok {
+				entry.Expiry = expiry.UnixNano()
+			}
+
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Only call with the shards paused. Snapshots don't record the shard count,
+// entries are routed again on the way in.
+func (ds *DataStore) restore(r io.Reader) error {
+
+	decoder := gob.NewDecoder(r)
+
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+
+	if header.Version != snapshotVersion || header.Count < 0 {
+		return ErrBadSnapshot
+	}
+
+	entries := make([]snapshotEntry, 0, header.Count)
+	for i := 0; i < header.Count; i++ {
+		var entry snapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, sh := range ds.shards {
+		sh.reset()
+	}
+
+	for _, entry := range entries {
+		sh := ds.shardFor(entry.Key)
+		sh.setValue(entry.Key, entry.Value)
+		if entry.Expiry != 0 {
+			sh.setExpiry(entry.Key, time.Unix(0, entry.Expiry))
+		} else {
+			delete(sh.expiries, entry.Key)
+		}
+	}
+
+	return ds.enforceLimit()
+}
+
+// Apply a change from the log to its shard, or each change in a batch to theirs
+func (ds *DataStore) applyRecord(record logRecord) {
+	if record.op == opBatch {
+		for _, r := range record.batch {
+			ds.shardFor(r.key).apply(r)
+		}
+		return
+	}
+	ds.shardFor(record.key).apply(record)
+}
+
+// How the data dir is used, see EnablePersistence
+type PersistenceOptions struct {
+	SnapshotInterval time.Duration // 0 only snapshots on close and compaction
+	SyncPolicy       SyncPolicy
+	SyncInterval     time.Duration // used with SyncInterval
+	CompactSize      int64         // snapshot and reset the log once it passes this many bytes
+}
+
+// Write a snapshot to dir. When dir is the data dir the write ahead log is
+// reset at the same time, since the snapshot now covers everything in it.
+func (ds *DataStore) SaveSnapshot(dir string) error {
+	release := ds.pauseAll()
+	defer release()
+
+	return ds.checkpoint(dir)
+}
+
+// Restore the latest snapshot in dir, if there is one
+func (ds *DataStore) LoadSnapshot(dir string) error {
+	file, err := os.Open(filepath.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return ds.Restore(file)
+}
+
+// Load the latest snapshot in dir and replay the log written after it, then
+// log every change from here on and keep snapshotting into dir until the store
+// is closed
+func (ds *DataStore) EnablePersistence(dir string, options PersistenceOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	release := ds.pauseAll()
+	err := ds.open(dir, options)
+	release()
+	if err != nil {
+		return err
+	}
+
+	ds.snapshotStop = make(chan struct{})
+
+	ds.snapshotWait.Add(1)
+	go ds.persistence()
+
+	return nil
+}
+
+// Takes the periodic snapshots and the ones shards ask for when the log gets
+// too big
+func (ds *DataStore) persistence() {
+	defer ds.snapshotWait.Done()
+
+	var tick <-chan time.Time
+	if ds.options.SnapshotInterval > 0 {
+		ticker := time.NewTicker(ds.options.SnapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if err := ds.SaveSnapshot(ds.dataDir); err != nil {
+				log.Println("Snapshot failed:", err)
+			}
+		case <-ds.compactRequests:
+			if ds.wal.currentSize() < ds.options.CompactSize {
+				// Someone else snapshotted in the meantime
+				continue
+			}
+			if err := ds.SaveSnapshot(ds.dataDir); err != nil {
+				log.Println("Log compaction failed:", err)
+			}
+		case <-ds.snapshotStop:
+			return
+		}
+	}
+}
+
+// Only call with the shards paused
+func (ds *DataStore) open(dir string, options PersistenceOptions) error {
+
+	file, err := os.Open(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		err = ds.restore(file)
+		file.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	path := filepath.Join(dir, logFile)
+
+	err = replayLog(path, ds.applyRecord)
+	if err != nil {
+		return err
+	}
+
+	ds.wal, err = openLog(path, options.SyncPolicy, options.SyncInterval)
+	if err != nil {
+		return err
+	}
+
+	ds.dataDir = dir
+	ds.options = options
+
+	for _, sh := range ds.shards {
+		sh.wal = ds.wal
+		sh.compactSize = options.CompactSize
+	}
+
+	// The limit may be lower than when the data was written
+	return ds.enforceLimit()
+}
+
+// Only call with the shards paused. The snapshot goes to a temporary file
+// first and is renamed over the previous one so a crash never leaves a half
+// written snapshot. If we crash between the rename and resetting the log,
+// replaying the log on top of the snapshot just repeats changes it already has.
+func (ds *DataStore) checkpoint(dir string) error {
+
+	file, err := os.CreateTemp(dir, snapshotFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := ds.snapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if ds.wal != nil && dir == ds.dataDir {
+		return ds.wal.truncate()
+	}
+
+	return nil
+}
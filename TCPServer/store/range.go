@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Data for one shard's part of a range read
+type rangeRequest struct {
+	Start   string // "" for no lower bound
+	End     string // "" for no upper bound
+	Reverse bool
+	Limit   int
+}
+
+// Entries with keys from start to end, both included, in key order and no
+// more than limit of them. An empty start or end leaves that side open.
+func (ds *DataStore) Range(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	return ds.readRange(ctx, rangeRequest{Start: start, End: end, Limit: limit})
+}
+
+// Like Range, starting from end and working back towards start
+func (ds *DataStore) ReverseRange(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	return ds.readRange(ctx, rangeRequest{Start: start, End: end, Reverse: true, Limit: limit})
+}
+
+// Each shard hands over its first limit entries and the best of those win.
+// Shards are read one after another, as in Scan, so this isn't a snapshot of
+// the whole store.
+func (ds *DataStore) readRange(ctx context.Context, read rangeRequest) ([]KeyValue, error) {
+	if read.Limit < 1 {
+		read.Limit = 1
+	}
+
+	var entries []KeyValue
+	for _, sh := range ds.shards {
+		result, err := request(ctx, sh.rangeChannel, read)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, result.([]KeyValue)...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if read.Reverse {
+			return entries[i].Key > entries[j].Key
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	if len(entries) > read.Limit {
+		entries = entries[:read.Limit]
+	}
+
+	return entries, nil
+}
+
+func (sh *shard) readRange(data interface{}) []KeyValue {
+
+	read, ok := data.(rangeRequest)
+	if !ok {
+		return nil
+	}
+
+	var entries []KeyValue
+	now := time.Now()
+
+	// Expired keys are skipped and left for the sweeper
+	add := func(key string) {
+		if expiry, ok := sh.expiries[key]; ok && !now.Before(expiry) {
+			return
+		}
+		entries = append(entries, KeyValue{Key: key, Value: sh.data[key]})
+	}
+
+	if read.Reverse {
+		node := sh.index.last()
+		if read.End != "" {
+			node = sh.index.floor(read.End)
+		}
+
+		for ; node != nil && node.key >= read.Start && len(entries) < read.Limit; node = node.prev {
+			add(node.key)
+		}
+		return entries
+	}
+
+	for node := sh.index.ceiling(read.Start); node != nil && len(entries) < read.Limit; node = node.next[0] {
+		if read.End != "" && node.key > read.End {
+			break
+		}
+		add(node.key)
+	}
+	return entries
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequest(t *testing.T) {
+
+	t.Run("WaitsOnceTaken", func(t *testing.T) {
+		channel := make(chan storeMessage)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		// A shard that takes the write and only answers after the deadline
+		go func() {
+			msg := <-channel
+			<-ctx.Done()
+			msg.responseChannel <- nil
+		}()
+
+		if err := requestErr(ctx, channel, []string{"1", "Apple"}); err != nil {
+			t.Error("Expected: <nil> Actual: ", err)
+		}
+	})
+
+	t.Run("GivesUpBeforeTaken", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		if err := requestErr(ctx, make(chan storeMessage), []string{"1", "Apple"}); err != context.DeadlineExceeded {
+			t.Error("Expected: ", context.DeadlineExceeded, " Actual: ", err)
+		}
+	})
+}
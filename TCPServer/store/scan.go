@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Data for one shard's part of a scan page
+type scanRequest struct {
+	After   string // keys after this one, "" to start from the beginning
+	Prefix  string // every key the pattern can match starts with this
+	Pattern string
+	Limit   int // most keys to look at
+}
+
+// Response to a scan request. Last is the last key looked at, which is where
+// the shard got to unless it ran out of keys.
+type scanContents struct {
+	Keys []string
+	Last string
+	Done bool
+}
+
+// One page of the keys matching pattern, in order, starting after cursor. Pass
+// "" to start and then the returned cursor until it comes back "". A pattern
+// is a glob where * is any run of bytes, ? is a single byte and \ escapes the
+// next one, "" matches everything.
+//
+// Each shard looks at no more than count keys per page, so a page can hold
+// fewer than count keys, or none, even when there are more to come. Shards
+// are visited one at a time rather than paused together: a key that is there
+// for the whole scan is returned exactly once, one added or removed part way
+// through may or may not be.
+func (ds *DataStore) Scan(ctx context.Context, cursor, pattern string, count int) ([]string, string, error) {
+	if count < 1 {
+		count = 1
+	}
+
+	page := scanRequest{After: cursor, Prefix: literalPrefix(pattern), Pattern: pattern, Limit: count}
+
+	var keys []string
+	boundary := ""
+	more := false
+
+	for _, sh := range ds.shards {
+		result, err := request(ctx, sh.scanChannel, page)
+		if err != nil {
+			return nil, "", err
+		}
+
+		contents := result.(scanContents)
+		keys = append(keys, contents.Keys...)
+
+		// Keys past where the slowest shard got to have to wait for the next
+		// page, or the cursor would skip that shard's keys in between
+		if !contents.Done && (!more || contents.Last < boundary) {
+			boundary = contents.Last
+			more = true
+		}
+	}
+
+	sort.Strings(keys)
+
+	if more {
+		keys = keys[:sort.SearchStrings(keys, boundary+"\x00")]
+	}
+
+	if len(keys) > count {
+		keys = keys[:count]
+		return keys, keys[count-1], nil
+	}
+
+	if more {
+		return keys, boundary, nil
+	}
+
+	return keys, "", nil
+}
+
+func (sh *shard) scan(data interface{}) scanContents {
+
+	request, ok := data.(scanRequest)
+	if !ok {
+		return scanContents{Done: true}
+	}
+
+	start := request.After
+	if request.Prefix > start {
+		start = request.Prefix
+	}
+
+	var result scanContents
+	now := time.Now()
+	examined := 0
+
+	for node := sh.index.ceiling(start); node != nil; node = node.next[0] {
+		if node.key == request.After {
+			continue
+		}
+
+		if !strings.HasPrefix(node.key, request.Prefix) {
+			// Sorted, so nothing further on can match either
+			break
+		}
+
+		if examined == request.Limit {
+			return result
+		}
+		examined++
+		result.Last = node.key
+
+		// Left for the sweeper rather than removed mid walk
+		if expiry, ok := sh.expiries[node.key]; ok && !now.Before(expiry) {
+			continue
+		}
+
+		if globMatch(request.Pattern, node.key) {
+			result.Keys = append(result.Keys, node.key)
+		}
+	}
+
+	result.Done = true
+	return result
+}
+
+// Everything in pattern before the first wildcard
+func literalPrefix(pattern string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' || c == '?':
+			return sb.String()
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteByte(pattern[i])
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
+
+// Match key against a glob, see Scan. On a mismatch after a * the star takes
+// one more byte and matching carries on from there.
+func globMatch(pattern, key string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	p, k := 0, 0
+	starP, starK := -1, 0
+
+	for k < len(key) {
+		if p < len(pattern) {
+			c := pattern[p]
+			switch {
+			case c == '*':
+				starP, starK = p, k
+				p++
+				continue
+			case c == '?':
+				p++
+				k++
+				continue
+			case c == '\\' && p+1 < len(pattern):
+				if pattern[p+1] == key[k] {
+					p += 2
+					k++
+					continue
+				}
+			case c == key[k]:
+				p++
+				k++
+				continue
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+
+		starK++
+		p, k = starP+1, starK
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
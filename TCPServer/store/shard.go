@@ -0,0 +1,227 @@
+package store
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// One partition of the store. All of its state belongs to its monitor
+// goroutine, the DataStore only reaches in while the shard is paused.
+type shard struct {
+	putChannel       chan storeMessage
+	deleteChannel    chan storeMessage
+	getChannel       chan storeMessage
+	ttlChannel       chan storeMessage
+	persistChannel   chan storeMessage
+	incrementChannel chan storeMessage
+	scanChannel      chan storeMessage
+	rangeChannel     chan storeMessage
+	statsChannel     chan storeMessage
+	pauseChannel     chan storeMessage
+	doneChannel      chan bool
+	data             map[string]string
+	expiries         map[string]time.Time // only keys with a TTL
+	expiryQueue      expiryQueue          // the same, soonest first, see setExpiry
+	index            *keyIndex            // the keys of data in order
+
+	// Memory accounting, keys are only evicted once a limit is set. The
+	// limit covers memory, which every shard adds to.
+	limit      MemoryLimit
+	evictor    evictor
+	memory     *memoryUsage
+	usedMemory int64
+	evictions  uint64
+	rejections uint64
+	borrowFrom []*shard // shards makeRoom may evict from, set while they're all paused
+
+	// Shared by every shard, set while paused by EnablePersistence
+	wal             *writeAheadLog
+	compactSize     int64
+	compactRequests chan struct{}
+}
+
+func newShard(compactRequests chan struct{}, memory *memoryUsage) *shard {
+	return &shard{
+		putChannel:       make(chan storeMessage),
+		deleteChannel:    make(chan storeMessage),
+		getChannel:       make(chan storeMessage),
+		ttlChannel:       make(chan storeMessage),
+		persistChannel:   make(chan storeMessage),
+		incrementChannel: make(chan storeMessage),
+		scanChannel:      make(chan storeMessage),
+		rangeChannel:     make(chan storeMessage),
+		statsChannel:     make(chan storeMessage),
+		pauseChannel:     make(chan storeMessage),
+		doneChannel:      make(chan bool),
+		data:             make(map[string]string),
+		expiries:         make(map[string]time.Time),
+		index:            newKeyIndex(),
+		memory:           memory,
+		compactRequests:  compactRequests,
+	}
+}
+
+func (sh *shard) monitor() {
+	process := true
+
+	sweeper := time.NewTicker(sweepInterval)
+	defer sweeper.Stop()
+
+	for process {
+		select {
+		case msg := <-sh.putChannel:
+			msg.responseChannel <- sh.put(msg.data)
+			sh.compactLog()
+		case msg := <-sh.deleteChannel:
+			msg.responseChannel <- sh.delete(msg.data)
+			sh.compactLog()
+		case msg := <-sh.getChannel:
+			msg.responseChannel <- sh.get(msg.data)
+		case msg := <-sh.ttlChannel:
+			msg.responseChannel <- sh.ttl(msg.data)
+		case msg := <-sh.persistChannel:
+			msg.responseChannel <- sh.persist(msg.data)
+			sh.compactLog()
+		case msg := <-sh.incrementChannel:
+			msg.responseChannel <- sh.increment(msg.data)
+			sh.compactLog()
+		case msg := <-sh.scanChannel:
+			msg.responseChannel <- sh.scan(msg.data)
+		case msg := <-sh.rangeChannel:
+			msg.responseChannel <- sh.readRange(msg.data)
+		case msg := <-sh.statsChannel:
+			msg.responseChannel <- sh.stats()
+		case msg := <-sh.pauseChannel:
+			// Sit still until the DataStore is done with us
+			release, _ := msg.data.(chan struct{})
+			msg.responseChannel <- nil
+			<-release
+		case <-sweeper.C:
+			sh.sweepExpired()
+		case <-sh.doneChannel:
+			process = false
+		}
+	}
+}
+
+func (sh *shard) put(data interface{}) error {
+
+	var record logRecord
+
+	switch kv := data.(type) {
+	case []string:
+		if len(kv) != 2 {
+			return ErrBadData
+		}
+		record = logRecord{op: opPut, key: kv[0], value: kv[1]}
+	case expiringEntry:
+		record = logRecord{op: opPutExpiring, key: kv.Key, value: kv.Value, expiry: kv.Expiry.UnixNano()}
+	case conditionalEntry:
+		if !sh.conditionHolds(kv) {
+			return ErrConditionFailed
+		}
+		// Only the outcome is logged, replay doesn't need to check again
+		record = logRecord{op: opPut, key: kv.Key, value: kv.Value}
+	default:
+		return ErrBadData
+	}
+
+	if err := sh.makeRoom(record.key, record.value); err != nil {
+		return err
+	}
+
+	// Must be in the log before the caller can ack it
+	if err := sh.appendLog(record); err != nil {
+		return err
+	}
+
+	sh.apply(record)
+	return nil
+}
+
+func (sh *shard) get(data interface{}) getContents {
+
+	key, ok := data.(string)
+	if !ok {
+		return getContents{Value: "", Err: ErrBadData}
+	}
+
+	value, ok := sh.data[key]
+	if !ok || sh.expired(key) {
+		return getContents{Value: "", Err: ErrKeyNotFound}
+	}
+
+	sh.touch(key)
+	return getContents{Value: value, Err: nil}
+}
+
+func (sh *shard) delete(data interface{}) error {
+
+	key, ok := data.(string)
+	if !ok {
+		return ErrBadData
+	}
+
+	_, contains := sh.data[key]
+
+	if !contains || sh.expired(key) {
+		return ErrKeyNotFound
+	}
+
+	record := logRecord{op: opDelete, key: key}
+	if err := sh.appendLog(record); err != nil {
+		return err
+	}
+
+	sh.apply(record)
+	return nil
+}
+
+// Make a change that is already in the log, also used for replaying it
+func (sh *shard) apply(record logRecord) {
+	switch record.op {
+	case opPut:
+		sh.setValue(record.key, record.value)
+		delete(sh.expiries, record.key)
+	case opPutExpiring:
+		sh.setValue(record.key, record.value)
+		sh.setExpiry(record.key, time.Unix(0, record.expiry))
+	case opDelete:
+		sh.removeKey(record.key)
+	case opPersist:
+		delete(sh.expiries, record.key)
+	}
+}
+
+// Empty the shard, keeping its limit
+func (sh *shard) reset() {
+	sh.data = make(map[string]string)
+	sh.expiries = make(map[string]time.Time)
+	sh.expiryQueue = nil
+	sh.index = newKeyIndex()
+	atomic.AddInt64(&sh.memory.used, -sh.usedMemory)
+	sh.usedMemory = 0
+	sh.rebuildEvictor()
+}
+
+// Record a change before it is applied, a no-op without persistence
+func (sh *shard) appendLog(record logRecord) error {
+	if sh.wal == nil {
+		return nil
+	}
+	return sh.wal.append(record)
+}
+
+// Called by the monitor after a write has been acknowledged. The log is shared
+// so the snapshot is taken by the DataStore, we just ask for one.
+func (sh *shard) compactLog() {
+	if sh.wal == nil || sh.compactSize <= 0 || sh.wal.currentSize() < sh.compactSize {
+		return
+	}
+
+	select {
+	case sh.compactRequests <- struct{}{}:
+	default:
+		// Already asked
+	}
+}
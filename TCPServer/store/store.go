@@ -1,134 +1,238 @@
-package store
-
-import (
-	"errors"
-)
-
-var (
-	// Errors
-	ErrKeyNotFound = errors.New("Unknown key")
-	ErrBadData     = errors.New("Bad Data")
-)
-
-type StoreMessage struct {
-	responseChannel chan interface{} // dynamic channel type for responding to messages
-	data            interface{}
-}
-
-// Make a little more prettier
-func NewStoreMessage(channel chan interface{}, data interface{}) StoreMessage {
-	smsg := StoreMessage{
-		responseChannel: channel,
-		data:            data,
-	}
-	return smsg
-}
-
-func (ds *DataStore) T() bool {
-	return true
-}
-
-type DataStore struct {
-	putChannel    chan StoreMessage
-	deleteChannel chan StoreMessage
-	getChannel    chan StoreMessage
-	doneChannel   chan bool
-	data          map[string]string
-}
-
-func NewDataStore() *DataStore {
-
-	cache := DataStore{
-		putChannel:    make(chan StoreMessage),
-		deleteChannel: make(chan StoreMessage),
-		getChannel:    make(chan StoreMessage),
-		doneChannel:   make(chan bool),
-		data:          make(map[string]string),
-	}
-
-	go cache.monitor()
-	return &cache
-}
-
-func (ds *DataStore) monitor() {
-	process := true
-
-	for process {
-		select {
-		case msg := <-ds.putChannel:
-			defer close(msg.responseChannel)
-			msg.responseChannel <- ds.put(msg.data)
-		case msg := <-ds.deleteChannel:
-			defer close(msg.responseChannel)
-			msg.responseChannel <- ds.delete(msg.data)
-		case msg := <-ds.getChannel:
-			defer close(msg.responseChannel)
-			msg.responseChannel <- ds.get(msg.data)
-		case <-ds.doneChannel:
-			process = false
-		}
-	}
-}
-
-func (ds *DataStore) Put(msg StoreMessage) {
-	ds.putChannel <- msg
-}
-
-func (ds *DataStore) Delete(msg StoreMessage) {
-	ds.deleteChannel <- msg
-}
-
-func (ds *DataStore) Get(msg StoreMessage) {
-	ds.getChannel <- msg
-}
-
-func (ds *DataStore) put(data interface{}) error {
-
-	kv, ok := data.([]string)
-	if !ok {
-		return ErrBadData
-	}
-
-	key := kv[0]
-	value := kv[1]
-
-	ds.data[key] = value
-	return nil
-}
-
-type GetContents struct {
-	Value string
-	Err   error
-}
-
-func (ds *DataStore) get(data interface{}) GetContents {
-
-	key, ok := data.(string)
-	if !ok {
-		return GetContents{Value: "", Err: ErrBadData}
-	}
-
-	value, ok := ds.data[key]
-	if !ok {
-		return GetContents{Value: "", Err: ErrKeyNotFound}
-	}
-
-	return GetContents{Value: value, Err: nil}
-}
-
-func (ds *DataStore) delete(data interface{}) error {
-
-	key, ok := data.(string)
-	if !ok {
-		return ErrBadData
-	}
-
-	_, contains := ds.data[key]
-
-	if !contains {
-		return ErrKeyNotFound
-	}
-
-	delete(ds.data, key)
-	return nil
-}
+package store
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	// Errors
+	ErrKeyNotFound = errors.New("Unknown key")
+	ErrBadData     = errors.New("Bad Data")
+)
+
+type storeMessage struct {
+	responseChannel chan interface{} // dynamic channel type for responding to messages
+	data            interface{}
+}
+
+// Make a little more prettier
+func newStoreMessage(channel chan interface{}, data interface{}) storeMessage {
+	smsg := storeMessage{
+		responseChannel: channel,
+		data:            data,
+	}
+	return smsg
+}
+
+func (ds *DataStore) T() bool {
+	return true
+}
+
+// Everything a DataServer needs from a store, so other backends and test
+// doubles can stand in for DataStore. Calls return ctx.Err() if ctx is done
+// before the store takes the request, in which case nothing was written. Once
+// taken, a call waits for the answer.
+type Store interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(ctx context.Context, key, value string) error
+	PutWithExpiry(ctx context.Context, key, value string, expiry time.Time) error
+	Delete(ctx context.Context, key string) error
+	TTL(ctx context.Context, key string) (time.Time, error) // zero time if the key never expires
+	Persist(ctx context.Context, key string) error
+	Stats(ctx context.Context) (StoreStats, error)
+
+	// Conditional puts fail with ErrConditionFailed and write nothing
+	CompareAndSwap(ctx context.Context, key, expected, value string) error
+	PutIfAbsent(ctx context.Context, key, value string) error
+	PutIfExists(ctx context.Context, key, value string) error
+
+	// Fails with ErrNotInteger or ErrOverflow and leaves the value alone
+	Increment(ctx context.Context, key string, delta int64) (int64, time.Time, error)
+
+	// A page of matching keys and the cursor for the next, "" once done
+	Scan(ctx context.Context, cursor, pattern string, count int) ([]string, string, error)
+
+	// Entries with keys from start to end inclusive, "" leaves a side open
+	Range(ctx context.Context, start, end string, limit int) ([]KeyValue, error)
+	ReverseRange(ctx context.Context, start, end string, limit int) ([]KeyValue, error)
+
+	// Batches are applied as one operation, nothing else sees one half done
+	GetMany(ctx context.Context, keys []string) (map[string]string, error)
+	PutMany(ctx context.Context, entries []KeyValue) error
+	DeleteMany(ctx context.Context, keys []string) (int, error)
+
+	Close() error
+}
+
+var _ Store = (*DataStore)(nil)
+
+type DataStore struct {
+	shards []*shard
+	memory *memoryUsage // shared by the shards
+
+	// Persistence, unused until EnablePersistence is called
+	dataDir         string
+	options         PersistenceOptions
+	wal             *writeAheadLog
+	compactRequests chan struct{}
+	snapshotStop    chan struct{}
+	snapshotWait    sync.WaitGroup
+}
+
+// A store with a single shard, every request goes through one monitor
+func NewDataStore() *DataStore {
+	return NewShardedDataStore(1)
+}
+
+// Keys are hash partitioned over n shards, each with its own monitor
+// goroutine, so requests for different keys don't queue up behind each other
+func NewShardedDataStore(n int) *DataStore {
+	if n < 1 {
+		n = 1
+	}
+
+	cache := DataStore{
+		shards:          make([]*shard, n),
+		memory:          &memoryUsage{},
+		compactRequests: make(chan struct{}, 1),
+	}
+
+	for i := range cache.shards {
+		cache.shards[i] = newShard(cache.compactRequests, cache.memory)
+		go cache.shards[i].monitor()
+	}
+
+	return &cache
+}
+
+// The shard owning key
+func (ds *DataStore) shardFor(key string) *shard {
+	return ds.shards[ds.shardIndex(key)]
+}
+
+// How many shards the store is split into, for callers that want to line
+// their own locking up with them
+func (ds *DataStore) Shards() int {
+	return len(ds.shards)
+}
+
+// Index of the shard owning key, from 0 to Shards()-1
+func (ds *DataStore) ShardIndex(key string) int {
+	return ds.shardIndex(key)
+}
+
+func (ds *DataStore) shardIndex(key string) int {
+	if len(ds.shards) == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(ds.shards)))
+}
+
+// Send a request to a shard and wait for the answer, giving up if ctx is done
+// before the shard takes it. Once taken a write is going to happen, so we
+// wait for it rather than have the caller think it failed. Shards never sit
+// on a request they've taken for long.
+func request(ctx context.Context, channel chan storeMessage, data interface{}) (interface{}, error) {
+	responseChannel := make(chan interface{}, 1)
+
+	select {
+	case channel <- newStoreMessage(responseChannel, data):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return <-responseChannel, nil
+}
+
+// Like request for calls that only answer with an error
+func requestErr(ctx context.Context, channel chan storeMessage, data interface{}) error {
+	result, err := request(ctx, channel, data)
+	if err != nil {
+		return err
+	}
+	err, _ = result.(error)
+	return err
+}
+
+func (ds *DataStore) Get(ctx context.Context, key string) (string, error) {
+	result, err := request(ctx, ds.shardFor(key).getChannel, key)
+	if err != nil {
+		return "", err
+	}
+
+	contents := result.(getContents)
+	return contents.Value, contents.Err
+}
+
+func (ds *DataStore) Put(ctx context.Context, key, value string) error {
+	return ds.put(ctx, key, []string{key, value})
+}
+
+// Every kind of put goes through the shard's put, trying again with room
+// from the other shards if its own couldn't make enough
+func (ds *DataStore) put(ctx context.Context, key string, data interface{}) error {
+	err := requestErr(ctx, ds.shardFor(key).putChannel, data)
+	if err == errNeedRoom {
+		err = ds.withRoom(ctx, key, func(sh *shard) error {
+			return sh.put(data)
+		})
+	}
+	return err
+}
+
+func (ds *DataStore) Delete(ctx context.Context, key string) error {
+	return requestErr(ctx, ds.shardFor(key).deleteChannel, key)
+}
+
+// Stop every shard in turn and hand back a function that starts them again.
+// While paused nothing else touches shard state, so the caller can work on all
+// of it at once.
+func (ds *DataStore) pauseAll() func() {
+	release := make(chan struct{})
+
+	for _, sh := range ds.shards {
+		responseChannel := make(chan interface{})
+		sh.pauseChannel <- newStoreMessage(responseChannel, release)
+		<-responseChannel
+	}
+
+	return func() {
+		close(release)
+	}
+}
+
+// Stop the monitor goroutines, nothing should use the store after this. When
+// persistence is enabled a final snapshot is written first.
+func (ds *DataStore) Close() error {
+	var err error
+
+	if ds.dataDir != "" {
+		close(ds.snapshotStop)
+		ds.snapshotWait.Wait()
+		err = ds.SaveSnapshot(ds.dataDir)
+	}
+
+	for _, sh := range ds.shards {
+		sh.doneChannel <- true
+	}
+
+	if ds.wal != nil {
+		if walErr := ds.wal.close(); err == nil {
+			err = walErr
+		}
+	}
+
+	return err
+}
+
+type getContents struct {
+	Value string
+	Err   error
+}
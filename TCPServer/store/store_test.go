@@ -1,113 +1,1186 @@
-package store_test
-
-import (
-	"store"
-	"testing"
-)
-
-
-func TestAddEntry(t *testing.T) {
-
-	t.Run("AddNewSuccessful", func(t *testing.T) {
-		dataStore := store.NewDataStore() // setup
-
-		testAdd(t, dataStore, []string{"1", "Apple"}, nil) // test
-		
-		dataStore = nil // cleanup
-	})
-
-	t.Run("AddUpdateAuthorized", func(t *testing.T) {
-		dataStore := store.NewDataStore()
-		
-		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
-		testAdd(t, dataStore, []string{"1", "Banana"}, nil)
-		
-		dataStore = nil
-	})
-}
-
-func TestDeleteEntry(t *testing.T) {
-
-	t.Run("DeleteSuccessful", func(t *testing.T) {
-		dataStore := store.NewDataStore()
-		
-		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
-		testDelete(t, dataStore, "1", nil)
-		
-		dataStore = nil
-	})
-
-	t.Run("DeleteKeyNotFound", func(t *testing.T) {
-		dataStore := store.NewDataStore()
-		
-		testDelete(t, dataStore, "1", store.ErrKeyNotFound)
-		
-		dataStore = nil
-	})
-}
-
-func TestGetEntry(t *testing.T) {
-
-	t.Run("GetKeyExists", func(t *testing.T) {
-		expectedResults := store.GetContents{Value: "Apple", Err: nil}
-		dataStore := store.NewDataStore()
-		
-		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
-		testGet(t, dataStore, "1", expectedResults)
-		
-		dataStore = nil
-	})
-
-	t.Run("GetKeyNotFound", func(t *testing.T) {
-		expectedResults := store.GetContents{Value: "", Err: store.ErrKeyNotFound}
-		dataStore := store.NewDataStore()
-
-		testGet(t, dataStore, "1", expectedResults)
-		
-		dataStore = nil
-	})
-}
-
-
-
-// Helper functions
-
-func testAdd(t *testing.T, dataStore *store.DataStore, data []string, expected error) {
-
-	testChan := make(chan interface{})
-	msg := store.NewStoreMessage(testChan, data)
-	dataStore.Put(msg)
-	result := <-testChan
-
-	if result != expected {
-		t.Error("Expected error : ", expected, " Actual error: ", result)
-	}
-}
-
-func testDelete(t *testing.T, dataStore *store.DataStore, key string, expected error) {
-	testChan := make(chan interface{})
-	msg := store.NewStoreMessage(testChan, key)
-	dataStore.Delete(msg)
-	result := <-testChan
-
-	if result != expected {
-		t.Error("Expected error: ", expected, " Actual error: ", result)
-	}
-}
-
-func testGet(t *testing.T, dataStore *store.DataStore, key string, expected store.GetContents) {
-	testChan := make(chan interface{})
-	msg := store.NewStoreMessage(testChan, key)
-	dataStore.Get(msg)
-	result := <-testChan
-
-	actualResults, ok := result.(store.GetContents)
-	if !ok {
-		t.Error("Returned type is not what we expected")
-		return
-	}
-
-	if actualResults != expected {
-		t.Error("Expected results: ", expected, " Actual results: ", actualResults)
-	}
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"store"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+func TestAddEntry(t *testing.T) {
+
+	t.Run("AddNewSuccessful", func(t *testing.T) {
+		dataStore := store.NewDataStore() // setup
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil) // test
+		
+		dataStore = nil // cleanup
+	})
+
+	t.Run("AddUpdateAuthorized", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"1", "Banana"}, nil)
+		
+		dataStore = nil
+	})
+}
+
+func TestDeleteEntry(t *testing.T) {
+
+	t.Run("DeleteSuccessful", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testDelete(t, dataStore, "1", nil)
+		
+		dataStore = nil
+	})
+
+	t.Run("DeleteKeyNotFound", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		
+		testDelete(t, dataStore, "1", store.ErrKeyNotFound)
+		
+		dataStore = nil
+	})
+}
+
+func TestGetEntry(t *testing.T) {
+
+	t.Run("GetKeyExists", func(t *testing.T) {
+		expectedResults := getContents{Value: "Apple", Err: nil}
+		dataStore := store.NewDataStore()
+		
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testGet(t, dataStore, "1", expectedResults)
+		
+		dataStore = nil
+	})
+
+	t.Run("GetEmptyValue", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAdd(t, dataStore, []string{"1", ""}, nil)
+		testGet(t, dataStore, "1", getContents{Value: "", Err: nil})
+	})
+
+	t.Run("GetKeyNotFound", func(t *testing.T) {
+		expectedResults := getContents{Value: "", Err: store.ErrKeyNotFound}
+		dataStore := store.NewDataStore()
+
+		testGet(t, dataStore, "1", expectedResults)
+		
+		dataStore = nil
+	})
+}
+
+
+
+func TestContext(t *testing.T) {
+
+	t.Run("TimeoutWhileStoreBusy", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		// The store is paused until the snapshot writer returns
+		blocked := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+		go dataStore.Snapshot(blocked)
+		defer close(blocked.release)
+		<-blocked.started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := dataStore.Put(ctx, "1", "Apple"); err != context.DeadlineExceeded {
+			t.Error("Expected error: ", context.DeadlineExceeded, " Actual error: ", err)
+		}
+	})
+
+	t.Run("WorksAfterCancelledRequest", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		dataStore.Get(ctx, "1")
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+
+	t.Run("SnapshotRestoreSuccessful", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Banana"}, nil)
+
+		var buffer bytes.Buffer
+		if err := dataStore.Snapshot(&buffer); err != nil {
+			t.Fatal("Snapshot failed: ", err)
+		}
+
+		restored := store.NewDataStore()
+		testAdd(t, restored, []string{"3", "Cherry"}, nil)
+
+		if err := restored.Restore(&buffer); err != nil {
+			t.Fatal("Restore failed: ", err)
+		}
+
+		testGet(t, restored, "1", getContents{Value: "Apple", Err: nil})
+		testGet(t, restored, "2", getContents{Value: "Banana", Err: nil})
+		testGet(t, restored, "3", getContents{Value: "", Err: store.ErrKeyNotFound})
+	})
+
+	t.Run("RestoreCorruptSnapshot", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+
+		if err := dataStore.Restore(strings.NewReader("not a snapshot")); err == nil {
+			t.Error("Expected restoring garbage to fail")
+		}
+
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+	})
+
+	t.Run("PersistenceSurvivesRestart", func(t *testing.T) {
+		dir := t.TempDir()
+
+		dataStore := store.NewDataStore()
+		if err := dataStore.EnablePersistence(dir, store.PersistenceOptions{SnapshotInterval: time.Hour}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+
+		if err := dataStore.Close(); err != nil {
+			t.Fatal("Close failed: ", err)
+		}
+
+		restarted := store.NewDataStore()
+		if err := restarted.EnablePersistence(dir, store.PersistenceOptions{SnapshotInterval: time.Hour}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testGet(t, restarted, "1", getContents{Value: "Apple", Err: nil})
+	})
+}
+
+func TestWriteAheadLog(t *testing.T) {
+
+	t.Run("LogReplayedAfterCrash", func(t *testing.T) {
+		dir := t.TempDir()
+
+		dataStore := store.NewDataStore()
+		if err := dataStore.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncAlways}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Banana"}, nil)
+		testAdd(t, dataStore, []string{"3", ""}, nil)
+		testDelete(t, dataStore, "1", nil)
+
+		// No Close, so no snapshot, everything has to come from the log
+		restarted := store.NewDataStore()
+		if err := restarted.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncAlways}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testGet(t, restarted, "1", getContents{Value: "", Err: store.ErrKeyNotFound})
+		testGet(t, restarted, "2", getContents{Value: "Banana", Err: nil})
+		testGet(t, restarted, "3", getContents{Value: "", Err: nil})
+	})
+
+	t.Run("TornRecordTruncated", func(t *testing.T) {
+		dir := t.TempDir()
+
+		dataStore := store.NewDataStore()
+		if err := dataStore.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncNever}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+
+		path := filepath.Join(dir, "store.wal")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal("Log missing: ", err)
+		}
+
+		// Half a record, as if we crashed mid write
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		_, _ = file.Write([]byte{0x20, 0, 0, 0, 1, 2})
+		file.Close()
+
+		restarted := store.NewDataStore()
+		if err := restarted.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncNever}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testGet(t, restarted, "1", getContents{Value: "Apple", Err: nil})
+
+		truncated, _ := os.Stat(path)
+		if truncated.Size() != info.Size() {
+			t.Error("Expected log size: ", info.Size(), " Actual log size: ", truncated.Size())
+		}
+	})
+
+	t.Run("LogCompacted", func(t *testing.T) {
+		dir := t.TempDir()
+
+		dataStore := store.NewDataStore()
+		if err := dataStore.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncNever, CompactSize: 100}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		for i := 0; i < 20; i++ {
+			testAdd(t, dataStore, []string{"key", strings.Repeat("v", i)}, nil)
+		}
+
+		// Compaction runs in the background after the ack
+		deadline := time.Now().Add(5 * time.Second)
+		info, _ := os.Stat(filepath.Join(dir, "store.wal"))
+		for info.Size() >= 100 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			info, _ = os.Stat(filepath.Join(dir, "store.wal"))
+		}
+		if info.Size() >= 100 {
+			t.Error("Expected the log to be compacted, size: ", info.Size())
+		}
+
+		restarted := store.NewDataStore()
+		if err := restarted.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncNever}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testGet(t, restarted, "key", getContents{Value: strings.Repeat("v", 19), Err: nil})
+	})
+}
+
+func TestExpiry(t *testing.T) {
+
+	t.Run("ExpiredKeyNotFound", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAddExpiring(t, dataStore, "1", "Apple", time.Now().Add(-time.Second))
+
+		testGet(t, dataStore, "1", getContents{Value: "", Err: store.ErrKeyNotFound})
+		testDelete(t, dataStore, "1", store.ErrKeyNotFound)
+	})
+
+	t.Run("ExpiredKeyNotCounted", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAddExpiring(t, dataStore, "2", "Banana", time.Now().Add(-time.Second))
+		testAddExpiring(t, dataStore, "3", "Cherry", time.Now().Add(time.Hour))
+
+		// The sweeper hasn't been round yet, but get would already miss "2"
+		stats, _ := dataStore.Stats(context.Background())
+		if stats.Keys != 2 || stats.UsedMemory != 13 {
+			t.Error("Expected 2 keys using 13 bytes, Actual stats: ", stats)
+		}
+	})
+
+	t.Run("ExpiryChangedBeforeItPassed", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		soon := time.Now().Add(50 * time.Millisecond)
+
+		testAddExpiring(t, dataStore, "1", "Apple", soon)
+		testAddExpiring(t, dataStore, "2", "Banana", soon)
+		testAddExpiring(t, dataStore, "3", "Cherry", soon)
+
+		// Only "3" still expires when it was going to
+		dataStore.Persist(context.Background(), "1")
+		testAddExpiring(t, dataStore, "2", "Banana", time.Now().Add(time.Hour))
+
+		time.Sleep(100 * time.Millisecond)
+
+		stats, _ := dataStore.Stats(context.Background())
+		if stats.Keys != 2 {
+			t.Error("Expected 2 keys, Actual stats: ", stats)
+		}
+		testGet(t, dataStore, "2", getContents{Value: "Banana", Err: nil})
+	})
+
+	t.Run("TTLBeforeExpiry", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		expiry := time.Now().Add(time.Hour)
+
+		testAddExpiring(t, dataStore, "1", "Apple", expiry)
+
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+		testTTL(t, dataStore, "1", expiry, nil)
+	})
+
+	t.Run("TTLKeyNotFound", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testTTL(t, dataStore, "1", time.Time{}, store.ErrKeyNotFound)
+	})
+
+	t.Run("PutClearsExpiry", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAddExpiring(t, dataStore, "1", "Apple", time.Now().Add(time.Hour))
+		testAdd(t, dataStore, []string{"1", "Banana"}, nil)
+
+		testTTL(t, dataStore, "1", time.Time{}, nil)
+	})
+
+	t.Run("PersistRemovesExpiry", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAddExpiring(t, dataStore, "1", "Apple", time.Now().Add(time.Hour))
+
+		if result := dataStore.Persist(context.Background(), "1"); result != nil {
+			t.Error("Expected error: ", nil, " Actual error: ", result)
+		}
+
+		testTTL(t, dataStore, "1", time.Time{}, nil)
+	})
+
+	t.Run("ExpirySurvivesRestart", func(t *testing.T) {
+		dir := t.TempDir()
+		expiry := time.Now().Add(time.Hour)
+
+		dataStore := store.NewDataStore()
+		if err := dataStore.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncNever}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testAddExpiring(t, dataStore, "1", "Apple", expiry)
+		testAddExpiring(t, dataStore, "2", "Banana", time.Now().Add(-time.Second))
+
+		restarted := store.NewDataStore()
+		if err := restarted.EnablePersistence(dir, store.PersistenceOptions{SyncPolicy: store.SyncNever}); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testTTL(t, restarted, "1", expiry, nil)
+		testGet(t, restarted, "2", getContents{Value: "", Err: store.ErrKeyNotFound})
+	})
+}
+
+func TestEviction(t *testing.T) {
+
+	// Every entry below is 6 bytes so a 12 byte limit holds two of them
+	const limit = 12
+
+	t.Run("EvictLeastRecentlyUsed", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: limit, Policy: store.EvictLRU})
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Mango"}, nil)
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+		testAdd(t, dataStore, []string{"3", "Peach"}, nil)
+
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+		testGet(t, dataStore, "2", getContents{Value: "", Err: store.ErrKeyNotFound})
+		testGet(t, dataStore, "3", getContents{Value: "Peach", Err: nil})
+
+		if stats, _ := dataStore.Stats(context.Background()); stats.Evictions != 1 || stats.UsedMemory != limit {
+			t.Error("Expected 1 eviction using ", limit, " bytes, Actual stats: ", stats)
+		}
+	})
+
+	t.Run("EvictLeastFrequentlyUsed", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: limit, Policy: store.EvictLFU})
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Mango"}, nil)
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+		testGet(t, dataStore, "2", getContents{Value: "Mango", Err: nil})
+		testAdd(t, dataStore, []string{"3", "Peach"}, nil)
+
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+		testGet(t, dataStore, "2", getContents{Value: "", Err: store.ErrKeyNotFound})
+	})
+
+	t.Run("EvictRandom", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: limit, Policy: store.EvictRandom})
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Mango"}, nil)
+		testAdd(t, dataStore, []string{"3", "Peach"}, nil)
+
+		testGet(t, dataStore, "3", getContents{Value: "Peach", Err: nil})
+
+		if stats, _ := dataStore.Stats(context.Background()); stats.Keys != 2 || stats.Evictions != 1 {
+			t.Error("Expected 2 keys after 1 eviction, Actual stats: ", stats)
+		}
+	})
+
+	t.Run("RejectWrites", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: limit, Policy: store.EvictReject})
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Mango"}, nil)
+		testAdd(t, dataStore, []string{"3", "Peach"}, store.ErrOutOfMemory)
+
+		// Overwriting with something the same size still fits
+		testAdd(t, dataStore, []string{"2", "Lemon"}, nil)
+
+		if stats, _ := dataStore.Stats(context.Background()); stats.Rejections != 1 || stats.Evictions != 0 {
+			t.Error("Expected 1 rejection and no evictions, Actual stats: ", stats)
+		}
+	})
+
+	t.Run("ValueLargerThanLimit", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: limit, Policy: store.EvictLRU})
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", strings.Repeat("v", limit)}, store.ErrOutOfMemory)
+
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+	})
+
+	t.Run("LoweringLimitEvicts", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		testAdd(t, dataStore, []string{"2", "Mango"}, nil)
+		testAdd(t, dataStore, []string{"3", "Peach"}, nil)
+
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: limit, Policy: store.EvictLRU})
+
+		if stats, _ := dataStore.Stats(context.Background()); stats.Keys != 2 || stats.UsedMemory > limit {
+			t.Error("Expected the store to be evicted down to the limit, Actual stats: ", stats)
+		}
+	})
+}
+
+func TestShardedStore(t *testing.T) {
+
+	t.Run("KeysSpreadOverShards", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+
+		for i := 0; i < 100; i++ {
+			testAdd(t, dataStore, []string{strconv.Itoa(i), "Apple"}, nil)
+		}
+		for i := 0; i < 100; i++ {
+			testGet(t, dataStore, strconv.Itoa(i), getContents{Value: "Apple", Err: nil})
+		}
+		testDelete(t, dataStore, "50", nil)
+		testGet(t, dataStore, "50", getContents{Value: "", Err: store.ErrKeyNotFound})
+
+		stats, _ := dataStore.Stats(context.Background())
+		if stats.Keys != 99 {
+			t.Error("Expected keys: ", 99, " Actual keys: ", stats.Keys)
+		}
+	})
+
+	t.Run("SnapshotToDifferentShardCount", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		for i := 0; i < 20; i++ {
+			testAdd(t, dataStore, []string{strconv.Itoa(i), "Apple"}, nil)
+		}
+
+		var buffer bytes.Buffer
+		if err := dataStore.Snapshot(&buffer); err != nil {
+			t.Fatal("Snapshot failed: ", err)
+		}
+
+		restored := store.NewShardedDataStore(3)
+		if err := restored.Restore(&buffer); err != nil {
+			t.Fatal("Restore failed: ", err)
+		}
+		for i := 0; i < 20; i++ {
+			testGet(t, restored, strconv.Itoa(i), getContents{Value: "Apple", Err: nil})
+		}
+	})
+
+	t.Run("MemoryLimitSharedByShards", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		if err := dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 100, Policy: store.EvictLRU}); err != nil {
+			t.Fatal("Failed to set limit: ", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			testAdd(t, dataStore, []string{fmt.Sprintf("%03d", i), "Apple"}, nil)
+		}
+
+		stats, _ := dataStore.Stats(context.Background())
+		if stats.MaxMemory != 100 {
+			t.Error("Expected max memory: ", 100, " Actual max memory: ", stats.MaxMemory)
+		}
+		if stats.UsedMemory > 100 {
+			t.Error("Expected used memory under: ", 100, " Actual used memory: ", stats.UsedMemory)
+		}
+		if stats.Evictions == 0 {
+			t.Error("Expected evictions, Actual evictions: ", stats.Evictions)
+		}
+	})
+
+	t.Run("EntryBiggerThanAShard", func(t *testing.T) {
+		// Well over a quarter of the limit, but it fits the store
+		big := strings.Repeat("v", 60)
+
+		for _, policy := range []store.EvictionPolicy{store.EvictLRU, store.EvictReject} {
+			dataStore := store.NewShardedDataStore(4)
+			dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 100, Policy: policy})
+
+			testAdd(t, dataStore, []string{"big", big}, nil)
+			testGet(t, dataStore, "big", getContents{Value: big, Err: nil})
+		}
+	})
+
+	t.Run("EvictsFromOtherShards", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 100, Policy: store.EvictLRU})
+
+		// 60 bytes spread over the shards, the big one can only fit if keys
+		// go from shards other than its own
+		for i := 0; i < 10; i++ {
+			testAdd(t, dataStore, []string{strconv.Itoa(i), "Apple"}, nil)
+		}
+
+		big := strings.Repeat("v", 90)
+		testAdd(t, dataStore, []string{"big", big}, nil)
+		testGet(t, dataStore, "big", getContents{Value: big, Err: nil})
+
+		if n, _, _ := dataStore.Increment(context.Background(), "counter", 1); n != 1 {
+			t.Error("Expected: 1 Actual: ", n)
+		}
+
+		batch := []store.KeyValue{{Key: "a", Value: strings.Repeat("v", 40)}, {Key: "b", Value: strings.Repeat("v", 40)}}
+		if err := dataStore.PutMany(context.Background(), batch); err != nil {
+			t.Error("Expected: <nil> Actual: ", err)
+		}
+
+		stats, _ := dataStore.Stats(context.Background())
+		if stats.UsedMemory > 100 || stats.Rejections != 0 {
+			t.Error("Expected under 100 bytes and no rejections, Actual stats: ", stats)
+		}
+	})
+
+	t.Run("LoweringLimitEvictsAcrossShards", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		for i := 0; i < 20; i++ {
+			testAdd(t, dataStore, []string{fmt.Sprintf("%03d", i), "Apple"}, nil)
+		}
+
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 40, Policy: store.EvictLRU})
+
+		stats, _ := dataStore.Stats(context.Background())
+		if stats.UsedMemory > 40 || stats.Keys != 5 {
+			t.Error("Expected 5 keys in 40 bytes, Actual stats: ", stats)
+		}
+	})
+}
+
+func TestConditionalPut(t *testing.T) {
+
+	t.Run("PutIfAbsent", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		ctx := context.Background()
+
+		if err := dataStore.PutIfAbsent(ctx, "1", "Apple"); err != nil {
+			t.Error("Expected error: ", nil, " Actual error: ", err)
+		}
+		if err := dataStore.PutIfAbsent(ctx, "1", "Banana"); err != store.ErrConditionFailed {
+			t.Error("Expected error: ", store.ErrConditionFailed, " Actual error: ", err)
+		}
+
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+	})
+
+	t.Run("PutIfExists", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		ctx := context.Background()
+
+		if err := dataStore.PutIfExists(ctx, "1", "Apple"); err != store.ErrConditionFailed {
+			t.Error("Expected error: ", store.ErrConditionFailed, " Actual error: ", err)
+		}
+		testGet(t, dataStore, "1", getContents{Value: "", Err: store.ErrKeyNotFound})
+
+		testAdd(t, dataStore, []string{"1", ""}, nil)
+		if err := dataStore.PutIfExists(ctx, "1", "Apple"); err != nil {
+			t.Error("Expected error: ", nil, " Actual error: ", err)
+		}
+		testGet(t, dataStore, "1", getContents{Value: "Apple", Err: nil})
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		ctx := context.Background()
+
+		if err := dataStore.CompareAndSwap(ctx, "1", "", "Apple"); err != store.ErrConditionFailed {
+			t.Error("Expected error: ", store.ErrConditionFailed, " Actual error: ", err)
+		}
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		if err := dataStore.CompareAndSwap(ctx, "1", "Mango", "Banana"); err != store.ErrConditionFailed {
+			t.Error("Expected error: ", store.ErrConditionFailed, " Actual error: ", err)
+		}
+		if err := dataStore.CompareAndSwap(ctx, "1", "Apple", "Banana"); err != nil {
+			t.Error("Expected error: ", nil, " Actual error: ", err)
+		}
+		testGet(t, dataStore, "1", getContents{Value: "Banana", Err: nil})
+	})
+
+	t.Run("ExpiredKeyIsAbsent", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		ctx := context.Background()
+
+		dataStore.PutWithExpiry(ctx, "1", "Apple", time.Now().Add(-time.Second))
+
+		if err := dataStore.CompareAndSwap(ctx, "1", "Apple", "Banana"); err != store.ErrConditionFailed {
+			t.Error("Expected error: ", store.ErrConditionFailed, " Actual error: ", err)
+		}
+		if err := dataStore.PutIfAbsent(ctx, "1", "Banana"); err != nil {
+			t.Error("Expected error: ", nil, " Actual error: ", err)
+		}
+	})
+
+	t.Run("OneWinnerUnderContention", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		testAdd(t, dataStore, []string{"counter", "0"}, nil)
+
+		// Each round everyone tries to move the counter on from the same value
+		var wait sync.WaitGroup
+		var mutex sync.Mutex
+		wins := 0
+		for i := 0; i < 10; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for round := 0; round < 50; round++ {
+					if dataStore.CompareAndSwap(context.Background(), "counter", strconv.Itoa(round), strconv.Itoa(round+1)) == nil {
+						mutex.Lock()
+						wins++
+						mutex.Unlock()
+					}
+				}
+			}()
+		}
+		wait.Wait()
+
+		value, _ := dataStore.Get(context.Background(), "counter")
+		if strconv.Itoa(wins) != value {
+			t.Error("Expected counter: ", wins, " Actual counter: ", value)
+		}
+	})
+}
+
+func TestIncrement(t *testing.T) {
+
+	t.Run("IncrementFromMissing", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testIncrement(t, dataStore, "1", 5, 5, nil)
+		testIncrement(t, dataStore, "1", -7, -2, nil)
+		testGet(t, dataStore, "1", getContents{Value: "-2", Err: nil})
+	})
+
+	t.Run("NotAnInteger", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		for _, value := range []string{"Apple", "", "1.5", "99999999999999999999"} {
+			testAdd(t, dataStore, []string{"1", value}, nil)
+			testIncrement(t, dataStore, "1", 1, 0, store.ErrNotInteger)
+			testGet(t, dataStore, "1", getContents{Value: value, Err: nil})
+		}
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAdd(t, dataStore, []string{"1", strconv.FormatInt(math.MaxInt64, 10)}, nil)
+		testIncrement(t, dataStore, "1", 1, 0, store.ErrOverflow)
+
+		testAdd(t, dataStore, []string{"1", strconv.FormatInt(math.MinInt64+1, 10)}, nil)
+		testIncrement(t, dataStore, "1", -1, math.MinInt64, nil)
+		testIncrement(t, dataStore, "1", -1, 0, store.ErrOverflow)
+	})
+
+	t.Run("KeepsExpiry", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		expiry := time.Now().Add(time.Hour)
+
+		dataStore.PutWithExpiry(context.Background(), "1", "10", expiry)
+
+		_, kept, err := dataStore.Increment(context.Background(), "1", 1)
+		if err != nil || !kept.Equal(expiry) {
+			t.Error("Expected expiry: ", expiry, " Actual expiry: ", kept, err)
+		}
+
+		if ttl, _ := dataStore.TTL(context.Background(), "1"); !ttl.Equal(expiry) {
+			t.Error("Expected expiry: ", expiry, " Actual expiry: ", ttl)
+		}
+	})
+
+	t.Run("ConcurrentIncrements", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+
+		var wait sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for j := 0; j < 100; j++ {
+					dataStore.Increment(context.Background(), "1", 1)
+				}
+			}()
+		}
+		wait.Wait()
+
+		testGet(t, dataStore, "1", getContents{Value: "1000", Err: nil})
+	})
+}
+
+func TestScan(t *testing.T) {
+
+	t.Run("EveryKeyOnceInOrder", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		for i := 0; i < 500; i++ {
+			testAdd(t, dataStore, []string{fmt.Sprintf("%03d", i), "Apple"}, nil)
+		}
+
+		keys := scanAll(t, dataStore, "", 7)
+		if len(keys) != 500 {
+			t.Fatal("Expected keys: ", 500, " Actual keys: ", len(keys))
+		}
+		for i, key := range keys {
+			if key != fmt.Sprintf("%03d", i) {
+				t.Fatal("Expected key: ", fmt.Sprintf("%03d", i), " Actual key: ", key)
+			}
+		}
+	})
+
+	t.Run("PrefixAndGlob", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		for _, key := range []string{"user:1", "user:2", "user:10", "users", "admin:1", "a*b", "axb"} {
+			testAdd(t, dataStore, []string{key, "Apple"}, nil)
+		}
+
+		tests := []struct {
+			pattern  string
+			expected string
+		}{
+			{"user:*", "[user:1 user:10 user:2]"},
+			{"user:?", "[user:1 user:2]"},
+			{"*:1", "[admin:1 user:1]"},
+			{"*1*", "[admin:1 user:1 user:10]"},
+			{"users", "[users]"},
+			{`a\*b`, "[a*b]"},
+			{"a*b", "[a*b axb]"},
+			{"nobody*", "[]"},
+		}
+
+		for _, test := range tests {
+			if actual := fmt.Sprint(scanAll(t, dataStore, test.pattern, 2)); actual != test.expected {
+				t.Error("Pattern: ", test.pattern, " Expected keys: ", test.expected, " Actual keys: ", actual)
+			}
+		}
+	})
+
+	t.Run("SkipsExpiredKeys", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+		dataStore.PutWithExpiry(context.Background(), "2", "Mango", time.Now().Add(-time.Second))
+
+		if keys := fmt.Sprint(scanAll(t, dataStore, "", 10)); keys != "[1]" {
+			t.Error("Expected keys: ", "[1]", " Actual keys: ", keys)
+		}
+	})
+
+	t.Run("StableWhileWriting", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		for i := 0; i < 200; i++ {
+			testAdd(t, dataStore, []string{fmt.Sprintf("k%03d", i), "Apple"}, nil)
+		}
+
+		// Churn other keys while scanning, the ones above must all turn up once
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("k%03d.%d", i%200, i)
+				dataStore.Put(context.Background(), key, "Mango")
+				dataStore.Delete(context.Background(), key)
+			}
+		}()
+
+		seen := make(map[string]int)
+		for _, key := range scanAll(t, dataStore, "", 3) {
+			seen[key]++
+		}
+		close(done)
+		<-stopped
+
+		for i := 0; i < 200; i++ {
+			if key := fmt.Sprintf("k%03d", i); seen[key] != 1 {
+				t.Error("Expected key once: ", key, " Actual times: ", seen[key])
+			}
+		}
+	})
+}
+
+func TestRange(t *testing.T) {
+
+	dataStore := store.NewShardedDataStore(4)
+	for i := 100; i < 300; i++ {
+		testAdd(t, dataStore, []string{fmt.Sprintf("user:%d", i), strconv.Itoa(i)}, nil)
+	}
+	dataStore.PutWithExpiry(context.Background(), "user:150x", "Gone", time.Now().Add(-time.Second))
+
+	tests := []struct {
+		name     string
+		reverse  bool
+		start    string
+		end      string
+		limit    int
+		expected string
+	}{
+		{"Between", false, "user:100", "user:104", 10, "[user:100 user:101 user:102 user:103 user:104]"},
+		{"Limited", false, "user:150", "user:200", 2, "[user:150 user:151]"},
+		{"OpenStart", false, "", "user:101", 10, "[user:100 user:101]"},
+		{"OpenEnd", false, "user:298", "", 10, "[user:298 user:299]"},
+		{"Reverse", true, "user:100", "user:104", 3, "[user:104 user:103 user:102]"},
+		{"ReverseOpenEnd", true, "", "", 2, "[user:299 user:298]"},
+		{"ReverseOpenStart", true, "", "user:101", 10, "[user:101 user:100]"},
+		{"Empty", false, "user:3", "user:4", 10, "[]"},
+		{"Backwards", false, "user:200", "user:100", 10, "[]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			read := dataStore.Range
+			if test.reverse {
+				read = dataStore.ReverseRange
+			}
+
+			entries, err := read(context.Background(), test.start, test.end, test.limit)
+			if err != nil {
+				t.Fatal("Range failed: ", err)
+			}
+
+			keys := []string{}
+			for _, entry := range entries {
+				keys = append(keys, entry.Key)
+				if entry.Value != strings.TrimPrefix(entry.Key, "user:") {
+					t.Error("Expected value: ", strings.TrimPrefix(entry.Key, "user:"), " Actual value: ", entry.Value)
+				}
+			}
+
+			if fmt.Sprint(keys) != test.expected {
+				t.Error("Expected keys: ", test.expected, " Actual keys: ", keys)
+			}
+		})
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	t.Run("PutGetDeleteMany", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		ctx := context.Background()
+
+		entries := []store.KeyValue{{Key: "1", Value: "Apple"}, {Key: "2", Value: ""}, {Key: "3", Value: "Mango"}}
+		if err := dataStore.PutMany(ctx, entries); err != nil {
+			t.Fatal("PutMany failed: ", err)
+		}
+
+		values, err := dataStore.GetMany(ctx, []string{"1", "2", "4"})
+		if err != nil || len(values) != 2 || values["1"] != "Apple" || values["2"] != "" {
+			t.Error("Expected values: ", "map[1:Apple 2:]", " Actual values: ", values, err)
+		}
+
+		deleted, err := dataStore.DeleteMany(ctx, []string{"1", "3", "4"})
+		if deleted != 2 || err != nil {
+			t.Error("Expected deleted: ", 2, " Actual deleted: ", deleted, err)
+		}
+
+		testGet(t, dataStore, "1", getContents{Value: "", Err: store.ErrKeyNotFound})
+		testGet(t, dataStore, "2", getContents{Value: "", Err: nil})
+	})
+
+	t.Run("PutManyAllOrNothing", func(t *testing.T) {
+		dataStore := store.NewDataStore()
+		dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 12, Policy: store.EvictReject})
+
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+
+		entries := []store.KeyValue{{Key: "2", Value: "Mango"}, {Key: "3", Value: "Peach"}}
+		if err := dataStore.PutMany(context.Background(), entries); err != store.ErrOutOfMemory {
+			t.Error("Expected error: ", store.ErrOutOfMemory, " Actual error: ", err)
+		}
+
+		testGet(t, dataStore, "2", getContents{Value: "", Err: store.ErrKeyNotFound})
+	})
+
+	t.Run("PutManyNeverEvictsItself", func(t *testing.T) {
+		ctx := context.Background()
+
+		// Random picks differently every time, give it plenty of chances
+		for attempt := 0; attempt < 20; attempt++ {
+			dataStore := store.NewShardedDataStore(4)
+			dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: 30, Policy: store.EvictRandom})
+
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				testAdd(t, dataStore, []string{key, "1234"}, nil)
+			}
+
+			var entries []store.KeyValue
+			for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+				entries = append(entries, store.KeyValue{Key: key, Value: "123"})
+			}
+			if err := dataStore.PutMany(ctx, entries); err != nil {
+				t.Fatal("PutMany failed: ", err)
+			}
+
+			values, _ := dataStore.GetMany(ctx, []string{"k1", "k2", "k3", "k4", "k5"})
+			if len(values) != 5 {
+				t.Fatal("Expected the whole batch, Actual values: ", values)
+			}
+		}
+	})
+
+	t.Run("PutManyLoggedAsOne", func(t *testing.T) {
+		dir := t.TempDir()
+		options := store.PersistenceOptions{SyncPolicy: store.SyncNever}
+
+		dataStore := store.NewShardedDataStore(4)
+		if err := dataStore.EnablePersistence(dir, options); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+
+		testAdd(t, dataStore, []string{"0", "Apple"}, nil)
+		entries := []store.KeyValue{{Key: "1", Value: "Banana"}, {Key: "2", Value: "Cherry"}, {Key: "3", Value: "Mango"}}
+		if err := dataStore.PutMany(context.Background(), entries); err != nil {
+			t.Fatal("PutMany failed: ", err)
+		}
+
+		restarted := store.NewShardedDataStore(4)
+		if err := restarted.EnablePersistence(dir, options); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+		testGet(t, restarted, "3", getContents{Value: "Mango", Err: nil})
+
+		// Crashed part way through writing the batch, none of it comes back
+		path := filepath.Join(dir, "store.wal")
+		info, _ := os.Stat(path)
+		if err := os.Truncate(path, info.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+
+		torn := store.NewShardedDataStore(4)
+		if err := torn.EnablePersistence(dir, options); err != nil {
+			t.Fatal("Failed to enable persistence: ", err)
+		}
+		testGet(t, torn, "0", getContents{Value: "Apple", Err: nil})
+		for _, key := range []string{"1", "2", "3"} {
+			testGet(t, torn, key, getContents{Value: "", Err: store.ErrKeyNotFound})
+		}
+	})
+
+	t.Run("BatchesAreAtomic", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+		ctx := context.Background()
+		keys := []string{"1", "2", "3", "4", "5", "6"}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				entries := make([]store.KeyValue, len(keys))
+				for j, key := range keys {
+					entries[j] = store.KeyValue{Key: key, Value: strconv.Itoa(i)}
+				}
+				dataStore.PutMany(ctx, entries)
+			}
+		}()
+
+		// Every read sees all of one batch or all of another, never a mix
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+
+			values, _ := dataStore.GetMany(ctx, keys)
+			for _, key := range keys {
+				if values[key] != values[keys[0]] {
+					t.Fatal("Expected matching values, Actual values: ", values)
+				}
+			}
+		}
+	})
+
+	t.Run("CancelledWhileShardBusy", func(t *testing.T) {
+		dataStore := store.NewShardedDataStore(4)
+
+		blocked := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+		go dataStore.Snapshot(blocked)
+		<-blocked.started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if _, err := dataStore.GetMany(ctx, []string{"1", "2"}); err != context.DeadlineExceeded {
+			t.Error("Expected error: ", context.DeadlineExceeded, " Actual error: ", err)
+		}
+
+		// Nothing is left paused once the snapshot is done
+		close(blocked.release)
+		testAdd(t, dataStore, []string{"1", "Apple"}, nil)
+	})
+}
+
+// One shard is the old single monitor store, compare it with sharded stores
+// under lots of concurrent clients
+func BenchmarkStore(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("Shards%d", shards), func(b *testing.B) {
+			dataStore := store.NewShardedDataStore(shards)
+			defer dataStore.Close()
+
+			for i := 0; i < 1000; i++ {
+				benchmarkAdd(dataStore, strconv.Itoa(i), "Apple")
+			}
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+
+				// Start somewhere different so goroutines don't move in lockstep
+				i := rand.Intn(1000)
+				for pb.Next() {
+					key := strconv.Itoa(i % 1000)
+					if i%4 == 0 {
+						dataStore.Put(ctx, key, "Banana")
+					} else {
+						dataStore.Get(ctx, key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// Helper functions
+
+// What testGet expects back from the store
+type getContents struct {
+	Value string
+	Err   error
+}
+
+// Holds up writes until release is closed, started is closed on the first one
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return len(p), nil
+}
+
+func testAdd(t *testing.T, dataStore *store.DataStore, data []string, expected error) {
+
+	result := dataStore.Put(context.Background(), data[0], data[1])
+
+	if result != expected {
+		t.Error("Expected error : ", expected, " Actual error: ", result)
+	}
+}
+
+func testIncrement(t *testing.T, dataStore *store.DataStore, key string, delta int64, expectedValue int64, expected error) {
+
+	value, _, err := dataStore.Increment(context.Background(), key, delta)
+
+	if err != expected || (err == nil && value != expectedValue) {
+		t.Error("Expected value: ", expectedValue, " Actual value: ", value, " Expected error: ", expected, " Actual error: ", err)
+	}
+}
+
+// Follow the cursor to the end of a scan
+func scanAll(t *testing.T, dataStore *store.DataStore, pattern string, count int) []string {
+	keys := []string{}
+	cursor := ""
+
+	for {
+		page, next, err := dataStore.Scan(context.Background(), cursor, pattern, count)
+		if err != nil {
+			t.Fatal("Scan failed: ", err)
+		}
+		keys = append(keys, page...)
+
+		if next == "" {
+			return keys
+		}
+		cursor = next
+	}
+}
+
+func testDelete(t *testing.T, dataStore *store.DataStore, key string, expected error) {
+	result := dataStore.Delete(context.Background(), key)
+
+	if result != expected {
+		t.Error("Expected error: ", expected, " Actual error: ", result)
+	}
+}
+
+func testGet(t *testing.T, dataStore *store.DataStore, key string, expected getContents) {
+	value, err := dataStore.Get(context.Background(), key)
+
+	actualResults := getContents{Value: value, Err: err}
+	if actualResults != expected {
+		t.Error("Expected results: ", expected, " Actual results: ", actualResults)
+	}
+}
+
+func testAddExpiring(t *testing.T, dataStore *store.DataStore, key, value string, expiry time.Time) {
+	result := dataStore.PutWithExpiry(context.Background(), key, value, expiry)
+
+	if result != nil {
+		t.Error("Expected error: ", nil, " Actual error: ", result)
+	}
+}
+
+func testTTL(t *testing.T, dataStore *store.DataStore, key string, expectedExpiry time.Time, expectedErr error) {
+	expiry, err := dataStore.TTL(context.Background(), key)
+
+	if !expiry.Equal(expectedExpiry) || err != expectedErr {
+		t.Error("Expected results: ", expectedExpiry, expectedErr, " Actual results: ", expiry, err)
+	}
+}
+
+func benchmarkAdd(dataStore *store.DataStore, key, value string) {
+	dataStore.Put(context.Background(), key, value)
 }
\ No newline at end of file
@@ -0,0 +1,391 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	logFile = "store.wal"
+
+	// Record ops
+	opPut         byte = 'p'
+	opPutExpiring byte = 'x'
+	opDelete      byte = 'd'
+	opPersist     byte = 'r'
+	opBatch       byte = 'b' // records applied together, see PutMany
+
+	// Length and checksum in front of every record
+	recordHeaderSize = 8
+)
+
+var ErrBadRecord = errors.New("Bad log record")
+
+// When appended records are forced to disk
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // fsync before every ack
+	SyncInterval                   // fsync in the background every SyncInterval
+	SyncNever                      // leave it to the OS
+)
+
+// Accepts "always", "never" or a duration such as "100ms" for SyncInterval
+func ParseSyncPolicy(s string) (SyncPolicy, time.Duration, error) {
+	switch s {
+	case "always":
+		return SyncAlways, 0, nil
+	case "never":
+		return SyncNever, 0, nil
+	}
+
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval <= 0 {
+		return SyncAlways, 0, fmt.Errorf("invalid fsync policy %q", s)
+	}
+
+	return SyncInterval, interval, nil
+}
+
+type logRecord struct {
+	op     byte
+	key    string
+	value  string
+	expiry int64       // unix nanoseconds, opPutExpiring only
+	batch  []logRecord // opBatch only
+}
+
+// The parts of *os.File the log uses
+type walFile interface {
+	io.Writer
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Append only log of every change made since the last snapshot. Every shard
+// appends to the same log, the mutex keeps their records and the background
+// sync apart.
+type writeAheadLog struct {
+	file   walFile
+	size   int64
+	policy SyncPolicy
+	dirty  bool
+	failed error // set if a failed record couldn't be cut back off, nothing more is appended
+	mutex  sync.Mutex
+	stop   chan struct{}
+	wait   sync.WaitGroup
+}
+
+// Open the log for appending, starting the background sync if the policy
+// needs one. Replay it first, openLog expects to append after the last good
+// record.
+func openLog(path string, policy SyncPolicy, interval time.Duration) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	wal := &writeAheadLog{
+		file:   file,
+		size:   info.Size(),
+		policy: policy,
+		stop:   make(chan struct{}),
+	}
+
+	if policy == SyncInterval {
+		wal.wait.Add(1)
+		go wal.syncEvery(interval)
+	}
+
+	return wal, nil
+}
+
+func (wal *writeAheadLog) append(record logRecord) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	if wal.failed != nil {
+		return wal.failed
+	}
+
+	n, err := wal.file.Write(encodeRecord(record))
+	if err != nil {
+		// Replay stops at the first bad record, so anything appended after
+		// half of this one would be lost
+		if n > 0 {
+			wal.cutBack()
+		}
+		return err
+	}
+
+	if wal.policy == SyncAlways {
+		if err := wal.file.Sync(); err != nil {
+			// The write fails, so it mustn't come back on replay either
+			wal.cutBack()
+			return err
+		}
+		wal.size += int64(n)
+		return nil
+	}
+
+	wal.size += int64(n)
+	wal.dirty = true
+	return nil
+}
+
+// Cut off a record that failed part way, or stop appending if that fails too
+func (wal *writeAheadLog) cutBack() {
+	if err := wal.file.Truncate(wal.size); err != nil {
+		wal.failed = fmt.Errorf("log has a failed record at offset %d: %w", wal.size, err)
+	}
+}
+
+func (wal *writeAheadLog) currentSize() int64 {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	return wal.size
+}
+
+// Throw away everything in the log once a snapshot covers it
+func (wal *writeAheadLog) truncate() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+
+	wal.size = 0
+	wal.dirty = false
+	wal.failed = nil
+	return wal.file.Sync()
+}
+
+func (wal *writeAheadLog) syncEvery(interval time.Duration) {
+	defer wal.wait.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			wal.mutex.Lock()
+			if wal.dirty {
+				if err := wal.file.Sync(); err != nil {
+					log.Println("Log sync failed:", err)
+				}
+				wal.dirty = false
+			}
+			wal.mutex.Unlock()
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+func (wal *writeAheadLog) close() error {
+	close(wal.stop)
+	wal.wait.Wait()
+
+	if err := wal.file.Sync(); err != nil {
+		wal.file.Close()
+		return err
+	}
+	return wal.file.Close()
+}
+
+// Record layout: 4 byte payload length, 4 byte CRC32 of the payload, then the
+// payload itself which is the op, the uvarint key length, the key, an 8 byte
+// expiry for opPutExpiring and the value. An opBatch has no key and its value
+// is the batch's records one after another.
+func encodeRecord(record logRecord) []byte {
+	if record.op == opBatch {
+		var value []byte
+		for _, r := range record.batch {
+			value = append(value, encodeRecord(r)...)
+		}
+		record.value = string(value)
+	}
+
+	varint := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(varint, uint64(len(record.key)))
+
+	payload := make([]byte, 0, 1+n+len(record.key)+8+len(record.value))
+	payload = append(payload, record.op)
+	payload = append(payload, varint[:n]...)
+	payload = append(payload, record.key...)
+	if record.op == opPutExpiring {
+		expiry := make([]byte, 8)
+		binary.LittleEndian.PutUint64(expiry, uint64(record.expiry))
+		payload = append(payload, expiry...)
+	}
+	payload = append(payload, record.value...)
+
+	buffer := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buffer[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buffer[4:8], crc32.ChecksumIEEE(payload))
+
+	return append(buffer, payload...)
+}
+
+func decodeRecord(payload []byte) (logRecord, error) {
+	if len(payload) < 2 {
+		return logRecord{}, ErrBadRecord
+	}
+
+	keyLength, n := binary.Uvarint(payload[1:])
+	if n <= 0 || keyLength > uint64(len(payload)-1-n) {
+		return logRecord{}, ErrBadRecord
+	}
+
+	keyStart := 1 + n
+	keyEnd := keyStart + int(keyLength)
+
+	record := logRecord{
+		op:  payload[0],
+		key: string(payload[keyStart:keyEnd]),
+	}
+
+	switch record.op {
+	case opPut, opDelete, opPersist:
+		record.value = string(payload[keyEnd:])
+	case opPutExpiring:
+		if len(payload)-keyEnd < 8 {
+			return logRecord{}, ErrBadRecord
+		}
+		record.expiry = int64(binary.LittleEndian.Uint64(payload[keyEnd : keyEnd+8]))
+		record.value = string(payload[keyEnd+8:])
+	case opBatch:
+		batch, err := decodeBatch(payload[keyEnd:])
+		if err != nil {
+			return logRecord{}, err
+		}
+		record.batch = batch
+	default:
+		return logRecord{}, ErrBadRecord
+	}
+
+	return record, nil
+}
+
+// The records inside an opBatch, all of them or an error
+func decodeBatch(data []byte) ([]logRecord, error) {
+	var batch []logRecord
+	for len(data) > 0 {
+		if len(data) < recordHeaderSize {
+			return nil, ErrBadRecord
+		}
+
+		length := binary.LittleEndian.Uint32(data[0:4])
+		checksum := binary.LittleEndian.Uint32(data[4:8])
+		if uint64(length) > uint64(len(data)-recordHeaderSize) {
+			return nil, ErrBadRecord
+		}
+
+		payload := data[recordHeaderSize : recordHeaderSize+int(length)]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return nil, ErrBadRecord
+		}
+
+		record, err := decodeRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		if record.op == opBatch {
+			// Batches don't nest
+			return nil, ErrBadRecord
+		}
+		batch = append(batch, record)
+		data = data[recordHeaderSize+int(length):]
+	}
+	return batch, nil
+}
+
+// Feed every intact record in the log at path to apply. A torn or corrupt
+// record means we crashed part way through a write, so the log is cut back to
+// the last good record rather than failing.
+func replayLog(path string, apply func(logRecord)) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, recordHeaderSize)
+	var good int64
+
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+
+		// A corrupt length could claim gigabytes, don't trust it past the end of the file
+		if int64(length) > info.Size()-good-recordHeaderSize {
+			break
+		}
+
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		record, err := decodeRecord(payload)
+		if err != nil {
+			break
+		}
+
+		apply(record)
+		good += recordHeaderSize + int64(length)
+	}
+
+	log.Printf("Truncating torn log record at offset %d in %s\n", good, path)
+
+	if err := file.Truncate(good); err != nil {
+		return err
+	}
+	return file.Sync()
+}
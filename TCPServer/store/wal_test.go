@@ -0,0 +1,141 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// Writes half of what it's given and fails while torn is set, like a full disk.
+// Sync and Truncate fail while their flags are set.
+type tornFile struct {
+	*os.File
+	torn          bool
+	truncateFails bool
+	syncFails     bool
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	if !f.torn {
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, errDiskFull
+}
+
+func (f *tornFile) Sync() error {
+	if f.syncFails {
+		return errDiskFull
+	}
+	return f.File.Sync()
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if f.truncateFails {
+		return errDiskFull
+	}
+	return f.File.Truncate(size)
+}
+
+func openTornLog(t *testing.T) (*writeAheadLog, *tornFile, string) {
+	path := filepath.Join(t.TempDir(), logFile)
+
+	wal, err := openLog(path, SyncNever, 0)
+	if err != nil {
+		t.Fatal("Failed to open log: ", err)
+	}
+	file := &tornFile{File: wal.file.(*os.File)}
+	wal.file = file
+
+	return wal, file, path
+}
+
+func replayedKeys(t *testing.T, path string) []string {
+	var keys []string
+	if err := replayLog(path, func(record logRecord) { keys = append(keys, record.key) }); err != nil {
+		t.Fatal("Replay failed: ", err)
+	}
+	return keys
+}
+
+func TestWriteAheadLogTornAppend(t *testing.T) {
+
+	t.Run("TornRecordCutBack", func(t *testing.T) {
+		wal, file, path := openTornLog(t)
+		defer wal.close()
+
+		wal.append(logRecord{op: opPut, key: "1", value: "Apple"})
+
+		file.torn = true
+		if err := wal.append(logRecord{op: opPut, key: "2", value: "Banana"}); err != errDiskFull {
+			t.Error("Expected: ", errDiskFull, " Actual: ", err)
+		}
+		file.torn = false
+
+		// Acked after the failed one, replay has to reach it
+		if err := wal.append(logRecord{op: opPut, key: "3", value: "Cherry"}); err != nil {
+			t.Fatal("Append failed: ", err)
+		}
+
+		keys := replayedKeys(t, path)
+		if len(keys) != 2 || keys[0] != "1" || keys[1] != "3" {
+			t.Error("Expected: [1 3] Actual: ", keys)
+		}
+	})
+
+	t.Run("UnsyncedRecordCutBack", func(t *testing.T) {
+		wal, file, path := openTornLog(t)
+		defer wal.close()
+		wal.policy = SyncAlways
+
+		wal.append(logRecord{op: opPut, key: "1", value: "Apple"})
+
+		// Written but never acked, so replay mustn't bring it back
+		file.syncFails = true
+		if err := wal.append(logRecord{op: opPut, key: "2", value: "Banana"}); err != errDiskFull {
+			t.Error("Expected: ", errDiskFull, " Actual: ", err)
+		}
+		file.syncFails = false
+
+		if err := wal.append(logRecord{op: opPut, key: "3", value: "Cherry"}); err != nil {
+			t.Fatal("Append failed: ", err)
+		}
+
+		keys := replayedKeys(t, path)
+		if len(keys) != 2 || keys[0] != "1" || keys[1] != "3" {
+			t.Error("Expected: [1 3] Actual: ", keys)
+		}
+	})
+
+	t.Run("StopsAppendingIfCutBackFails", func(t *testing.T) {
+		wal, file, path := openTornLog(t)
+		defer wal.close()
+
+		wal.append(logRecord{op: opPut, key: "1", value: "Apple"})
+
+		file.torn, file.truncateFails = true, true
+		wal.append(logRecord{op: opPut, key: "2", value: "Banana"})
+		file.torn, file.truncateFails = false, false
+
+		// Would be lost behind the torn record on replay, so it has to fail
+		if err := wal.append(logRecord{op: opPut, key: "3", value: "Cherry"}); !errors.Is(err, errDiskFull) {
+			t.Error("Expected: ", errDiskFull, " Actual: ", err)
+		}
+
+		// A snapshot covers everything, so the log can start over
+		if err := wal.truncate(); err != nil {
+			t.Fatal("Truncate failed: ", err)
+		}
+		if err := wal.append(logRecord{op: opPut, key: "4", value: "Date"}); err != nil {
+			t.Error("Expected: <nil> Actual: ", err)
+		}
+
+		keys := replayedKeys(t, path)
+		if len(keys) != 1 || keys[0] != "4" {
+			t.Error("Expected: [4] Actual: ", keys)
+		}
+	})
+}
@@ -1,3 +1,3 @@
-main.exe -tcpListenIP "127.0.0.1:1000" -udpListenIP "192.168.1.26:8000" -log "server1.log"
-main.exe -tcpListenIP "127.0.0.1:1001" -udpListenIP "192.168.1.59:8000" -log "server2.log"
-main.exe -tcpListenIP "127.0.0.1:1002" -udpListenIP "192.168.1.89:8000" -log "server3.log"
\ No newline at end of file
+main.exe -tcpListenIP "127.0.0.1:1000" -udpListenIP "127.0.0.1:8001" -peers "127.0.0.1:8001,127.0.0.1:8002,127.0.0.1:8003" -log "server1.log"
+main.exe -tcpListenIP "127.0.0.1:1001" -udpListenIP "127.0.0.1:8002" -peers "127.0.0.1:8001,127.0.0.1:8002,127.0.0.1:8003" -log "server2.log"
+main.exe -tcpListenIP "127.0.0.1:1002" -udpListenIP "127.0.0.1:8003" -peers "127.0.0.1:8001,127.0.0.1:8002,127.0.0.1:8003" -log "server3.log"
\ No newline at end of file
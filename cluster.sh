@@ -0,0 +1,12 @@
+#!/bin/sh
+# Three node cluster on this machine, stopped with ctrl-c
+go build -o server . || exit 1
+
+peers=127.0.0.1:8001,127.0.0.1:8002,127.0.0.1:8003
+
+./server -tcpListenIP 127.0.0.1:1000 -udpListenIP 127.0.0.1:8001 -peers $peers -log server1.log &
+./server -tcpListenIP 127.0.0.1:1001 -udpListenIP 127.0.0.1:8002 -peers $peers -log server2.log &
+./server -tcpListenIP 127.0.0.1:1002 -udpListenIP 127.0.0.1:8003 -peers $peers -log server3.log &
+
+trap 'kill $(jobs -p) 2>/dev/null' INT TERM
+wait
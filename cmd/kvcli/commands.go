@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Emanuel-Nunes/Go-TCPServer/client"
+)
+
+var errUnterminated = errors.New("Unterminated quote or escape")
+
+// Keys asked for in each scn round trip
+const scanPageSize = 100
+
+// args is the exact number of args, or for a batch command minus the args in
+// each entry
+type commandSpec struct {
+	args  int
+	usage string
+}
+
+var commands = map[string]commandSpec{
+	"get": {1, "get KEY"},
+	"put": {2, "put KEY VALUE"},
+	"pex": {3, "pex KEY VALUE TTL (milliseconds or a duration such as 10s)"},
+	"del": {1, "del KEY"},
+	"ttl": {1, "ttl KEY"},
+	"per": {1, "per KEY (remove the expiry)"},
+	"sts": {0, "sts"},
+	"sdn": {1, "sdn TOKEN (shut the server down)"},
+	"cas": {3, "cas KEY EXPECTED VALUE (compare and swap)"},
+	"pnx": {2, "pnx KEY VALUE (put if absent)"},
+	"pxx": {2, "pxx KEY VALUE (put if exists)"},
+	"inc": {2, "inc KEY DELTA"},
+	"dec": {2, "dec KEY DELTA"},
+	"scn": {1, "scn PATTERN (every matching key, * for all)"},
+	"cnt": {0, "cnt"},
+	"rng": {3, "rng START END LIMIT (keys from START to END, \"\" for open)"},
+	"rrg": {3, "rrg START END LIMIT (rng in reverse)"},
+	"mgt": {-1, "mgt KEY [KEY ...]"},
+	"mpt": {-2, "mpt KEY VALUE [KEY VALUE ...] (all or nothing)"},
+	"mdl": {-1, "mdl KEY [KEY ...]"},
+	"mem": {0, "mem (cluster members and their state)"},
+	"mad": {2, "mad TOKEN ADDRESS (add a raft member by its cluster address)"},
+	"mrm": {2, "mrm TOKEN ADDRESS (remove a raft member)"},
+}
+
+type session struct {
+	client  *client.Client
+	out     io.Writer
+	json    bool
+	timeout time.Duration
+}
+
+// What came back for one command
+type reply struct {
+	command  string
+	key      string
+	value    *string // set for get, even when the value is empty
+	ttl      *time.Duration
+	stats    map[string]int64
+	keys     []string          // mgt, in the order asked for
+	values   map[string]string // mgt, missing keys left out
+	deleted  *int
+	written  *bool // conditional puts, false when the condition wasn't met
+	counter  *int64
+	list     []string       // scn
+	entries  []client.Entry // rng and rrg, in the order read
+	members  []client.Member
+	notFound bool
+	help     string
+	err      error
+}
+
+// Run one command and print the reply, false if it failed
+func (s *session) run(args []string) bool {
+	r := s.execute(args)
+	s.print(r)
+	return r.err == nil
+}
+
+func (s *session) execute(args []string) reply {
+	name := strings.ToLower(args[0])
+	r := reply{command: name}
+
+	if name == "help" {
+		r.help = usage()
+		return r
+	}
+
+	spec, ok := commands[name]
+	if !ok {
+		r.err = fmt.Errorf("Unknown command %q, try help", args[0])
+		return r
+	}
+
+	if !spec.accepts(len(args) - 1) {
+		r.err = fmt.Errorf("Usage: %s", spec.usage)
+		return r
+	}
+
+	if spec.args > 0 && name != "sdn" && name != "scn" && name != "rng" && name != "rrg" && name != "mad" && name != "mrm" {
+		r.key = args[1]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	switch name {
+	case "get":
+		value, err := s.client.Get(ctx, r.key)
+		if errors.Is(err, client.ErrNotFound) {
+			r.notFound = true
+		} else if err != nil {
+			r.err = err
+		} else {
+			r.value = &value
+		}
+	case "put":
+		r.err = s.client.Put(ctx, r.key, args[2])
+	case "pex":
+		ttl, err := parseTTL(args[3])
+		if err != nil {
+			r.err = err
+			return r
+		}
+		r.err = s.client.PutWithTTL(ctx, r.key, args[2], ttl)
+	case "del":
+		r.err = s.client.Delete(ctx, r.key)
+	case "ttl":
+		ttl, err := s.client.TTL(ctx, r.key)
+		if errors.Is(err, client.ErrNotFound) {
+			r.notFound = true
+		} else if err != nil {
+			r.err = err
+		} else {
+			r.ttl = &ttl
+		}
+	case "per":
+		r.err = s.client.Persist(ctx, r.key)
+	case "sts":
+		r.stats, r.err = s.client.Stats(ctx)
+	case "sdn":
+		r.err = s.client.Shutdown(ctx, args[1])
+	case "mad":
+		r.err = s.client.AddMember(ctx, args[1], args[2])
+	case "mrm":
+		r.err = s.client.RemoveMember(ctx, args[1], args[2])
+	case "cas", "pnx", "pxx":
+		var written bool
+		switch name {
+		case "cas":
+			written, r.err = s.client.CompareAndSwap(ctx, r.key, args[2], args[3])
+		case "pnx":
+			written, r.err = s.client.PutIfAbsent(ctx, r.key, args[2])
+		case "pxx":
+			written, r.err = s.client.PutIfExists(ctx, r.key, args[2])
+		}
+		r.written = &written
+	case "inc", "dec":
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			r.err = fmt.Errorf("Bad delta %q", args[2])
+			return r
+		}
+
+		var value int64
+		if name == "inc" {
+			value, r.err = s.client.Increment(ctx, r.key, delta)
+		} else {
+			value, r.err = s.client.Decrement(ctx, r.key, delta)
+		}
+		r.counter = &value
+	case "scn":
+		r.list, r.err = s.scanAll(ctx, args[1])
+	case "rng", "rrg":
+		limit, err := strconv.Atoi(args[3])
+		if err != nil {
+			r.err = fmt.Errorf("Bad limit %q", args[3])
+			return r
+		}
+
+		read := s.client.Range
+		if name == "rrg" {
+			read = s.client.ReverseRange
+		}
+
+		r.entries, r.err = read(ctx, args[1], args[2], limit)
+		if r.err == nil && r.entries == nil {
+			r.entries = []client.Entry{}
+		}
+	case "cnt":
+		var n int64
+		n, r.err = s.client.Count(ctx)
+		r.counter = &n
+	case "mem":
+		r.members, r.err = s.client.Members(ctx)
+		if r.err == nil && r.members == nil {
+			r.members = []client.Member{}
+		}
+	case "mgt":
+		r.keys = args[1:]
+		r.values, r.err = s.client.GetMany(ctx, r.keys...)
+	case "mpt":
+		entries := make(map[string]string)
+		for i := 1; i+1 < len(args); i += 2 {
+			entries[args[i]] = args[i+1]
+		}
+		r.err = s.client.PutMany(ctx, entries)
+	case "mdl":
+		deleted, err := s.client.DeleteMany(ctx, args[1:]...)
+		r.deleted, r.err = &deleted, err
+	}
+
+	return r
+}
+
+// Follow the cursor to the end, a page at a time so the server is never
+// asked for everything at once
+func (s *session) scanAll(ctx context.Context, pattern string) ([]string, error) {
+	keys := []string{}
+	cursor := ""
+
+	for {
+		page, next, err := s.client.Scan(ctx, cursor, pattern, scanPageSize)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+func (spec commandSpec) accepts(n int) bool {
+	if spec.args >= 0 {
+		return n == spec.args
+	}
+	return n > 0 && n%-spec.args == 0
+}
+
+// Plain milliseconds like the wire protocol, or a Go duration
+func parseTTL(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad TTL %q", s)
+	}
+	return ttl, nil
+}
+
+func (s *session) print(r reply) {
+	if s.json {
+		s.printJSON(r)
+		return
+	}
+
+	switch {
+	case r.err != nil:
+		fmt.Fprintf(s.out, "(error) %v\n", r.err)
+	case r.help != "":
+		fmt.Fprint(s.out, r.help)
+	case r.notFound:
+		fmt.Fprintln(s.out, "(nil)")
+	case r.value != nil:
+		// Quoted so an empty value can't be mistaken for nothing
+		fmt.Fprintln(s.out, strconv.Quote(*r.value))
+	case r.ttl != nil && *r.ttl == client.NoExpiry:
+		fmt.Fprintln(s.out, "(no expiry)")
+	case r.ttl != nil:
+		fmt.Fprintln(s.out, *r.ttl)
+	case r.stats != nil:
+		for _, name := range sortedKeys(r.stats) {
+			fmt.Fprintf(s.out, "%s=%d\n", name, r.stats[name])
+		}
+	case r.list != nil:
+		for _, key := range r.list {
+			fmt.Fprintln(s.out, strconv.Quote(key))
+		}
+		if len(r.list) == 0 {
+			fmt.Fprintln(s.out, "(empty)")
+		}
+	case r.entries != nil:
+		for _, entry := range r.entries {
+			fmt.Fprintf(s.out, "%s: %s\n", entry.Key, strconv.Quote(entry.Value))
+		}
+		if len(r.entries) == 0 {
+			fmt.Fprintln(s.out, "(empty)")
+		}
+	case r.members != nil:
+		for _, member := range r.members {
+			fmt.Fprintf(s.out, "%s %s %d\n", member.Address, member.State, member.Incarnation)
+		}
+		if len(r.members) == 0 {
+			fmt.Fprintln(s.out, "(empty)")
+		}
+	case r.keys != nil:
+		for _, key := range r.keys {
+			if value, ok := r.values[key]; ok {
+				fmt.Fprintf(s.out, "%s: %s\n", key, strconv.Quote(value))
+			} else {
+				fmt.Fprintf(s.out, "%s: (nil)\n", key)
+			}
+		}
+	case r.deleted != nil:
+		fmt.Fprintf(s.out, "%d deleted\n", *r.deleted)
+	case r.counter != nil:
+		fmt.Fprintln(s.out, *r.counter)
+	case r.written != nil && !*r.written:
+		fmt.Fprintln(s.out, "(not written)")
+	default:
+		fmt.Fprintln(s.out, "OK")
+	}
+}
+
+// One object per line so scripts can read the output a line at a time
+func (s *session) printJSON(r reply) {
+	object := map[string]interface{}{
+		"command": r.command,
+		"ok":      r.err == nil,
+	}
+
+	if r.key != "" {
+		object["key"] = r.key
+	}
+	if r.notFound {
+		object["found"] = false
+	}
+	if r.value != nil {
+		object["found"] = true
+		object["value"] = *r.value
+	}
+	if r.ttl != nil {
+		object["ttlMs"] = r.ttl.Milliseconds()
+		if *r.ttl == client.NoExpiry {
+			object["ttlMs"] = -1
+		}
+	}
+	if r.stats != nil {
+		object["stats"] = r.stats
+	}
+	if r.keys != nil && r.err == nil {
+		// Missing keys come out as null
+		values := make(map[string]interface{}, len(r.keys))
+		for _, key := range r.keys {
+			values[key] = nil
+			if value, ok := r.values[key]; ok {
+				values[key] = value
+			}
+		}
+		object["values"] = values
+	}
+	if r.deleted != nil && r.err == nil {
+		object["deleted"] = *r.deleted
+	}
+	if r.list != nil {
+		object["keys"] = r.list
+	}
+	if r.entries != nil {
+		entries := make([]map[string]string, len(r.entries))
+		for i, entry := range r.entries {
+			entries[i] = map[string]string{"key": entry.Key, "value": entry.Value}
+		}
+		object["entries"] = entries
+	}
+	if r.members != nil {
+		members := make([]map[string]interface{}, len(r.members))
+		for i, member := range r.members {
+			members[i] = map[string]interface{}{"address": member.Address, "state": member.State, "incarnation": member.Incarnation}
+		}
+		object["members"] = members
+	}
+	if r.counter != nil && r.err == nil {
+		object["value"] = *r.counter
+	}
+	if r.written != nil && r.err == nil {
+		object["written"] = *r.written
+	}
+	if r.help != "" {
+		object["help"] = r.help
+	}
+	if r.err != nil {
+		object["error"] = errorObject(r.err)
+	}
+
+	encoded, _ := json.Marshal(object)
+	fmt.Fprintln(s.out, string(encoded))
+}
+
+// Server errors keep their code, anything that went wrong on our side is
+// reported as client
+func errorObject(err error) map[string]string {
+	var serverErr *client.ServerError
+	if errors.As(err, &serverErr) {
+		return map[string]string{"code": serverErr.Code, "message": serverErr.Message}
+	}
+	return map[string]string{"code": "client", "message": err.Error()}
+}
+
+func usage() string {
+	var sb strings.Builder
+	for _, name := range sortedKeys(commands) {
+		fmt.Fprintf(&sb, "  %s\n", commands[name].usage)
+	}
+	sb.WriteString("  quit\n")
+	return sb.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Split a line on spaces. Double quotes keep spaces in an arg and allow an
+// empty one, a backslash takes the next character as is.
+func tokenize(line string) ([]string, error) {
+	var (
+		args     []string
+		current  strings.Builder
+		inWord   bool
+		inQuotes bool
+		escaped  bool
+	)
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inWord = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if inQuotes || escaped {
+		return nil, errUnterminated
+	}
+	if inWord {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
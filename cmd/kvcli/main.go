@@ -0,0 +1,132 @@
+// kvcli talks to a DataServer from a terminal or a script, so nobody has to
+// work out length prefixes by hand.
+//
+//	kvcli -tcpListenIP 127.0.0.1:1234            interactive prompt
+//	kvcli -file commands.txt                     run a script, - reads stdin
+//	kvcli -json get foo                          run one command
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Emanuel-Nunes/Go-TCPServer/client"
+)
+
+// Longest line a script may contain, enough for a value of the server's
+// default maximum size
+const maxLineSize = 64*1024*1024 + 1024
+
+func main() {
+	var (
+		tcpListenIP string
+		jsonOutput  bool
+		file        string
+		timeout     time.Duration
+		consistency string
+	)
+
+	flag.StringVar(&tcpListenIP, "tcpListenIP", "127.0.0.1:1234", "address of the server to connect to")
+	flag.BoolVar(&jsonOutput, "json", false, "print each response as a JSON object")
+	flag.StringVar(&file, "file", "", "run the commands in this file, - for stdin")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "how long to wait for each response")
+	flag.StringVar(&consistency, "consistency", "", "members that must have a write before it is acked: one, quorum or all, the server's default if empty")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c, err := client.Dial(ctx, tcpListenIP, client.Options{PoolSize: 1, Consistency: consistency})
+	cancel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to connect:", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	session := &session{
+		client:  c,
+		out:     os.Stdout,
+		json:    jsonOutput,
+		timeout: timeout,
+	}
+
+	// A command on the command line runs once
+	if flag.NArg() > 0 {
+		if !session.run(flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var input io.Reader = os.Stdin
+	interactive := file == "" && isTerminal(os.Stdin)
+
+	if file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	if !session.repl(input, interactive) {
+		os.Exit(1)
+	}
+}
+
+// Read commands a line at a time until the input ends or the user quits.
+// Scripts carry on past a failed command, the result says if any failed.
+func (s *session) repl(input io.Reader, interactive bool) bool {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	ok := true
+	for {
+		if interactive {
+			fmt.Fprint(s.out, "> ")
+		}
+
+		if !scanner.Scan() {
+			break
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		args, err := tokenize(line)
+		if err != nil {
+			s.print(reply{command: line, err: err})
+			ok = false
+			continue
+		}
+
+		if args[0] == "quit" || args[0] == "exit" {
+			break
+		}
+
+		if !s.run(args) {
+			ok = false
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read input:", err)
+		return false
+	}
+
+	return ok
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"client"
+	"context"
+	"dataServer"
+	"fmt"
+	"store"
+	"strings"
+	"testing"
+	"time"
+)
+
+const address = "localhost:1434"
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []string
+	}{
+		{"get foo", []string{"get", "foo"}},
+		{"  put   foo bar  ", []string{"put", "foo", "bar"}},
+		{`put foo "hello world"`, []string{"put", "foo", "hello world"}},
+		{`put foo ""`, []string{"put", "foo", ""}},
+		{`put "a b"c d\ e`, []string{"put", "a bc", "d e"}},
+		{`put foo \"bar\"`, []string{"put", "foo", `"bar"`}},
+	}
+
+	for _, test := range tests {
+		actual, err := tokenize(test.line)
+		if err != nil || fmt.Sprint(actual) != fmt.Sprint(test.expected) || len(actual) != len(test.expected) {
+			t.Error(fmt.Sprintf("Expected: %q, Actual: %q %v", test.expected, actual, err))
+		}
+	}
+
+	for _, line := range []string{`put foo "bar`, `put foo bar\`} {
+		if _, err := tokenize(line); err != errUnterminated {
+			t.Error(fmt.Sprintf("Expected: %v, Actual: %v", errUnterminated, err))
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	server := dataServer.NewDataServer(store.NewDataStore(), true, "server.log", "")
+	go server.InitClientListener(address)
+	defer server.Shutdown(context.Background())
+
+	var c *client.Client
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = client.Dial(context.Background(), address, client.Options{PoolSize: 1}); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Failed to connect: %v", err))
+	}
+	defer c.Close()
+
+	script := strings.Join([]string{
+		"# comment",
+		`put foo "hello world"`,
+		"get foo",
+		"put empty \"\"",
+		"get empty",
+		"del foo",
+		"get foo",
+		"del foo",
+		"pex foo bar 1h",
+		"per foo",
+		"ttl foo",
+		"bad",
+		"mpt a 1 b",
+		"mpt a 1 b 2",
+		"mgt b c a",
+		"mdl a b c",
+		"pnx a 1",
+		"pnx a 2",
+		"cas a 1 2",
+		"inc n 5",
+		"dec n 2",
+		"scn *",
+		"cnt",
+		`rrg "" "" 2`,
+		"mem",
+		"mad token 127.0.0.1:8004",
+		"quit",
+		"get empty",
+	}, "\n")
+
+	t.Run("Human", func(t *testing.T) {
+		var out bytes.Buffer
+		s := &session{client: c, out: &out, timeout: time.Second}
+
+		if s.repl(strings.NewReader(script), false) {
+			t.Error("Expected the script to report a failure")
+		}
+
+		expected := strings.Join([]string{
+			"OK",
+			`"hello world"`,
+			"OK",
+			`""`,
+			"OK",
+			"(nil)",
+			"(error) missing_key: Unknown key",
+			"OK",
+			"OK",
+			"(no expiry)",
+			`(error) Unknown command "bad", try help`,
+			"(error) Usage: mpt KEY VALUE [KEY VALUE ...] (all or nothing)",
+			"OK",
+			`b: "2"`,
+			"c: (nil)",
+			`a: "1"`,
+			"2 deleted",
+			"OK",
+			"(not written)",
+			"OK",
+			"5",
+			"3",
+			`"a"`,
+			`"empty"`,
+			`"foo"`,
+			`"n"`,
+			"4",
+			`n: "3"`,
+			`foo: "bar"`,
+			"(empty)",
+			"(error) unauthorized: Bad admin token",
+		}, "\n") + "\n"
+
+		if out.String() != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, out.String()))
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var out bytes.Buffer
+		s := &session{client: c, out: &out, json: true, timeout: time.Second}
+
+		s.repl(strings.NewReader("put foo bar\nget foo\nget missing\ndel missing\nmgt foo missing\nmdl foo missing\npxx foo bar\n"), false)
+
+		expected := strings.Join([]string{
+			`{"command":"put","key":"foo","ok":true}`,
+			`{"command":"get","found":true,"key":"foo","ok":true,"value":"bar"}`,
+			`{"command":"get","found":false,"key":"missing","ok":true}`,
+			`{"command":"del","error":{"code":"missing_key","message":"Unknown key"},"key":"missing","ok":false}`,
+			`{"command":"mgt","ok":true,"values":{"foo":"bar","missing":null}}`,
+			`{"command":"mdl","deleted":1,"ok":true}`,
+			`{"command":"pxx","key":"foo","ok":true,"written":false}`,
+		}, "\n") + "\n"
+
+		if out.String() != expected {
+			t.Error(fmt.Sprintf("Expected: %s, Actual: %s", expected, out.String()))
+		}
+	})
+}
@@ -1,3 +1,3 @@
 module github.com/Emanuel-Nunes/Go-TCPServer
 
-go 1.17
\ No newline at end of file
+go 1.18
\ No newline at end of file
@@ -1,5 +1,12 @@
 module harness
 
-go 1.16
+go 1.18
 
-require github.com/sirupsen/logrus v1.8.1
+require (
+	github.com/Emanuel-Nunes/Go-TCPServer v0.0.0-00010101000000-000000000000
+	github.com/sirupsen/logrus v1.8.1
+)
+
+require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+
+replace github.com/Emanuel-Nunes/Go-TCPServer => ../
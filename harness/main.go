@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
 	"os"
+	"time"
 
+	"github.com/Emanuel-Nunes/Go-TCPServer/TCPServer/client"
 	"github.com/sirupsen/logrus"
 )
 
@@ -26,69 +29,136 @@ func main() {
 		logrus.Fatal("Please provide an address!")
 	}
 
-	c, err := net.Dial("tcp", os.Args[1])
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c, err := client.Dial(ctx, os.Args[1], client.Options{})
 
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to startup")
 	}
 
-	write(c, "put11k11v")
-	assert(c, "ack")
+	assert("put", c.Put(ctx, "k", "v"), nil)
+
+	v, err := c.Get(ctx, "k")
+	assertValue("get", v, err, "v")
 
-	write(c, "get11k")
-	assert(c, "val11v")
+	_, err = c.Get(ctx, "v")
+	assert("get", err, client.ErrNotFound)
 
-	write(c, "get11v")
-	assert(c, "nil")
+	assert("del", c.Delete(ctx, "k"), nil)
 
-	write(c, "get21v")
-	assert(c, "err")
+	_, err = c.Get(ctx, "k")
+	assert("get", err, client.ErrNotFound)
 
-	write(c, "del11k")
-	assert(c, "ack")
+	// Empty values are stored and are not the same as a missing key
+	assert("put", c.Put(ctx, "e", ""), nil)
 
-	write(c, "get11k")
-	assert(c, "nil")
+	v, err = c.Get(ctx, "e")
+	assertValue("get", v, err, "")
+
+	assert("del", c.Delete(ctx, "e"), nil)
 
 	_ = c.Close()
 
-	c, err = net.Dial("tcp", os.Args[1])
+	c, err = client.Dial(ctx, os.Args[1], client.Options{})
 
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to reconnect")
 	}
+	defer c.Close()
+
+	assert("del", c.Delete(ctx, "v"), client.ErrNotFound)
+	assert("put", c.Put(ctx, key, value), nil)
+
+	v, err = c.Get(ctx, key)
+	assertValue("get", v, err, value)
+
+	assert("del", c.Delete(ctx, key), nil)
+
+	// Expiry
+	assert("pex", c.PutWithTTL(ctx, "t", "v", time.Hour), nil)
+
+	ttl, err := c.TTL(ctx, "t")
+	assert("ttl", err, nil)
+	if ttl <= 0 || ttl > time.Hour {
+		fail(fmt.Sprintf("%v", ttl), "under 1h")
+	}
+
+	assert("per", c.Persist(ctx, "t"), nil)
+
+	ttl, err = c.TTL(ctx, "t")
+	assertValue("ttl", ttl.String(), err, client.NoExpiry.String())
+
+	// Several commands in one write
+	results, err := c.Pipeline().Put("a", "1").Get("a").Delete("a").Get("a").Exec(ctx)
+	assert("pipeline", err, nil)
+	if len(results) != 4 || results[1].Value != "1" || !errors.Is(results[3].Err, client.ErrNotFound) {
+		fail(fmt.Sprintf("%v", results), "[{} {1} {} {missing_key}]")
+	}
+
+	// Conditional puts
+	written, err := c.PutIfAbsent(ctx, "c", "1")
+	assertValue("pnx", fmt.Sprint(written), err, "true")
+
+	written, err = c.CompareAndSwap(ctx, "c", "2", "3")
+	assertValue("cas", fmt.Sprint(written), err, "false")
+
+	written, err = c.CompareAndSwap(ctx, "c", "1", "2")
+	assertValue("cas", fmt.Sprint(written), err, "true")
+
+	assert("del", c.Delete(ctx, "c"), nil)
+
+	// Counters
+	n, err := c.Increment(ctx, "n", 5)
+	assertValue("inc", fmt.Sprint(n), err, "5")
+
+	n, err = c.Decrement(ctx, "n", 2)
+	assertValue("dec", fmt.Sprint(n), err, "3")
+
+	assert("del", c.Delete(ctx, "n"), nil)
+
+	// Batches
+	assert("mpt", c.PutMany(ctx, map[string]string{"b1": "1", "b2": "2"}), nil)
+
+	values, err := c.GetMany(ctx, "b1", "b2", "b3")
+	assertValue("mgt", fmt.Sprint(values), err, "map[b1:1 b2:2]")
+
+	deleted, err := c.DeleteMany(ctx, "b1", "b2", "b3")
+	assertValue("mdl", fmt.Sprint(deleted), err, "2")
+
+	_, err = c.Stats(ctx)
+	assert("sts", err, nil)
 
-	write(c, "del11v")
-	assert(c, "ack")
-	write(c, "put226"+key+"3513"+value)
-	assert(c, "ack")
-	write(c, "get226"+key)
-	assert(c, "val3513"+value)
-	write(c, "del226"+key)
-	assert(c, "ack")
-	write(c, "bye")
 	fmt.Println("DONE")
 }
 
-func write(c net.Conn, s string) {
-	fmt.Printf("%s ... ", s[:3])
+// Print PASS if err is want, otherwise stop with FAIL
+func assert(name string, err error, want error) {
+	fmt.Printf("%s ... ", name)
 
-	if _, err := c.Write([]byte(s)); err != nil {
-		logrus.WithError(err).Fatal("Write error")
+	if !errors.Is(err, want) {
+		fail(fmt.Sprintf("%v", err), fmt.Sprintf("%v", want))
 	}
+
+	fmt.Println("PASS")
 }
 
-func assert(c net.Conn, expect string) {
-	b := make([]byte, len(expect))
+func assertValue(name string, got string, err error, want string) {
+	fmt.Printf("%s ... ", name)
 
-	if _, err := c.Read(b); err != nil {
-		logrus.WithError(err).Fatal("Read error")
+	if err != nil {
+		logrus.WithError(err).Fatal("Request error")
 	}
 
-	if string(b) != expect {
-		fmt.Printf("FAIL (got %s, want %s)\n", string(b), expect)
-		os.Exit(-1)
-	} else {
-		fmt.Println("PASS")
+	if got != want {
+		fail(got, want)
 	}
+
+	fmt.Println("PASS")
+}
+
+func fail(got, want string) {
+	fmt.Printf("FAIL (got %s, want %s)\n", got, want)
+	os.Exit(-1)
 }
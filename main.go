@@ -1,35 +1,184 @@
-package main
-
-import (
-	"flag"
-	"fmt"
-
-	"github.com/Emanuel-Nunes/Go-TCPServer/dataServer"
-	"github.com/Emanuel-Nunes/Go-TCPServer/store"
-)
-
-func main() {
-	var (
-		tcpListenIP string
-		udpListenIP string
-		standAlone  bool
-		logFile     string
-	)
-
-	flag.StringVar(&tcpListenIP, "tcpListenIP", "127.0.0.1:1234", "port for tcp listener")
-	flag.StringVar(&udpListenIP, "udpListenIP", "127.0.0.1:8000", "ip:port for udp listener")
-	flag.BoolVar(&standAlone, "standalone", false, "set if using server outside of a cluster")
-	flag.StringVar(&logFile, "log", "server.log", "log file name")
-	flag.Parse()
-
-	fmt.Println(standAlone)
-
-	dataServer := dataServer.NewDataServer(store.NewDataStore(), standAlone, logFile, udpListenIP)
-
-	if !standAlone {
-		dataServer.SetupUDPConn()
-		go dataServer.InitClusterListener()
-	}
-
-	dataServer.InitClientListener(tcpListenIP)
-}
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/Emanuel-Nunes/Go-TCPServer/dataServer"
+	"github.com/Emanuel-Nunes/Go-TCPServer/store"
+)
+
+func main() {
+	var (
+		tcpListenIP     string
+		udpListenIP     string
+		advertiseAddr   string
+		standAlone      bool
+		logFile         string
+		maxArgSize      int
+		adminToken      string
+		shutdownTimeout time.Duration
+		dataDir         string
+		snapshotEvery   time.Duration
+		fsync           string
+		compactSize     int64
+		maxMemory       int64
+		eviction        string
+		shards          int
+		requestTimeout  time.Duration
+		readOnly        bool
+		peerList        string
+		peersFile       string
+		gossip          = dataServer.DefaultGossipOptions
+		consistency     string
+		consistencyWait time.Duration
+		useRaft         bool
+		raftOptions     = dataServer.DefaultRaftOptions
+	)
+
+	flag.StringVar(&tcpListenIP, "tcpListenIP", "127.0.0.1:1234", "port for tcp listener")
+	flag.StringVar(&udpListenIP, "udpListenIP", "127.0.0.1:8000", "ip:port for udp listener, replicated writes are sent from it too")
+	flag.StringVar(&advertiseAddr, "advertiseAddr", "", "ip:port other nodes reach our udp listener on, the udpListenIP if empty. Needed when that is 0.0.0.0")
+	flag.StringVar(&peerList, "peers", "", "comma separated ip:port of other nodes' udp listeners to join the cluster through")
+	flag.StringVar(&peersFile, "peersFile", "", "file listing other nodes' udp listeners to join through, one ip:port per line")
+	flag.BoolVar(&standAlone, "standalone", false, "set if using server outside of a cluster")
+	flag.StringVar(&logFile, "log", "server.log", "log file name")
+	flag.IntVar(&maxArgSize, "maxArgSize", dataServer.DefaultMaxArgSize, "largest key or value in bytes a client may send")
+	flag.StringVar(&adminToken, "adminToken", "", "token for the sdn shutdown command, disabled if empty")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 10*time.Second, "time given to open connections to finish on shutdown")
+	flag.StringVar(&dataDir, "data-dir", "", "directory to persist the store in, in memory only if empty")
+	flag.DurationVar(&snapshotEvery, "snapshotInterval", time.Minute, "how often to snapshot the store to the data dir")
+	flag.StringVar(&fsync, "fsync", "always", "when to fsync the write ahead log: always, never or an interval such as 100ms")
+	flag.Int64Var(&compactSize, "compactSize", 64*1024*1024, "snapshot and reset the write ahead log once it grows past this many bytes")
+	flag.Int64Var(&maxMemory, "maxMemory", 0, "bytes of keys and values to hold before evicting, 0 for no limit")
+	flag.StringVar(&eviction, "eviction", "lru", "what to do when maxMemory is reached: lru, lfu, random or reject")
+	flag.IntVar(&shards, "shards", runtime.NumCPU(), "number of partitions the store is split into, each served by its own goroutine")
+	flag.DurationVar(&requestTimeout, "requestTimeout", 0, "how long a client request may wait on the store, 0 for no limit")
+	flag.BoolVar(&readOnly, "readonly", false, "refuse writes from clients, replicated writes still apply")
+	flag.DurationVar(&gossip.ProbeInterval, "probeInterval", gossip.ProbeInterval, "how often a cluster member is pinged to check it is up")
+	flag.DurationVar(&gossip.ProbeTimeout, "probeTimeout", gossip.ProbeTimeout, "wait for a ping answer before asking other members to try")
+	flag.DurationVar(&gossip.SuspectTimeout, "suspectTimeout", gossip.SuspectTimeout, "how long a member that stopped answering has before it is declared dead")
+	flag.StringVar(&consistency, "consistency", "one", "cluster members that must have a write before it is acked: one, quorum or all")
+	flag.DurationVar(&consistencyWait, "consistencyTimeout", dataServer.DefaultConsistencyTimeout, "how long a quorum or all write waits for replicas before failing")
+	flag.BoolVar(&useRaft, "raft", false, "put writes through a raft log on a leader instead of replicating them, the peers are the initial members")
+	flag.StringVar(&raftOptions.Dir, "raftDir", "", "directory to keep the raft log and snapshots in, in memory only if empty")
+	flag.BoolVar(&raftOptions.Join, "raftJoin", false, "start with no raft members and wait to be added to a running cluster with mad")
+	flag.DurationVar(&raftOptions.HeartbeatInterval, "heartbeatInterval", raftOptions.HeartbeatInterval, "how often the raft leader sends followers its log")
+	flag.DurationVar(&raftOptions.ElectionTimeout, "electionTimeout", raftOptions.ElectionTimeout, "how long a raft follower goes without hearing from the leader before standing for election")
+	flag.IntVar(&raftOptions.SnapshotEntries, "raftSnapshotEntries", raftOptions.SnapshotEntries, "raft entries applied before the log is compacted into a snapshot, 0 never compacts")
+	flag.DurationVar(&raftOptions.CommitTimeout, "commitTimeout", raftOptions.CommitTimeout, "how long a write waits to be committed in raft mode")
+	flag.Parse()
+
+	fmt.Println(standAlone)
+
+	dataStore := store.NewShardedDataStore(shards)
+
+	evictionPolicy, err := store.ParseEvictionPolicy(eviction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Set before loading any persisted data so it is held to the limit too
+	if err := dataStore.SetMemoryLimit(store.MemoryLimit{MaxMemory: maxMemory, Policy: evictionPolicy}); err != nil {
+		log.Fatal(err)
+	}
+
+	if useRaft && (standAlone || dataDir != "") {
+		// Raft keeps its own log and restores the store from its snapshots
+		log.Fatal("-raft can't be used with -standalone or -data-dir")
+	}
+
+	if useRaft && maxMemory > 0 && evictionPolicy != store.EvictReject {
+		// Every node would evict different keys, depending on its own reads
+		log.Fatal("-raft with -maxMemory needs -eviction reject")
+	}
+
+	if dataDir != "" {
+		syncPolicy, syncInterval, err := store.ParseSyncPolicy(fsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Restores the last snapshot and replays the log before we start taking requests
+		err = dataStore.EnablePersistence(dataDir, store.PersistenceOptions{
+			SnapshotInterval: snapshotEvery,
+			SyncPolicy:       syncPolicy,
+			SyncInterval:     syncInterval,
+			CompactSize:      compactSize,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	peers, err := dataServer.ParsePeers(peerList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if peersFile != "" {
+		filePeers, err := dataServer.LoadPeersFile(peersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		peers = append(peers, filePeers...)
+	}
+
+	if !standAlone && len(peers) == 0 {
+		log.Println("No peers given, writes won't be replicated")
+	}
+
+	consistencyLevel, err := dataServer.ParseConsistency(consistency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dataServer := dataServer.NewDataServer(dataStore, standAlone, logFile, udpListenIP)
+	dataServer.SetMaxArgSize(maxArgSize)
+	dataServer.SetAdminToken(adminToken)
+	dataServer.SetRequestTimeout(requestTimeout)
+	dataServer.SetReadOnly(readOnly)
+	dataServer.SetConsistency(consistencyLevel, consistencyWait)
+
+	if !standAlone {
+		if advertiseAddr != "" {
+			if err := dataServer.SetAdvertiseAddr(advertiseAddr); err != nil {
+				log.Fatal(err)
+			}
+		}
+		dataServer.SetPeers(peers)
+		dataServer.SetGossipOptions(gossip)
+		if useRaft {
+			if err := dataServer.EnableRaft(raftOptions); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := dataServer.SetupClusterConn(); err != nil {
+			log.Fatal(err)
+		}
+		go dataServer.InitClusterListener()
+	}
+
+	// Drain connections and stop cleanly when the deploy tooling stops us
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := dataServer.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	// Returns once a shutdown has finished
+	dataServer.InitClientListener(tcpListenIP)
+}